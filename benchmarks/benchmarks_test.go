@@ -7,7 +7,10 @@ import (
 	"bachelor-thesis/vm/compiler"
 	"bachelor-thesis/vm2"
 	"bachelor-thesis/vm3"
+	"bachelor-thesis/vm4"
 	"bachelor-thesis/vm5"
+	registerCompiler "bachelor-thesis/vm5/compiler"
+	"bachelor-thesis/vm6"
 	"bachelor-thesis/vm7"
 	"fmt"
 	"github.com/antonmedv/expr"
@@ -63,6 +66,33 @@ func Benchmark_singleStack(b *testing.B) {
 	}
 }
 
+// Benchmark_singleStackOptimized runs the sum folded to a single constant by
+// compiler.Optimize.
+func Benchmark_singleStackOptimized(b *testing.B) {
+	for i := 200; i <= 200; i++ {
+		b.Run(fmt.Sprintf("input-%d", i), func(b *testing.B) {
+			tree := parser.Parse(getSum(i))
+			program, err := compiler.Compile(tree, compiler.Optimize())
+			var out interface{}
+			vm := vm.New(program.Instructions, program.Constants)
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				err = vm.Run(nil)
+			}
+			b.StopTimer()
+			out = vm.StackTop()
+
+			if err != nil {
+				b.Fatal(err)
+			}
+			if out.(int64) != int64(i*(i+1)/2) {
+				b.Fail()
+			}
+		})
+	}
+}
+
 func Benchmark_multipleStacks(b *testing.B) {
 	for i := 200; i <= 200; i++ {
 		b.Run(fmt.Sprintf("input-%d", i), func(b *testing.B) {
@@ -123,8 +153,8 @@ func Benchmark_registerBasedSum(b *testing.B) {
 				vm.Run(nil)
 			}
 			b.StopTimer()
-			out := vm.Registers[3]
-			if out != i*(i+1)/2 {
+			out := vm.Result()
+			if out != int64(i*(i+1)/2) {
 				b.Fail()
 			}
 		})
@@ -132,6 +162,29 @@ func Benchmark_registerBasedSum(b *testing.B) {
 }
 
 // Strings
+func Benchmark_registerBasedCompiledSum(b *testing.B) {
+	for i := 200; i <= 200; i++ {
+		b.Run(fmt.Sprintf("input-%d", i), func(b *testing.B) {
+			program, err := registerCompiler.Compile(parser.Parse(getSum(i)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			vm := vm5.New(*program)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				err = vm.Run(nil)
+			}
+			b.StopTimer()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if vm.Result() != int64(i*(i+1)/2) {
+				b.Fail()
+			}
+		})
+	}
+}
+
 func Benchmark_treeTraversalStrings(b *testing.B) {
 	for i := 200; i <= 200; i++ {
 		b.Run(fmt.Sprintf("input-%d", i), func(b *testing.B) {
@@ -238,7 +291,7 @@ func Benchmark_registerBasedStrings(b *testing.B) {
 				vm.Run(nil)
 			}
 			b.StopTimer()
-			out = vm.Registers[3]
+			out = vm.Result()
 			result := concatenateStringsResult(i)
 			if out != result {
 				fmt.Println(out)
@@ -333,7 +386,7 @@ func Benchmark_reflectBasedCalls(b *testing.B) {
 }
 
 func Benchmark_registerBasedCalls(b *testing.B) {
-	env := map[string]interface{}{"add": func(a, b, c, d, e, f, g, k, l, m int) int { return a + b + c + d + e + f + g + k + l + m }}
+	env := map[string]interface{}{"add": func(a, b, c, d, e, f, g, k, l, m int64) int64 { return a + b + c + d + e + f + g + k + l + m }}
 	program := vm5.Program{
 		Instructions: []byte{
 			byte(vm5.OpStoreInt), 01, 0,
@@ -348,7 +401,7 @@ func Benchmark_registerBasedCalls(b *testing.B) {
 			byte(vm5.OpStoreInt), 10, 9,
 			byte(vm5.OpCall), 03, 10, 10, 01, 02, 03, 04, 05, 06, 07, 8, 9, 10,
 		},
-		Constants: []interface{}{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, "add"},
+		Constants: []interface{}{int64(1), int64(2), int64(3), int64(4), int64(5), int64(6), int64(7), int64(8), int64(9), int64(10), "add"},
 	}
 	var out interface{}
 	vm := vm5.New(program)
@@ -357,8 +410,8 @@ func Benchmark_registerBasedCalls(b *testing.B) {
 		vm.Run(env)
 	}
 	b.StopTimer()
-	out = vm.Registers[3]
-	if out != 55 {
+	out = vm.Result()
+	if out != int64(55) {
 		b.Fail()
 	}
 }
@@ -406,13 +459,13 @@ func Benchmark_registerBasedExpression(b *testing.B) {
 				vm.Run(nil)
 			}
 			b.StopTimer()
-			out := vm.Registers[3].(int)
+			out := vm.Result().(int64)
 			if i%2 != 0 {
-				if out != (i+1)/2 {
+				if out != int64((i+1)/2) {
 					b.Fail()
 				}
 			} else {
-				if out != -i/2 {
+				if out != int64(-i/2) {
 					b.Fail()
 				}
 			}
@@ -496,16 +549,16 @@ func Benchmark_3(b *testing.B) {
 }
 
 var env1 = map[string]interface{}{
-	"foo1":  func(a, b int) int { return a + b },
-	"foo2":  func(a, b int) int { return a - b },
-	"foo3":  func(a, b int) int { return a * b },
-	"foo4":  func(a, b int) int { return a / b },
-	"foo5":  func(a, b int) int { return a % b },
-	"foo6":  func(a, b int) int { return int(math.Pow(float64(a), float64(b))) },
-	"foo7":  func(a, b int) int { return 2*a + b },
-	"foo8":  func(a, b int) int { return a + 2*b },
-	"foo9":  func(a, b int) int { return 2*a + 2*b },
-	"foo10": func(a, b int) int { return 2*a - 2*b },
+	"foo1":  func(a, b int64) int64 { return a + b },
+	"foo2":  func(a, b int64) int64 { return a - b },
+	"foo3":  func(a, b int64) int64 { return a * b },
+	"foo4":  func(a, b int64) int64 { return a / b },
+	"foo5":  func(a, b int64) int64 { return a % b },
+	"foo6":  func(a, b int64) int64 { return int64(math.Pow(float64(a), float64(b))) },
+	"foo7":  func(a, b int64) int64 { return 2*a + b },
+	"foo8":  func(a, b int64) int64 { return a + 2*b },
+	"foo9":  func(a, b int64) int64 { return 2*a + 2*b },
+	"foo10": func(a, b int64) int64 { return 2*a - 2*b },
 }
 
 func Benchmark_registerBasedCalls2(b *testing.B) {
@@ -560,16 +613,16 @@ func Benchmark_registerBasedCalls2(b *testing.B) {
 			byte(vm5.OpCall), 04, 29, 2, 01, 02,
 			byte(vm5.OpAdd), 03, 03, 04,
 		},
-		Constants: []interface{}{1, 2, "foo1", 1, 2, "foo2", 1, 2, "foo3", 4, 2, "foo4", 5, 2, "foo5", 2, 2, "foo6",
-			1, 2, "foo7", 1, 2, "foo8", 1, 2, "foo9", 1, 2, "foo10"}}
+		Constants: []interface{}{int64(1), int64(2), "foo1", int64(1), int64(2), "foo2", int64(1), int64(2), "foo3", int64(4), int64(2), "foo4", int64(5), int64(2), "foo5", int64(2), int64(2), "foo6",
+			int64(1), int64(2), "foo7", int64(1), int64(2), "foo8", int64(1), int64(2), "foo9", int64(1), int64(2), "foo10"}}
 	vm := vm5.New(program)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		vm.Run(env1)
 	}
 	b.StopTimer()
-	out := vm.Registers[3]
-	result := (1 + 2) + (1 - 2) + (1 * 2) + (4 / 2) + (5 % 2) + int(math.Pow(float64(2), float64(2))) + (2*1 + 2) + (1 + 2*2) + (2*1 + 2*2) + (2*1 - 2*2)
+	out := vm.Result()
+	result := (1 + 2) + (1 - 2) + (1 * 2) + (4 / 2) + (5 % 2) + int64(math.Pow(float64(2), float64(2))) + (2*1 + 2) + (1 + 2*2) + (2*1 + 2*2) + (2*1 - 2*2)
 	if out != result {
 		b.Fail()
 	}
@@ -624,8 +677,66 @@ func Benchmark_booleansStringsRegister(b *testing.B) {
 	}
 	b.StopTimer()
 	result, _ = expr.Eval(input, nil)
-	out = vm.Registers[3]
+	out = vm.Result()
 	if out != result {
 		b.Fail()
 	}
 }
+
+type machine interface {
+	Run(env interface{}) error
+	StackTop() interface{}
+}
+
+var typedMachines = []struct {
+	name string
+	new  func(program *compiler.Program) machine
+}{
+	{"vm4", func(p *compiler.Program) machine { return vm4.New(p.Instructions, p.Constants) }},
+	{"vm6", func(p *compiler.Program) machine { return vm6.New(p.Instructions, p.Constants) }},
+	{"vm7", func(p *compiler.Program) machine { return vm7.New(p.Instructions, p.Constants) }},
+}
+
+// Benchmark_typedInstructions compares the generic instructions with the ones
+// selected by compiler.Typed on the machines with typed stacks.
+func Benchmark_typedInstructions(b *testing.B) {
+	inputs := []struct {
+		name     string
+		input    string
+		expected interface{}
+	}{
+		{"sum", getSum(200), int64(200 * 201 / 2)},
+		{"floats", getFloatSum(200), float64(200*201/2) + 200*0.5},
+		{"strings", concatenateStrings(200), concatenateStringsResult(200)},
+	}
+	for _, m := range typedMachines {
+		for _, input := range inputs {
+			for _, typed := range []bool{false, true} {
+				b.Run(fmt.Sprintf("%s/%s/typed-%t", m.name, input.name, typed), func(b *testing.B) {
+					var options []compiler.Option
+					if typed {
+						options = append(options, compiler.Typed(nil))
+					}
+					program, err := compiler.Compile(parser.Parse(input.input), options...)
+					if err != nil {
+						b.Fatal(err)
+					}
+					vm := m.new(program)
+
+					b.ResetTimer()
+					for n := 0; n < b.N; n++ {
+						err = vm.Run(nil)
+					}
+					b.StopTimer()
+
+					if err != nil {
+						b.Fatal(err)
+					}
+					if vm.StackTop() != input.expected {
+						b.Fatalf("got %v, expected %v", vm.StackTop(), input.expected)
+					}
+				})
+			}
+		}
+	}
+}
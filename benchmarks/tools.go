@@ -18,6 +18,14 @@ func getSum(n int) string {
 	return out
 }
 
+func getFloatSum(n int) string {
+	out := "1.5"
+	for i := 2; i <= n; i++ {
+		out += "+" + strconv.Itoa(i) + ".5"
+	}
+	return out
+}
+
 func getExpression(n int) string {
 	out := "1"
 	for i := 2; i <= n; i++ {
@@ -53,18 +61,18 @@ func generateSumBytecode(n int) vm5.Program {
 	program := vm5.Program{}
 	if n == 1 {
 		program.Instructions = []byte{byte(vm5.OpStoreInt), 03, 0}
-		program.Constants = []interface{}{1}
+		program.Constants = []interface{}{int64(1)}
 	} else {
 		program.Instructions = []byte{byte(vm5.OpStoreInt), 01, 0}
-		program.Constants = []interface{}{1}
+		program.Constants = []interface{}{int64(1)}
 		if n >= 2 {
 			program.Instructions = append(program.Instructions, byte(vm5.OpStoreInt), 02, 1)
-			program.Constants = append(program.Constants, 2)
+			program.Constants = append(program.Constants, int64(2))
 			program.Instructions = append(program.Instructions, byte(vm5.OpAdd), 03, 01, 02)
 		}
 		for i := 3; i <= n; i++ {
 			program.Instructions = append(program.Instructions, byte(vm5.OpStoreInt), 01, byte(i-1))
-			program.Constants = append(program.Constants, i)
+			program.Constants = append(program.Constants, int64(i))
 			program.Instructions = append(program.Instructions, byte(vm5.OpAdd), 03, 01, 03)
 		}
 	}
@@ -75,18 +83,18 @@ func generateExpressionBytecode(n int) vm5.Program {
 	program := vm5.Program{}
 	if n == 1 {
 		program.Instructions = []byte{byte(vm5.OpStoreInt), 03, 0}
-		program.Constants = []interface{}{1}
+		program.Constants = []interface{}{int64(1)}
 	} else {
 		program.Instructions = []byte{byte(vm5.OpStoreInt), 01, 0}
-		program.Constants = []interface{}{1}
+		program.Constants = []interface{}{int64(1)}
 		if n >= 2 {
 			program.Instructions = append(program.Instructions, byte(vm5.OpStoreInt), 02, 1)
-			program.Constants = append(program.Constants, 2)
+			program.Constants = append(program.Constants, int64(2))
 			program.Instructions = append(program.Instructions, byte(vm5.OpSub), 03, 01, 02)
 		}
 		for i := 3; i <= n; i++ {
 			program.Instructions = append(program.Instructions, byte(vm5.OpStoreInt), 01, byte(i-1))
-			program.Constants = append(program.Constants, i)
+			program.Constants = append(program.Constants, int64(i))
 			if i%2 == 0 {
 				program.Instructions = append(program.Instructions, byte(vm5.OpSub), 03, 03, 01)
 			} else {
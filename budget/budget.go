@@ -0,0 +1,119 @@
+package budget
+
+import (
+	"context"
+	"fmt"
+)
+
+// CheckInterval is the number of instructions a machine executes between two
+// checks of the context given to RunContext.
+const CheckInterval = 1024
+
+// Limits bounds a single run of a machine. A zero field leaves its resource
+// unbounded, so the zero value does not limit anything.
+type Limits struct {
+	// Instructions is the number of instructions a run may execute.
+	Instructions int
+	// StackDepth is the number of values on the stack plus one per call of a
+	// user-defined function, on vm5 the registers in use and the local slots
+	// of every call instead of the stack.
+	StackDepth int
+	// ArrayLength is the number of elements of an array literal or of the
+	// result of a comprehension.
+	ArrayLength int
+	// StringLength is the length in bytes of a string built by concatenation.
+	StringLength int
+}
+
+// InstructionLimitError is returned when a run executes more instructions
+// than Limits.Instructions.
+type InstructionLimitError struct {
+	Limit int
+}
+
+func (e *InstructionLimitError) Error() string {
+	return fmt.Sprintf("instruction limit %d exceeded", e.Limit)
+}
+
+// StackDepthError is returned when the stack grows deeper than
+// Limits.StackDepth.
+type StackDepthError struct {
+	Limit int
+}
+
+func (e *StackDepthError) Error() string {
+	return fmt.Sprintf("stack depth limit %d exceeded", e.Limit)
+}
+
+// ArrayLengthError is returned for an array longer than Limits.ArrayLength.
+type ArrayLengthError struct {
+	Limit  int
+	Length int
+}
+
+func (e *ArrayLengthError) Error() string {
+	return fmt.Sprintf("array of %d elements exceeds the limit of %d", e.Length, e.Limit)
+}
+
+// StringLengthError is returned for a concatenated string longer than
+// Limits.StringLength.
+type StringLengthError struct {
+	Limit  int
+	Length int
+}
+
+func (e *StringLengthError) Error() string {
+	return fmt.Sprintf("string of %d bytes exceeds the limit of %d", e.Length, e.Limit)
+}
+
+// InterruptedError is returned by RunContext when its context is done. Offset
+// is the position of the instruction the run stopped at, in the evaluator the
+// position of the node in the source.
+type InterruptedError struct {
+	Offset int
+	Err    error
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("interrupted at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// Interrupted returns an *InterruptedError when ctx is done.
+func Interrupted(ctx context.Context, offset int) error {
+	if err := ctx.Err(); err != nil {
+		return &InterruptedError{offset, err}
+	}
+	return nil
+}
+
+// Step checks the instructions executed so far and the current stack depth.
+// The machines call it before every instruction when any limit is set.
+func (l Limits) Step(executed, depth int) error {
+	if l.Instructions > 0 && executed > l.Instructions {
+		return &InstructionLimitError{l.Instructions}
+	}
+	if l.StackDepth > 0 && depth > l.StackDepth {
+		return &StackDepthError{l.StackDepth}
+	}
+	return nil
+}
+
+// Array checks the length of a created or extended array.
+func (l Limits) Array(length int) error {
+	if l.ArrayLength > 0 && length > l.ArrayLength {
+		return &ArrayLengthError{l.ArrayLength, length}
+	}
+	return nil
+}
+
+// Concat checks the length of a concatenated string.
+func (l Limits) Concat(length int) error {
+	if l.StringLength > 0 && length > l.StringLength {
+		return &StringLengthError{l.StringLength, length}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package budget
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUnlimited(t *testing.T) {
+	var limits Limits
+	assert.NoError(t, limits.Step(1<<30, 1<<30))
+	assert.NoError(t, limits.Array(1<<30))
+	assert.NoError(t, limits.Concat(1<<30))
+}
+
+func TestErrors(t *testing.T) {
+	limits := Limits{Instructions: 10, StackDepth: 4, ArrayLength: 2, StringLength: 8}
+	assert.NoError(t, limits.Step(10, 4))
+	assert.EqualError(t, limits.Step(11, 4), "instruction limit 10 exceeded")
+	assert.EqualError(t, limits.Step(10, 5), "stack depth limit 4 exceeded")
+	assert.NoError(t, limits.Array(2))
+	assert.EqualError(t, limits.Array(3), "array of 3 elements exceeds the limit of 2")
+	assert.NoError(t, limits.Concat(8))
+	assert.EqualError(t, limits.Concat(9), "string of 9 bytes exceeds the limit of 8")
+}
@@ -0,0 +1,242 @@
+package builtin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Builtin is a conversion function available in every expression, e.g. int("42").
+type Builtin struct {
+	Name string
+	Call func(value interface{}) (interface{}, error)
+}
+
+// Builtins is indexed by the operand of code.OpBuiltin, so new entries go to the end.
+var Builtins = []Builtin{
+	{"int", func(value interface{}) (interface{}, error) { return Int(value) }},
+	{"float", func(value interface{}) (interface{}, error) { return Float(value) }},
+	{"string", func(value interface{}) (interface{}, error) { return String(value) }},
+	{"bool", func(value interface{}) (interface{}, error) { return Bool(value) }},
+}
+
+// Types lists the type names accepted on the right side of `is`.
+var Types = []string{"int", "float", "string", "bool", "nil", "array"}
+
+func Lookup(name string) (int, bool) {
+	for i, b := range Builtins {
+		if b.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func IsType(name string) bool {
+	for _, t := range Types {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+func Int(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case float64:
+		// NaN, the infinities and values out of range have no int64
+		if !(v >= math.MinInt64 && v < math.MaxInt64) {
+			return 0, conversionError(value, "int")
+		}
+		return int64(v), nil
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return 0, conversionError(value, "int")
+		}
+		return i, nil
+	}
+	return 0, conversionError(value, "int")
+}
+
+func Float(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, conversionError(value, "float")
+		}
+		return f, nil
+	}
+	return 0, conversionError(value, "float")
+}
+
+func String(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", conversionError(value, "string")
+}
+
+func Bool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case int:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, conversionError(value, "bool")
+		}
+		return b, nil
+	}
+	return false, conversionError(value, "bool")
+}
+
+// AsBool, AsInt64 and AsFloat64 check the result of a program compiled with
+// the compiler option of the same name. Integers are widened to float64, any
+// other mismatch is an error.
+func AsBool(value interface{}) (bool, error) {
+	if b, ok := value.(bool); ok {
+		return b, nil
+	}
+	return false, resultError(value, "bool")
+}
+
+func AsInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	}
+	return 0, resultError(value, "int64")
+}
+
+func AsFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	}
+	return 0, resultError(value, "float64")
+}
+
+// Is reports whether value has the type called name in the language.
+func Is(value interface{}, name string) bool {
+	switch value.(type) {
+	case int64, int:
+		return name == "int"
+	case float64:
+		return name == "float"
+	case string:
+		return name == "string"
+	case bool:
+		return name == "bool"
+	case nil:
+		return name == "nil"
+	case []interface{}:
+		return name == "array"
+	}
+	return false
+}
+
+// Entries returns the values bound to the loop variables of a comprehension
+// on each iteration. With one variable these are the elements of an array or
+// the keys of a map, with two the index and element or the key and value.
+// Maps are iterated in key order.
+func Entries(collection interface{}, variables int) ([][]interface{}, error) {
+	value := reflect.ValueOf(collection)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		entries := make([][]interface{}, value.Len())
+		for i := range entries {
+			if variables == 2 {
+				entries[i] = []interface{}{int64(i), value.Index(i).Interface()}
+			} else {
+				entries[i] = []interface{}{value.Index(i).Interface()}
+			}
+		}
+		return entries, nil
+	case reflect.Map:
+		keys := value.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		entries := make([][]interface{}, len(keys))
+		for i, key := range keys {
+			if variables == 2 {
+				entries[i] = []interface{}{key.Interface(), value.MapIndex(key).Interface()}
+			} else {
+				entries[i] = []interface{}{key.Interface()}
+			}
+		}
+		return entries, nil
+	}
+	if collection == nil {
+		return nil, fmt.Errorf("cannot iterate over nil")
+	}
+	return nil, fmt.Errorf("cannot iterate over %T", collection)
+}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// TakesContext reports whether the first parameter of a function type is a
+// context.Context. The machines pass it themselves, the expression supplies
+// the remaining arguments.
+func TakesContext(fn reflect.Type) bool {
+	return fn.Kind() == reflect.Func && fn.NumIn() > 0 && fn.In(0) == contextType
+}
+
+// WithContext prepends ctx to the arguments of fn when it takes a context.
+func WithContext(ctx context.Context, fn reflect.Value, in []reflect.Value) []reflect.Value {
+	if fn.IsValid() && TakesContext(fn.Type()) {
+		return append([]reflect.Value{reflect.ValueOf(ctx)}, in...)
+	}
+	return in
+}
+
+func resultError(value interface{}, expected string) error {
+	if value == nil {
+		return fmt.Errorf("expected %s result, got nil", expected)
+	}
+	return fmt.Errorf("expected %s result, got %#v (%T)", expected, value, value)
+}
+
+func conversionError(value interface{}, to string) error {
+	if value == nil {
+		return fmt.Errorf("cannot convert nil to %s", to)
+	}
+	return fmt.Errorf("cannot convert %#v (%T) to %s", value, value, to)
+}
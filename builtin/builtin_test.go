@@ -0,0 +1,264 @@
+package builtin
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type conversionTest struct {
+	name     string
+	input    interface{}
+	expected interface{}
+}
+
+var conversionTests = []conversionTest{
+	{"int", "42", int64(42)},
+	{"int", " 42 ", int64(42)},
+	{"int", 4.9, int64(4)},
+	{"int", 7, int64(7)},
+	{"float", "1.5", 1.5},
+	{"float", int64(2), 2.0},
+	{"string", int64(3), "3"},
+	{"string", 2.5, "2.5"},
+	{"string", true, "true"},
+	{"bool", "true", true},
+	{"bool", int64(0), false},
+	{"bool", 1.5, true},
+}
+
+func TestBuiltins(t *testing.T) {
+	for _, test := range conversionTests {
+		index, ok := Lookup(test.name)
+		require.True(t, ok, test.name)
+		value, err := Builtins[index].Call(test.input)
+		require.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, value)
+	}
+}
+
+func TestConversionErrors(t *testing.T) {
+	_, err := Int("abc")
+	assert.EqualError(t, err, `cannot convert "abc" (string) to int`)
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1e19, -1e19} {
+		_, err = Int(f)
+		assert.EqualError(t, err, fmt.Sprintf("cannot convert %#v (float64) to int", f))
+	}
+	i, err := Int(-9.2e18)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-9.2e18), i)
+	_, err = Float(nil)
+	assert.EqualError(t, err, "cannot convert nil to float")
+	_, err = Bool("maybe")
+	assert.EqualError(t, err, `cannot convert "maybe" (string) to bool`)
+	_, err = String([]interface{}{})
+	assert.EqualError(t, err, "cannot convert []interface {}{} ([]interface {}) to string")
+}
+
+func TestResult(t *testing.T) {
+	b, err := AsBool(true)
+	require.NoError(t, err)
+	assert.Equal(t, true, b)
+	i, err := AsInt64(7)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), i)
+	f, err := AsFloat64(int64(2))
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, f)
+
+	_, err = AsBool(int64(1))
+	assert.EqualError(t, err, "expected bool result, got 1 (int64)")
+	_, err = AsInt64(1.5)
+	assert.EqualError(t, err, "expected int64 result, got 1.5 (float64)")
+	_, err = AsFloat64("1.5")
+	assert.EqualError(t, err, `expected float64 result, got "1.5" (string)`)
+	_, err = AsFloat64(nil)
+	assert.EqualError(t, err, "expected float64 result, got nil")
+}
+
+func TestIs(t *testing.T) {
+	assert.True(t, Is(int64(1), "int"))
+	assert.True(t, Is(1.0, "float"))
+	assert.True(t, Is("a", "string"))
+	assert.True(t, Is(false, "bool"))
+	assert.True(t, Is(nil, "nil"))
+	assert.True(t, Is([]interface{}{}, "array"))
+	assert.False(t, Is("1", "int"))
+}
+
+func TestEntries(t *testing.T) {
+	entries, err := Entries([]interface{}{"a", nil}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{"a"}, {nil}}, entries)
+	entries, err = Entries([]int{5}, 2)
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{int64(0), 5}}, entries)
+	entries, err = Entries(map[string]int64{"b": 2, "a": 1}, 2)
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{"a", int64(1)}, {"b", int64(2)}}, entries)
+	_, err = Entries(int64(1), 1)
+	assert.EqualError(t, err, "cannot iterate over int64")
+	_, err = Entries(nil, 1)
+	assert.EqualError(t, err, "cannot iterate over nil")
+}
+
+type Address struct {
+	City string
+	Zip  string `expr:"postcode"`
+}
+
+type Account struct {
+	*Address
+	Name   string `expr:"name"`
+	Secret string `expr:"-"`
+	Count  int64
+	hidden int64
+}
+
+func (a Account) Greet() string {
+	return "hi " + a.Name
+}
+
+func (a *Account) Increment() int64 {
+	a.Count++
+	return a.Count
+}
+
+type Keys map[string]interface{}
+
+type fetchTest struct {
+	env      interface{}
+	name     string
+	expected interface{}
+}
+
+var account = Account{Address: &Address{City: "Prague", Zip: "11000"}, Name: "ann", Count: 1}
+
+var fetchTests = []fetchTest{
+	{account, "name", "ann"},
+	{&account, "name", "ann"},
+	{account, "City", "Prague"},
+	{account, "postcode", "11000"},
+	{account, "Count", int64(1)},
+	{map[string]interface{}{"a": int64(1)}, "a", int64(1)},
+	{map[string]interface{}{}, "a", nil},
+	{map[string]int64{}, "a", int64(0)},
+	{&map[string]interface{}{"a": "b"}, "a", "b"},
+	{Keys{"a": true}, "a", true},
+}
+
+func TestFetch(t *testing.T) {
+	for _, test := range fetchTests {
+		value, err := Fetch(test.env, test.name)
+		require.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, value, test.name)
+	}
+	pointer := &Account{Name: "bob", Count: 1}
+	for _, env := range []interface{}{account, pointer} {
+		greet, err := Fetch(env, "Greet")
+		require.NoError(t, err)
+		assert.Contains(t, []string{"hi ann", "hi bob"}, greet.(func() string)())
+		increment, err := Fetch(env, "Increment")
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), increment.(func() int64)())
+	}
+	// a method with a pointer receiver is called on a copy of a struct value
+	assert.Equal(t, int64(1), account.Count)
+	assert.Equal(t, int64(2), pointer.Count)
+	for _, name := range []string{"Name", "Secret", "hidden", "Zip", "Address", "Missing"} {
+		_, err := Fetch(account, name)
+		assert.EqualError(t, err, "cannot fetch "+name+" from builtin.Account", name)
+	}
+	_, err := Fetch(Account{}, "City")
+	assert.EqualError(t, err, "cannot fetch City from builtin.Account: reflect: indirection through nil pointer to embedded struct field Address")
+	_, err = Fetch(nil, "a")
+	assert.EqualError(t, err, "cannot fetch a from <nil>")
+	for _, name := range []string{"name", "City", "Greet", "Increment"} {
+		_, err = Fetch((*Account)(nil), name)
+		assert.EqualError(t, err, "cannot fetch "+name+" from *builtin.Account", name)
+	}
+}
+
+func TestIdentifier(t *testing.T) {
+	env := map[string]int64{"a": 1}
+	for _, mode := range []Mode{Lenient, Strict} {
+		value, err := Identifier{Name: "a", Mode: mode}.Get(env)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), value)
+		_, err = Identifier{Name: "f", Pos: 4, Mode: mode, Function: true}.Get(env)
+		assert.EqualError(t, err, "unknown function `f` at col 5")
+	}
+	for _, env := range []interface{}{env, account, nil} {
+		value, err := Identifier{Name: "b", Mode: Lenient}.Get(env)
+		require.NoError(t, err)
+		assert.Nil(t, value)
+		_, err = Identifier{Name: "b", Pos: 2, Mode: Strict}.Get(env)
+		assert.EqualError(t, err, "unknown identifier `b` at col 3")
+	}
+	// a name that exists but cannot be read is not missing
+	_, err := Identifier{Name: "City", Mode: Lenient}.Get(Account{})
+	assert.Error(t, err)
+}
+
+// loader loads every name on its first lookup.
+type loader struct {
+	loads map[string]int
+}
+
+func (l *loader) Lookup(name string) (interface{}, bool) {
+	if name == "missing" {
+		return nil, false
+	}
+	l.loads[name]++
+	return "loaded " + name, true
+}
+
+func TestChain(t *testing.T) {
+	loader := &loader{loads: map[string]int{}}
+	chain := Chain{map[string]int64{"a": 1}, nil, account, loader, map[string]int64{"b": 2, "missing": 3}}
+	for _, test := range []fetchTest{
+		{chain, "a", int64(1)},
+		{chain, "name", "ann"},
+		{chain, "b", "loaded b"},
+		{chain, "missing", int64(3)},
+		{chain, "Greet", nil},
+		{Chain{}, "a", nil},
+		{Chain{map[string]int64{}}, "a", nil},
+		{Chain{Chain{loader}}, "c", "loaded c"},
+		{loader, "missing", nil},
+	} {
+		value, err := Fetch(test.env, test.name)
+		require.NoError(t, err, test.name)
+		if test.name == "Greet" {
+			assert.Equal(t, "hi ann", value.(func() string)())
+			continue
+		}
+		assert.Equal(t, test.expected, value, test.name)
+	}
+	assert.Equal(t, map[string]int{"b": 1, "c": 1}, loader.loads)
+	_, err := Identifier{Name: "x", Mode: Strict}.Get(Chain{map[string]int64{"a": 1}, account})
+	assert.EqualError(t, err, "unknown identifier `x` at col 1")
+	_, err = Fetch(Chain{Account{}}, "City")
+	assert.Error(t, err)
+	assert.Nil(t, FieldsOf(loader))
+}
+
+func TestFields(t *testing.T) {
+	fields := FieldsOf(account)
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	assert.ElementsMatch(t, []string{"name", "City", "postcode", "Count", "Greet", "Increment"}, names)
+	assert.Equal(t, reflect.TypeOf(func() int64 { return 0 }), fields["Increment"].Type)
+	assert.Same(t, fields["name"], FieldsOf(reflect.TypeOf(account))["name"])
+	// a field resolved for Account is looked up by name in another environment
+	value, err := fields["name"].Get(map[string]interface{}{"name": "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, "bob", value)
+	assert.Nil(t, FieldsOf(nil))
+	assert.Nil(t, FieldsOf(map[string]interface{}{}))
+}
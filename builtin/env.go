@@ -0,0 +1,238 @@
+package builtin
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Field is a name of a struct environment resolved for one environment type:
+// a method of the struct or of its pointer, or an exported field, possibly
+// promoted from an embedded struct. A field tagged `expr:"name"` is known by
+// that name instead of its own, `expr:"-"` hides it. Methods win over fields
+// of the same name.
+type Field struct {
+	Name string
+	// Env is the type of the environment, a struct or a pointer to one.
+	Env reflect.Type
+	// Type is the type of the value, for a method a func type without the
+	// receiver.
+	Type    reflect.Type
+	index   []int // of the field, nil for a method
+	method  int
+	pointer bool // the method has a pointer receiver and Env is not a pointer
+}
+
+var fields sync.Map // reflect.Type -> map[string]*Field
+
+// Fields returns the names of a struct environment type, nil for other types
+// and for a Resolver. They are resolved once per type.
+func Fields(t reflect.Type) map[string]*Field {
+	if cached, ok := fields.Load(t); ok {
+		return cached.(map[string]*Field)
+	}
+	resolved, _ := fields.LoadOrStore(t, resolve(t))
+	return resolved.(map[string]*Field)
+}
+
+func resolve(t reflect.Type) map[string]*Field {
+	if t.Implements(resolverType) {
+		return nil
+	}
+	s := t
+	if s.Kind() == reflect.Ptr {
+		s = s.Elem()
+	}
+	if s.Kind() != reflect.Struct {
+		return nil
+	}
+	names := make(map[string]*Field)
+	for _, field := range reflect.VisibleFields(s) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("expr"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+		if other, ok := names[name]; ok && len(other.index) <= len(field.Index) {
+			continue
+		}
+		names[name] = &Field{Name: name, Env: t, Type: field.Type, index: field.Index}
+	}
+	methods := reflect.PtrTo(s)
+	for i := 0; i < methods.NumMethod(); i++ {
+		method := methods.Method(i)
+		in := make([]reflect.Type, method.Type.NumIn()-1)
+		for j := range in {
+			in[j] = method.Type.In(j + 1)
+		}
+		out := make([]reflect.Type, method.Type.NumOut())
+		for j := range out {
+			out[j] = method.Type.Out(j)
+		}
+		field := &Field{Name: method.Name, Env: t, Type: reflect.FuncOf(in, out, method.Type.IsVariadic()), method: i}
+		if own, ok := t.MethodByName(method.Name); ok {
+			field.method = own.Index
+		} else {
+			field.pointer = true
+		}
+		names[method.Name] = field
+	}
+	return names
+}
+
+func (f *Field) String() string {
+	return f.Name
+}
+
+// FieldsOf returns the Fields of the type of env, given as a value or as a
+// reflect.Type.
+func FieldsOf(env interface{}) map[string]*Field {
+	t, ok := env.(reflect.Type)
+	if !ok {
+		t = reflect.TypeOf(env)
+	}
+	if t == nil {
+		return nil
+	}
+	return Fields(t)
+}
+
+// Get reads the field, or binds the method, in env. An env of another type
+// than the one the field was resolved for is looked up by name.
+func (f *Field) Get(env interface{}) (interface{}, error) {
+	v := reflect.ValueOf(env)
+	if !v.IsValid() || v.Type() != f.Env {
+		return Fetch(env, f.Name)
+	}
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, fmt.Errorf("cannot fetch %s from %T", f.Name, env)
+	}
+	if f.index == nil {
+		if f.pointer {
+			p := reflect.New(v.Type())
+			p.Elem().Set(v)
+			v = p
+		}
+		return v.Method(f.method).Interface(), nil
+	}
+	value, err := reflect.Indirect(v).FieldByIndexErr(f.index)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch %s from %T: %v", f.Name, env, err)
+	}
+	return value.Interface(), nil
+}
+
+// Resolver is an environment looking its names up itself, for instance loading
+// them only when a program reads them. Lookup reports whether it has the name.
+type Resolver interface {
+	Lookup(name string) (interface{}, bool)
+}
+
+var resolverType = reflect.TypeOf((*Resolver)(nil)).Elem()
+
+// Chain is an environment made of several, a name is looked up in each in
+// order and the first one having it wins.
+type Chain []interface{}
+
+// Fetch returns the value called name in env, a map with string keys or a
+// struct (see Field), or a pointer to either, a Resolver or a Chain. A name
+// missing from a map gives the zero value of its elements, one missing from a
+// Resolver or a Chain gives nil.
+func Fetch(env interface{}, name string) (interface{}, error) {
+	value, _, err := find(env, name)
+	return value, err
+}
+
+// find is Fetch also telling whether env has the name.
+func find(env interface{}, name string) (interface{}, bool, error) {
+	switch env := env.(type) {
+	case Resolver:
+		value, found := env.Lookup(name)
+		return value, found, nil
+	case Chain:
+		for _, env := range env {
+			if value, found, err := find(env, name); found {
+				return value, true, err
+			}
+		}
+		return nil, false, nil
+	}
+	v := reflect.ValueOf(env)
+	d := reflect.Indirect(v)
+	switch d.Kind() {
+	case reflect.Map:
+		if d.Type().Key().Kind() != reflect.String {
+			break
+		}
+		value := d.MapIndex(reflect.ValueOf(name).Convert(d.Type().Key()))
+		if !value.IsValid() {
+			return reflect.Zero(d.Type().Elem()).Interface(), false, nil
+		}
+		return value.Interface(), true, nil
+	case reflect.Struct:
+		if field, ok := Fields(v.Type())[name]; ok {
+			value, err := field.Get(env)
+			return value, true, err
+		}
+	}
+	return nil, false, fmt.Errorf("cannot fetch %v from %T", name, env)
+}
+
+// Mode selects what a name missing from the environment evaluates to.
+type Mode int
+
+const (
+	// Zero gives the zero value of the elements of a map environment and
+	// fails with "cannot fetch" for other environments.
+	Zero Mode = iota
+	// Lenient gives nil for every environment.
+	Lenient
+	// Strict fails with "unknown identifier `x` at col N".
+	Strict
+)
+
+// Identifier is the operand of OpLoadConst for a name the compiler could not
+// resolve, when compiling in the Lenient or Strict mode. Pos is the offset of
+// the name in the source, reported as a column counted from 1. As it differs
+// between the uses of a name, each use takes its own constant.
+type Identifier struct {
+	Name string
+	Pos  int
+	Mode Mode
+	// Function is set for a callee, which fails when missing in both modes.
+	Function bool
+}
+
+// Get returns the value of the identifier in env, a missing name handled as
+// its mode says.
+func (i Identifier) Get(env interface{}) (interface{}, error) {
+	value, found, err := find(env, i.Name)
+	switch {
+	case found:
+		return value, err
+	case i.Function:
+		return nil, fmt.Errorf("unknown function `%s` at col %d", i.Name, i.Pos+1)
+	case i.Mode == Strict:
+		return nil, fmt.Errorf("unknown identifier `%s` at col %d", i.Name, i.Pos+1)
+	}
+	return nil, nil
+}
+
+// Load reads an operand of OpLoadConst from env: a *Field resolved by the
+// compiler, an Identifier or the name to fetch.
+func Load(env interface{}, name interface{}) (interface{}, error) {
+	switch name := name.(type) {
+	case *Field:
+		return name.Get(env)
+	case Identifier:
+		return name.Get(env)
+	case string:
+		return Fetch(env, name)
+	}
+	return Fetch(env, fmt.Sprint(name))
+}
@@ -0,0 +1,529 @@
+package checker
+
+import (
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/parser/ast"
+	"fmt"
+	"reflect"
+)
+
+var (
+	intType    = reflect.TypeOf(int64(0))
+	floatType  = reflect.TypeOf(float64(0))
+	stringType = reflect.TypeOf("")
+	boolType   = reflect.TypeOf(true)
+	arrayType  = reflect.TypeOf([]interface{}{})
+	anyType    = reflect.TypeOf((*interface{})(nil)).Elem()
+
+	resolverType = reflect.TypeOf((*builtin.Resolver)(nil)).Elem()
+)
+
+// conversions are the result types of the builtins, named after the type
+// they convert to.
+var conversions = map[string]reflect.Type{
+	"int":    intType,
+	"float":  floatType,
+	"string": stringType,
+	"bool":   boolType,
+}
+
+// Schema lists the names of an environment with the types of their values.
+// Functions are described by their func type.
+type Schema map[string]reflect.Type
+
+// Error is a type error in the node at byte offset Pos of the source.
+type Error struct {
+	Pos     int
+	Message string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s at position %d", err.Message, err.Pos)
+}
+
+type checker struct {
+	env       Schema
+	open      reflect.Type
+	variables map[string]reflect.Type
+	functions map[string]*ast.FunctionNode
+	results   map[string]reflect.Type
+	annotate  bool
+	types     Types
+}
+
+// Check infers the type of every node of the tree and stores it with
+// SetValueType. The environment is described by a Schema, a reflect.Type of a
+// map or a struct, or a value of such a type; nil means an empty environment.
+// Values whose type is unknown until runtime get the type interface{} and are
+// accepted by every operation. The first error found is returned.
+func Check(node ast.Node, env interface{}) (reflect.Type, error) {
+	return run(node, env, true, nil)
+}
+
+// Infer is Check leaving the nodes as they are, for callers only interested
+// in the type of the tree or in its errors.
+func Infer(node ast.Node, env interface{}) (reflect.Type, error) {
+	return run(node, env, false, nil)
+}
+
+// Types holds the type of every node of a tree, see InferTypes.
+type Types map[ast.Node]reflect.Type
+
+// InferTypes is Infer returning the types of the nodes, for callers needing
+// them without writing into a tree others may share. The nodes checked before
+// an error keep their types.
+func InferTypes(node ast.Node, env interface{}) (Types, error) {
+	types := Types{}
+	_, err := run(node, env, false, types)
+	return types, err
+}
+
+func run(node ast.Node, env interface{}, annotate bool, types Types) (t reflect.Type, err error) {
+	c := &checker{
+		variables: make(map[string]reflect.Type),
+		functions: make(map[string]*ast.FunctionNode),
+		results:   make(map[string]reflect.Type),
+		annotate:  annotate,
+		types:     types,
+	}
+	c.env, c.open = schemaOf(env)
+	defer func() {
+		if r := recover(); r != nil {
+			checkError, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = checkError
+		}
+	}()
+	return c.check(node), nil
+}
+
+// schemaOf returns the names known in env. For a map type without values the
+// names are not known, and the element type is returned instead.
+func schemaOf(env interface{}) (Schema, reflect.Type) {
+	switch env := env.(type) {
+	case nil:
+		return Schema{}, nil
+	case Schema:
+		return env, nil
+	case map[string]reflect.Type:
+		return env, nil
+	case reflect.Type:
+		return schemaOfType(env)
+	case builtin.Resolver:
+		return Schema{}, anyType
+	case builtin.Chain:
+		return schemaOfChain(env)
+	}
+	v := reflect.ValueOf(env)
+	if v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String {
+		schema := make(Schema, v.Len())
+		for _, key := range v.MapKeys() {
+			value := v.MapIndex(key)
+			if value.Kind() == reflect.Interface {
+				value = value.Elem()
+			}
+			if value.IsValid() {
+				schema[key.String()] = value.Type()
+			} else {
+				schema[key.String()] = anyType
+			}
+		}
+		return schema, nil
+	}
+	return schemaOfType(v.Type())
+}
+
+func schemaOfType(t reflect.Type) (Schema, reflect.Type) {
+	if t.Implements(resolverType) {
+		return Schema{}, anyType
+	}
+	if t.Kind() == reflect.Map && t.Key().Kind() == reflect.String {
+		return Schema{}, t.Elem()
+	}
+	// the names a machine finds in a struct, see builtin.Field
+	schema := Schema{}
+	for name, field := range builtin.Fields(t) {
+		schema[name] = field.Type
+	}
+	return schema, nil
+}
+
+// schemaOfChain merges the schemas of the environments of a chain. A name
+// may come from an earlier open environment, then its type is only known when
+// both agree.
+func schemaOfChain(chain builtin.Chain) (Schema, reflect.Type) {
+	schema := Schema{}
+	var open reflect.Type
+	for _, env := range chain {
+		names, rest := schemaOf(env)
+		for name, t := range names {
+			if _, ok := schema[name]; !ok {
+				schema[name] = join(open, t)
+			}
+		}
+		open = join(open, rest)
+	}
+	return schema, open
+}
+
+// join returns the type of a value of type a or b, nil standing for no value.
+func join(a, b reflect.Type) reflect.Type {
+	switch {
+	case a == nil:
+		return b
+	case b == nil || a == b:
+		return a
+	}
+	return anyType
+}
+
+func (c *checker) errorf(node ast.Node, format string, args ...interface{}) {
+	panic(&Error{Pos: node.Pos(), Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) check(node ast.Node) reflect.Type {
+	t := c.infer(node)
+	if c.annotate {
+		node.SetValueType(t)
+	}
+	if c.types != nil {
+		c.types[node] = t
+	}
+	return t
+}
+
+func (c *checker) infer(node ast.Node) reflect.Type {
+	switch node.Type() {
+	case ast.NodeNumber:
+		if node.(*ast.NumberNode).IsFloat {
+			return floatType
+		}
+		return intType
+	case ast.NodeString:
+		return stringType
+	case ast.NodeBool:
+		return boolType
+	case ast.NodeNil:
+		return anyType
+	case ast.NodeIdentifier:
+		return c.identifier(node.(*ast.IdentifierNode))
+	case ast.NodeUnary:
+		return c.unary(node.(*ast.UnaryNode))
+	case ast.NodeBinary:
+		return c.binary(node.(*ast.BinaryNode))
+	case ast.NodeChain:
+		return c.chain(node.(*ast.ChainNode))
+	case ast.NodeConditional:
+		return c.conditional(node.(*ast.ConditionalNode))
+	case ast.NodeCase:
+		return c.caseWhen(node.(*ast.CaseNode))
+	case ast.NodeIs:
+		c.check(node.(*ast.IsNode).Node)
+		return boolType
+	case ast.NodeProgram:
+		return c.program(node.(*ast.ProgramNode))
+	case ast.NodeLet:
+		t := c.check(node.(*ast.LetNode).Value)
+		c.variables[node.(*ast.LetNode).Name] = t
+		return t
+	case ast.NodeFunction:
+		c.function(node.(*ast.FunctionNode))
+		return anyType
+	case ast.NodeCall:
+		return c.call(node.(*ast.CallNode))
+	case ast.NodeArray:
+		for _, element := range node.(*ast.ArrayNode).Nodes {
+			c.check(element)
+		}
+		return arrayType
+	case ast.NodeMember:
+		return c.member(node.(*ast.MemberNode))
+	case ast.NodeComprehension:
+		return c.comprehension(node.(*ast.ComprehensionNode))
+	}
+	return anyType
+}
+
+func (c *checker) identifier(node *ast.IdentifierNode) reflect.Type {
+	if t, ok := c.variables[node.Value]; ok {
+		return t
+	}
+	if t, ok := c.env[node.Value]; ok {
+		return t
+	}
+	if c.open != nil {
+		return c.open
+	}
+	c.errorf(node, "unknown identifier %s", node.Value)
+	return nil
+}
+
+func (c *checker) unary(node *ast.UnaryNode) reflect.Type {
+	t := c.check(node.Node)
+	switch {
+	case isAny(t):
+		return t
+	case node.Operator == "not" && t == boolType:
+		return t
+	case node.Operator != "not" && isNumber(t):
+		return t
+	}
+	c.errorf(node, "invalid operation: %s %s", node.Operator, t)
+	return nil
+}
+
+func (c *checker) binary(node *ast.BinaryNode) reflect.Type {
+	left := c.check(node.Left)
+	right := c.check(node.Right)
+	if t, ok := binaryType(node.Operator, left, right); ok {
+		return t
+	}
+	c.errorf(node, "invalid operation: %s %s %s", left, node.Operator, right)
+	return nil
+}
+
+// binaryType mirrors the operations the machines implement: arithmetic on
+// int64 and float64, where a float64 operand makes the result float64,
+// concatenation of strings and ordering of numbers or strings.
+func binaryType(operator string, left, right reflect.Type) (reflect.Type, bool) {
+	switch operator {
+	case "==", "!=":
+		return boolType, true
+	case "and", "or":
+		return boolType, isBool(left) && isBool(right)
+	case "<", "<=", ">", ">=":
+		ordered := isAny(left) || isAny(right) ||
+			isNumber(left) && isNumber(right) ||
+			left == stringType && right == stringType
+		return boolType, ordered
+	}
+	if isAny(left) || isAny(right) {
+		return anyType, true
+	}
+	switch operator {
+	case "+":
+		if left == stringType && right == stringType {
+			return stringType, true
+		}
+		fallthrough
+	case "-", "*", "/", "^":
+		if !isNumber(left) || !isNumber(right) {
+			return nil, false
+		}
+		if left == floatType || right == floatType {
+			return floatType, true
+		}
+		return intType, true
+	case "%":
+		return intType, left == intType && right == intType
+	}
+	return nil, false
+}
+
+func (c *checker) chain(node *ast.ChainNode) reflect.Type {
+	left := c.check(node.Operands[0])
+	for i, operator := range node.Operators {
+		right := c.check(node.Operands[i+1])
+		if _, ok := binaryType(operator, left, right); !ok {
+			c.errorf(node, "invalid operation: %s %s %s", left, operator, right)
+		}
+		left = right
+	}
+	return boolType
+}
+
+func (c *checker) conditional(node *ast.ConditionalNode) reflect.Type {
+	c.condition(node.Condition)
+	then := c.check(node.Then)
+	if node.Else == nil {
+		return anyType
+	}
+	return unify(then, c.check(node.Else))
+}
+
+func (c *checker) caseWhen(node *ast.CaseNode) reflect.Type {
+	if node.Subject != nil {
+		c.check(node.Subject)
+	}
+	var t reflect.Type
+	for i, condition := range node.Conditions {
+		if node.Subject != nil {
+			c.check(condition)
+		} else {
+			c.condition(condition)
+		}
+		result := c.check(node.Results[i])
+		if t == nil {
+			t = result
+		} else {
+			t = unify(t, result)
+		}
+	}
+	if node.Else == nil {
+		return anyType
+	}
+	return unify(t, c.check(node.Else))
+}
+
+func (c *checker) condition(node ast.Node) {
+	if t := c.check(node); !isBool(t) {
+		c.errorf(node, "non-bool condition (%s)", t)
+	}
+}
+
+func (c *checker) program(node *ast.ProgramNode) reflect.Type {
+	t := anyType
+	for _, statement := range node.Statements {
+		if function, ok := statement.(*ast.FunctionNode); ok {
+			c.function(function)
+			continue
+		}
+		t = c.check(statement)
+	}
+	return t
+}
+
+// function checks the body with untyped parameters, the type of the body is
+// the result type of every call.
+func (c *checker) function(node *ast.FunctionNode) {
+	c.functions[node.Name] = node
+	c.results[node.Name] = anyType
+	variables := c.variables
+	c.variables = make(map[string]reflect.Type, len(node.Parameters))
+	for _, parameter := range node.Parameters {
+		c.variables[parameter] = anyType
+	}
+	c.results[node.Name] = c.check(node.Body)
+	c.variables = variables
+}
+
+func (c *checker) call(node *ast.CallNode) reflect.Type {
+	name := node.Callee.(*ast.IdentifierNode).Value
+	arguments := make([]reflect.Type, len(node.Arguments))
+	for i, argument := range node.Arguments {
+		arguments[i] = c.check(argument)
+	}
+	if function, ok := c.functions[name]; ok {
+		if len(arguments) != len(function.Parameters) {
+			c.errorf(node, "%s() expects %d arguments, got %d", name, len(function.Parameters), len(arguments))
+		}
+		return c.results[name]
+	}
+	if _, ok := builtin.Lookup(name); ok {
+		if len(arguments) != 1 {
+			c.errorf(node, "%s() expects 1 argument, got %d", name, len(arguments))
+		}
+		return conversions[name]
+	}
+	fn, ok := c.env[name]
+	if !ok {
+		if c.open == nil {
+			c.errorf(node, "unknown function %s", name)
+		}
+		fn = c.open
+	}
+	if isAny(fn) {
+		return anyType
+	}
+	if fn.Kind() != reflect.Func {
+		c.errorf(node, "%s is not a function (%s)", name, fn)
+	}
+	c.arguments(node, name, fn, arguments)
+	if fn.NumOut() == 0 {
+		return anyType
+	}
+	return fn.Out(0)
+}
+
+func (c *checker) arguments(node *ast.CallNode, name string, fn reflect.Type, arguments []reflect.Type) {
+	// a context.Context parameter is passed by the machine, not the expression
+	skip := 0
+	if builtin.TakesContext(fn) {
+		skip = 1
+	}
+	numIn := fn.NumIn() - skip
+	if fn.IsVariadic() && len(arguments) < numIn-1 ||
+		!fn.IsVariadic() && len(arguments) != numIn {
+		c.errorf(node, "%s() expects %d arguments, got %d", name, numIn, len(arguments))
+	}
+	for i, argument := range arguments {
+		var parameter reflect.Type
+		if fn.IsVariadic() && i >= numIn-1 {
+			parameter = fn.In(fn.NumIn() - 1).Elem()
+		} else {
+			parameter = fn.In(i + skip)
+		}
+		if !isAny(argument) && !argument.AssignableTo(parameter) {
+			c.errorf(node.Arguments[i], "cannot use %s as %s in argument %d to %s()", argument, parameter, i+1, name)
+		}
+	}
+}
+
+func (c *checker) member(node *ast.MemberNode) reflect.Type {
+	t := c.check(node.Node)
+	index := c.check(node.Property)
+	if isAny(t) {
+		return anyType
+	}
+	if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+		c.errorf(node, "cannot index %s", t)
+	}
+	if !isAny(index) && index != intType {
+		c.errorf(node.Property, "non-integer index (%s)", index)
+	}
+	return t.Elem()
+}
+
+func (c *checker) comprehension(node *ast.ComprehensionNode) reflect.Type {
+	t := c.check(node.Collection)
+	var variables []reflect.Type
+	switch {
+	case isAny(t):
+		variables = []reflect.Type{anyType, anyType}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		if len(node.Variables) == 2 {
+			variables = []reflect.Type{intType, t.Elem()}
+		} else {
+			variables = []reflect.Type{t.Elem()}
+		}
+	case t.Kind() == reflect.Map:
+		variables = []reflect.Type{t.Key(), t.Elem()}
+	default:
+		c.errorf(node.Collection, "cannot iterate over %s", t)
+	}
+	outer := c.variables
+	c.variables = make(map[string]reflect.Type, len(outer)+len(node.Variables))
+	for name, t := range outer {
+		c.variables[name] = t
+	}
+	for i, name := range node.Variables {
+		c.variables[name] = variables[i]
+	}
+	if node.Condition != nil {
+		c.condition(node.Condition)
+	}
+	c.check(node.Element)
+	c.variables = outer
+	return arrayType
+}
+
+func unify(a, b reflect.Type) reflect.Type {
+	if a == b {
+		return a
+	}
+	return anyType
+}
+
+func isAny(t reflect.Type) bool {
+	return t.Kind() == reflect.Interface
+}
+
+func isNumber(t reflect.Type) bool {
+	return t == intType || t == floatType
+}
+
+func isBool(t reflect.Type) bool {
+	return t == boolType || isAny(t)
+}
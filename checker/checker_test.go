@@ -0,0 +1,170 @@
+package checker
+
+import (
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/parser"
+	"bachelor-thesis/parser/ast"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"reflect"
+	"testing"
+)
+
+type env struct {
+	Name   string
+	Scores []float64
+	hidden int64
+}
+
+func (e env) Greet(greeting string) string {
+	return greeting + ", " + e.Name
+}
+
+type lazy struct{}
+
+func (lazy) Lookup(name string) (interface{}, bool) {
+	return nil, false
+}
+
+type checkerTest struct {
+	input    string
+	env      interface{}
+	expected reflect.Type
+}
+
+var checkerTests = []checkerTest{
+	{"1", nil, intType},
+	{"1.5", nil, floatType},
+	{`"a"`, nil, stringType},
+	{"nil", nil, anyType},
+	{"-1", nil, intType},
+	{"not true", nil, boolType},
+	{"1 + 2", nil, intType},
+	{"1 + 2.5", nil, floatType},
+	{"4 / 2", nil, intType},
+	{"5 % 2", nil, intType},
+	{`"a" + "b"`, nil, stringType},
+	{`"a" < "b"`, nil, boolType},
+	{"1 == true", nil, boolType},
+	{"0 < 1 <= 2.5", nil, boolType},
+	{`if true then 1 else 2`, nil, intType},
+	{`if true then 1 else "a"`, nil, anyType},
+	{`if true then 1`, nil, anyType},
+	{`case 1 when 1 then "a" else "b" end`, nil, stringType},
+	{`1 is int`, nil, boolType},
+	{`int("1")`, nil, intType},
+	{`string(1) + "px"`, nil, stringType},
+	{`[1, "a"]`, nil, arrayType},
+	{`[1, 2][0]`, nil, anyType},
+	{`let x = 1; x * 2.0`, nil, floatType},
+	{`fn sq(x) = x * x; sq(2)`, nil, anyType},
+	{`fn name() = "a"; name() + "b"`, nil, stringType},
+	{`[x * 2 for x in [1, 2] if x > 1]`, nil, arrayType},
+	{`a + b`, map[string]interface{}{"a": 1.5, "b": int64(2)}, floatType},
+	{`a + b`, Schema{"a": stringType, "b": stringType}, stringType},
+	{`a + 1`, reflect.TypeOf(map[string]interface{}{}), anyType},
+	{`a + 1`, reflect.TypeOf(map[string]int64{}), intType},
+	{`add(1, 2)`, map[string]interface{}{"add": func(a, b int64) int64 { return a + b }}, intType},
+	{`sum(1, 2, 3)`, map[string]interface{}{"sum": func(xs ...int64) int64 { return 0 }}, intType},
+	{`add(1, 2)`, map[string]interface{}{"add": func(ctx context.Context, a, b int64) int64 { return a + b }}, intType},
+	{`[k + "=" + v for k, v in m]`, map[string]interface{}{"m": map[string]string{}}, arrayType},
+	{`[x > 1 for x in xs]`, map[string]interface{}{"xs": []float64{}}, arrayType},
+	{`(xs)[0] + 1`, map[string]interface{}{"xs": []float64{}}, floatType},
+	{`Name + "!"`, env{}, stringType},
+	{`(Scores)[0]`, reflect.TypeOf(&env{}), floatType},
+	{`Greet("hi")`, env{}, stringType},
+	{`a`, map[string]interface{}{"a": nil}, anyType},
+	{`x + 1`, lazy{}, anyType},
+	{`a + b`, builtin.Chain{map[string]interface{}{"a": int64(1)}, Schema{"a": stringType, "b": intType}}, intType},
+	{`Name + a`, builtin.Chain{reflect.TypeOf(map[string]string{}), env{}}, stringType},
+	{`a + b`, builtin.Chain{map[string]interface{}{"a": int64(1)}, lazy{}, Schema{"b": intType}}, anyType},
+}
+
+func TestCheck(t *testing.T) {
+	for _, test := range checkerTests {
+		node := parser.Parse(test.input)
+		actual, err := Check(node, test.env)
+		require.NoError(t, err, test.input)
+		assert.Equal(t, test.expected, actual, test.input)
+		assert.Equal(t, test.expected, node.ValueType(), test.input)
+	}
+}
+
+type checkerErrorTest struct {
+	input    string
+	env      interface{}
+	expected string
+}
+
+var checkerErrorTests = []checkerErrorTest{
+	{`"a" + 1`, nil, "invalid operation: string + int64 at position 4"},
+	{`1 - "a"`, nil, "invalid operation: int64 - string at position 2"},
+	{`1.5 % 2`, nil, "invalid operation: float64 % int64 at position 4"},
+	{`true < false`, nil, "invalid operation: bool < bool at position 5"},
+	{`1 and true`, nil, "invalid operation: int64 and bool at position 2"},
+	{`not 1`, nil, "invalid operation: not int64 at position 0"},
+	{`-"a"`, nil, "invalid operation: - string at position 0"},
+	{`0 < "a" < 2`, nil, "invalid operation: int64 < string at position 2"},
+	{`if 1 then 2 else 3`, nil, "non-bool condition (int64) at position 3"},
+	{`x + 1`, nil, "unknown identifier x at position 0"},
+	{`a + b`, map[string]interface{}{"a": int64(1)}, "unknown identifier b at position 4"},
+	{`foo(1)`, nil, "unknown function foo at position 0"},
+	{`a(1)`, map[string]interface{}{"a": int64(1)}, "a is not a function (int64) at position 0"},
+	{`add(1)`, map[string]interface{}{"add": func(a, b int64) int64 { return a + b }}, "add() expects 2 arguments, got 1 at position 0"},
+	{`add(1, 2, 3)`, map[string]interface{}{"add": func(ctx context.Context, a, b int64) int64 { return a + b }}, "add() expects 2 arguments, got 3 at position 0"},
+	{`add(1, "b")`, map[string]interface{}{"add": func(a, b int64) int64 { return a + b }}, "cannot use string as int64 in argument 2 to add() at position 7"},
+	{`int(1, 2)`, nil, "int() expects 1 argument, got 2 at position 0"},
+	{`fn f(x) = x; f()`, nil, "f() expects 1 arguments, got 0 at position 13"},
+	{`fn f(x) = y; 1`, nil, "unknown identifier y at position 10"},
+	{`let x = 1; x + "a"`, nil, "invalid operation: int64 + string at position 13"},
+	{`[1][true]`, nil, "non-integer index (bool) at position 4"},
+	{`("abc")[0]`, nil, "cannot index string at position 7"},
+	{`[x for x in 1]`, nil, "cannot iterate over int64 at position 12"},
+	{`[x for x in [1]]; x`, nil, "unknown identifier x at position 18"},
+	{`Name - 1`, env{}, "invalid operation: string - int64 at position 5"},
+	{`hidden`, env{}, "unknown identifier hidden at position 0"},
+	{`a + Scores`, builtin.Chain{map[string]interface{}{"a": int64(1)}, env{}}, "invalid operation: int64 + []float64 at position 2"},
+	{`a + x`, builtin.Chain{map[string]interface{}{"a": int64(1)}, env{}}, "unknown identifier x at position 4"},
+}
+
+func TestCheckError(t *testing.T) {
+	for _, test := range checkerErrorTests {
+		_, err := Check(parser.Parse(test.input), test.env)
+		assert.EqualError(t, err, test.expected, test.input)
+	}
+}
+
+func TestCheckAnnotatesNodes(t *testing.T) {
+	node := parser.Parse(`a + 1 > 2`).(*ast.BinaryNode)
+	_, err := Check(node, Schema{"a": floatType})
+	require.NoError(t, err)
+	sum := node.Left.(*ast.BinaryNode)
+	assert.Equal(t, boolType, node.ValueType())
+	assert.Equal(t, floatType, sum.ValueType())
+	assert.Equal(t, floatType, sum.Left.ValueType())
+	assert.Equal(t, intType, sum.Right.ValueType())
+	assert.Equal(t, intType, node.Right.ValueType())
+}
+
+func TestInfer(t *testing.T) {
+	node := parser.Parse(`a + 1 > 2`).(*ast.BinaryNode)
+	typ, err := Infer(node, Schema{"a": floatType})
+	require.NoError(t, err)
+	assert.Equal(t, boolType, typ)
+	assert.Nil(t, node.ValueType())
+	assert.Nil(t, node.Left.ValueType())
+	_, err = Infer(parser.Parse(`a + "b"`), Schema{"a": floatType})
+	assert.EqualError(t, err, "invalid operation: float64 + string at position 2")
+}
+
+func TestInferTypes(t *testing.T) {
+	node := parser.Parse(`a + 1 > 2`).(*ast.BinaryNode)
+	types, err := InferTypes(node, Schema{"a": floatType})
+	require.NoError(t, err)
+	assert.Equal(t, boolType, types[node])
+	assert.Equal(t, floatType, types[node.Left])
+	assert.Equal(t, intType, types[node.Right])
+	assert.Nil(t, node.ValueType())
+	assert.Nil(t, node.Left.ValueType())
+}
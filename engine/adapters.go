@@ -0,0 +1,355 @@
+package engine
+
+import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/checker"
+	"bachelor-thesis/evaluator"
+	"bachelor-thesis/optimizer"
+	"bachelor-thesis/parser/ast"
+	"bachelor-thesis/vm"
+	"bachelor-thesis/vm/compiler"
+	"bachelor-thesis/vm2"
+	"bachelor-thesis/vm3"
+	"bachelor-thesis/vm4"
+	"bachelor-thesis/vm5"
+	registerCompiler "bachelor-thesis/vm5/compiler"
+	"bachelor-thesis/vm6"
+	"bachelor-thesis/vm7"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+func init() {
+	Register("evaluator", treeWalker{})
+	Register("vm", stackEngine{func(p *compiler.Program, limits budget.Limits) machine {
+		m := vm.New(p.Instructions, p.Constants)
+		m.Limits = limits
+		return m
+	}, false, true, true})
+	Register("vm2", stackEngine{func(p *compiler.Program, limits budget.Limits) machine {
+		m := vm2.New(p.Instructions, p.Constants)
+		m.Limits = limits
+		return m
+	}, false, false, false})
+	Register("vm3", stackEngine{func(p *compiler.Program, limits budget.Limits) machine {
+		m := vm3.New(p.Instructions, p.Constants)
+		m.Limits = limits
+		return m
+	}, false, false, true})
+	Register("vm4", stackEngine{func(p *compiler.Program, limits budget.Limits) machine {
+		m := vm4.New(p.Instructions, p.Constants)
+		m.Limits = limits
+		return m
+	}, true, true, true})
+	Register("vm5", registerEngine{})
+	Register("vm6", stackEngine{func(p *compiler.Program, limits budget.Limits) machine {
+		m := vm6.New(p.Instructions, p.Constants)
+		m.Limits = limits
+		return m
+	}, true, false, false})
+	Register("vm7", stackEngine{func(p *compiler.Program, limits budget.Limits) machine {
+		m := vm7.New(p.Instructions, p.Constants)
+		m.Limits = limits
+		return m
+	}, true, false, false})
+}
+
+// treeWalker evaluates the tree itself, there is nothing to compile.
+type treeWalker struct{}
+
+func (e treeWalker) Compile(node ast.Node) (Executable, error) {
+	return e.CompileWith(node, Config{})
+}
+
+func (treeWalker) CompileWith(node ast.Node, config Config) (Executable, error) {
+	if config.Limits != (budget.Limits{}) {
+		return nil, errors.New("the evaluator does not support limits")
+	}
+	if config.Env != nil {
+		if _, err := checker.Infer(node, config.Env); err != nil {
+			return nil, err
+		}
+	}
+	if config.Optimize {
+		node = optimizer.Optimize(node)
+	}
+	if config.Result != AnyResult {
+		if err := checkResult(node, config); err != nil {
+			return nil, err
+		}
+	}
+	return tree{node, config.Result, config.Mode}, nil
+}
+
+type tree struct {
+	node   ast.Node
+	result Result
+	mode   builtin.Mode
+}
+
+func (t tree) Run(env interface{}) (interface{}, error) {
+	return t.RunContext(context.Background(), env)
+}
+
+func (t tree) RunContext(ctx context.Context, env interface{}) (result interface{}, err error) {
+	defer recoverError(&err)
+	value, err := evaluator.EvalWith(ctx, t.node, env, t.mode)
+	if err != nil {
+		return nil, err
+	}
+	switch t.result {
+	case BoolResult:
+		return builtin.AsBool(value)
+	case Int64Result:
+		return builtin.AsInt64(value)
+	case Float64Result:
+		return builtin.AsFloat64(value)
+	}
+	return value, nil
+}
+
+var resultTypes = map[Result][]reflect.Type{
+	BoolResult:    {reflect.TypeOf(true)},
+	Int64Result:   {reflect.TypeOf(int64(0))},
+	Float64Result: {reflect.TypeOf(0.0), reflect.TypeOf(int64(0))},
+}
+
+// checkResult rejects a tree whose result type is known and differs from the
+// expected one, as the result options of the compilers do.
+func checkResult(node ast.Node, config Config) error {
+	env := config.Env
+	if env == nil {
+		env = reflect.TypeOf(map[string]interface{}{})
+	}
+	t, err := checker.Infer(node, env)
+	if err != nil || t.Kind() == reflect.Interface {
+		return nil
+	}
+	for _, expected := range resultTypes[config.Result] {
+		if t == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected %s result, got %s", resultTypes[config.Result][0], t)
+}
+
+// machine is implemented by the stack machines running programs of
+// vm/compiler.
+type machine interface {
+	RunContext(ctx context.Context, env interface{}) error
+	StackTop() interface{}
+}
+
+type stackEngine struct {
+	new       func(program *compiler.Program, limits budget.Limits) machine
+	typed     bool // the machine executes the typed instructions
+	functions bool // the machine executes OpCallLocal and OpReturn
+	iterators bool // the machine executes the instructions of comprehensions
+}
+
+func (e stackEngine) Compile(node ast.Node) (Executable, error) {
+	return e.CompileWith(node, Config{})
+}
+
+func (e stackEngine) CompileWith(node ast.Node, config Config) (Executable, error) {
+	if !e.functions {
+		if function := firstFunction(node); function != nil {
+			return nil, fmt.Errorf("user-defined function %s at position %d is not supported by this engine", function.Name, function.Pos())
+		}
+	}
+	if !e.iterators {
+		if comprehension := firstComprehension(node); comprehension != nil {
+			return nil, fmt.Errorf("comprehension at position %d is not supported by this engine", comprehension.Pos())
+		}
+	}
+	var options []compiler.Option
+	if config.Env != nil {
+		if config.Typed && e.typed {
+			options = append(options, compiler.Typed(config.Env))
+		} else if _, err := checker.Infer(node, config.Env); err != nil {
+			return nil, err
+		} else {
+			options = append(options, compiler.Env(config.Env))
+		}
+	}
+	if config.Mode != builtin.Zero {
+		options = append(options, compiler.Mode(config.Mode))
+	}
+	if config.Optimize {
+		options = append(options, compiler.Optimize())
+	}
+	switch config.Result {
+	case BoolResult:
+		options = append(options, compiler.AsBool())
+	case Int64Result:
+		options = append(options, compiler.AsInt64())
+	case Float64Result:
+		options = append(options, compiler.AsFloat64())
+	}
+	program, err := compiler.Compile(node, options...)
+	if err != nil {
+		return nil, err
+	}
+	return stackProgram{&sync.Pool{New: func() interface{} { return e.new(program, config.Limits) }}}, nil
+}
+
+// firstFunction returns the first `fn` definition of a program, they are
+// only allowed as its statements.
+func firstFunction(node ast.Node) *ast.FunctionNode {
+	if program, ok := node.(*ast.ProgramNode); ok {
+		for _, statement := range program.Statements {
+			if function, ok := statement.(*ast.FunctionNode); ok {
+				return function
+			}
+		}
+	}
+	return nil
+}
+
+// firstComprehension returns the first comprehension of the tree in source
+// order.
+func firstComprehension(node ast.Node) *ast.ComprehensionNode {
+	if comprehension, ok := node.(*ast.ComprehensionNode); ok {
+		return comprehension
+	}
+	for _, child := range children(node) {
+		if child == nil {
+			continue
+		}
+		if comprehension := firstComprehension(child); comprehension != nil {
+			return comprehension
+		}
+	}
+	return nil
+}
+
+// children returns the operands of node, nil for the missing optional ones.
+func children(node ast.Node) []ast.Node {
+	switch n := node.(type) {
+	case *ast.UnaryNode:
+		return []ast.Node{n.Node}
+	case *ast.BinaryNode:
+		return []ast.Node{n.Left, n.Right}
+	case *ast.ChainNode:
+		return n.Operands
+	case *ast.ConditionalNode:
+		return []ast.Node{n.Condition, n.Then, n.Else}
+	case *ast.CaseNode:
+		nodes := []ast.Node{n.Subject}
+		for i := range n.Conditions {
+			nodes = append(nodes, n.Conditions[i], n.Results[i])
+		}
+		return append(nodes, n.Else)
+	case *ast.IsNode:
+		return []ast.Node{n.Node}
+	case *ast.ProgramNode:
+		return n.Statements
+	case *ast.LetNode:
+		return []ast.Node{n.Value}
+	case *ast.FunctionNode:
+		return []ast.Node{n.Body}
+	case *ast.CallNode:
+		return append([]ast.Node{n.Callee}, n.Arguments...)
+	case *ast.ArrayNode:
+		return n.Nodes
+	case *ast.MemberNode:
+		return []ast.Node{n.Node, n.Property}
+	}
+	return nil
+}
+
+// stackProgram keeps a pool of machines for its program, which every
+// machine only reads, so that goroutines running it at once each get their
+// own machine.
+type stackProgram struct {
+	machines *sync.Pool
+}
+
+func (p stackProgram) Run(env interface{}) (interface{}, error) {
+	return p.RunContext(context.Background(), env)
+}
+
+func (p stackProgram) RunContext(ctx context.Context, env interface{}) (result interface{}, err error) {
+	m := p.machines.Get().(machine)
+	defer p.machines.Put(m)
+	defer recoverError(&err)
+	if err := m.RunContext(ctx, env); err != nil {
+		return nil, err
+	}
+	return m.StackTop(), nil
+}
+
+type registerEngine struct{}
+
+func (e registerEngine) Compile(node ast.Node) (Executable, error) {
+	return e.CompileWith(node, Config{})
+}
+
+func (registerEngine) CompileWith(node ast.Node, config Config) (Executable, error) {
+	if config.Env != nil {
+		if _, err := checker.Infer(node, config.Env); err != nil {
+			return nil, err
+		}
+	}
+	if config.Optimize {
+		node = optimizer.Optimize(node)
+	}
+	var options []registerCompiler.Option
+	if config.Env != nil {
+		options = append(options, registerCompiler.Env(config.Env))
+	}
+	if config.Mode != builtin.Zero {
+		options = append(options, registerCompiler.Mode(config.Mode))
+	}
+	switch config.Result {
+	case BoolResult:
+		options = append(options, registerCompiler.AsBool())
+	case Int64Result:
+		options = append(options, registerCompiler.AsInt64())
+	case Float64Result:
+		options = append(options, registerCompiler.AsFloat64())
+	}
+	program, err := registerCompiler.Compile(node, options...)
+	if err != nil {
+		return nil, err
+	}
+	return registerProgram{&sync.Pool{New: func() interface{} {
+		vm := vm5.New(*program)
+		vm.Limits = config.Limits
+		return vm
+	}}}, nil
+}
+
+type registerProgram struct {
+	machines *sync.Pool
+}
+
+func (p registerProgram) Run(env interface{}) (interface{}, error) {
+	return p.RunContext(context.Background(), env)
+}
+
+func (p registerProgram) RunContext(ctx context.Context, env interface{}) (result interface{}, err error) {
+	vm := p.machines.Get().(*vm5.VM)
+	defer p.machines.Put(vm)
+	defer recoverError(&err)
+	if err := vm.RunContext(ctx, env); err != nil {
+		return nil, err
+	}
+	return vm.Result(), nil
+}
+
+// recoverError turns the panics with which the machines report invalid
+// operations into an error.
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		if e, ok := r.(error); ok {
+			*err = e
+		} else {
+			*err = fmt.Errorf("%v", r)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/parser/ast"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Engine compiles a syntax tree for one of the interpreters.
+type Engine interface {
+	Compile(node ast.Node) (Executable, error)
+}
+
+// Executable is a compiled program. Run evaluates it against an environment
+// and returns the value of the program. RunContext also stops the run with a
+// *budget.InterruptedError once ctx is done, and passes ctx to the functions
+// of the environment taking a context.Context first. The executables of the
+// registered engines can be run from several goroutines at once.
+type Executable interface {
+	Run(env interface{}) (interface{}, error)
+	RunContext(ctx context.Context, env interface{}) (interface{}, error)
+}
+
+// Config adjusts how an engine compiles a program. The zero value compiles
+// the program as it is.
+type Config struct {
+	// Env is the environment the program is type checked against, given as a
+	// value, a reflect.Type or a checker.Schema. Nil skips the check.
+	Env interface{}
+	// Result is the type the program has to produce.
+	Result Result
+	// Optimize folds constants and removes identities, see optimizer.Optimize.
+	Optimize bool
+	// Typed selects the typed instructions on the machines executing them.
+	// It needs Env.
+	Typed bool
+	// Limits bounds every run of the program. The evaluator does not
+	// support limits and fails to compile when any is set.
+	Limits budget.Limits
+	// Mode sets what a name missing from the environment evaluates to, see
+	// builtin.Mode. With Env a missing name is already a compile error.
+	Mode builtin.Mode
+}
+
+// Result is the type required from the value of a program.
+type Result int
+
+const (
+	AnyResult Result = iota
+	BoolResult
+	Int64Result
+	Float64Result
+)
+
+// Configurable is implemented by the engines accepting a Config.
+type Configurable interface {
+	Engine
+	CompileWith(node ast.Node, config Config) (Executable, error)
+}
+
+var (
+	mutex   sync.RWMutex
+	engines = map[string]Engine{}
+)
+
+// Register makes an engine available under a name. It panics if the name is
+// already taken.
+func Register(name string, engine Engine) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := engines[name]; ok {
+		panic(fmt.Sprintf("engine %s registered twice", name))
+	}
+	engines[name] = engine
+}
+
+// Lookup returns the engine registered under a name.
+func Lookup(name string) (Engine, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	engine, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown engine %s", name)
+	}
+	return engine, nil
+}
+
+// Names lists the registered engines in alphabetical order.
+func Names() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
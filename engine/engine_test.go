@@ -0,0 +1,434 @@
+package engine
+
+import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/parser"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type engineTest struct {
+	input    string
+	expected interface{}
+}
+
+// engineTests only use the language supported by every engine.
+var engineTests = []engineTest{
+	{`1 + 2 * 3`, int64(7)},
+	{`1.5 + 1`, 2.5},
+	{`"a" + "b"`, "ab"},
+	{`""`, ""},
+	{`0`, int64(0)},
+	{`nil`, nil},
+	{`1 < 2 < 3`, true},
+	{`1 < 2 == true`, true},
+	{`1 == 1 != false`, true},
+	{`not (a and b)`, true},
+	{`if x > 10 then "big" else "small"`, "small"},
+	{`case s when "a" then 1 when "b" then 2 else 3 end`, int64(2)},
+	{`[1, "a", x][2]`, int64(5)},
+	{`add(x, 2) * 2`, int64(14)},
+	{`greet(s)`, "hi b"},
+	{`int("42") + 1`, int64(43)},
+	{`x is int`, true},
+	{`let y = x * 2; y + 1`, int64(11)},
+}
+
+var env = map[string]interface{}{
+	"a":     true,
+	"b":     false,
+	"x":     int64(5),
+	"s":     "b",
+	"add":   func(a, b int64) int64 { return a + b },
+	"greet": func(name string) string { return "hi " + name },
+}
+
+func TestEngines(t *testing.T) {
+	names := Names()
+	assert.Equal(t, []string{"evaluator", "vm", "vm2", "vm3", "vm4", "vm5", "vm6", "vm7"}, names)
+	for _, name := range names {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		for _, test := range engineTests {
+			program, err := engine.Compile(parser.Parse(test.input))
+			require.NoError(t, err, name, test.input)
+			result, err := program.Run(env)
+			require.NoError(t, err, name, test.input)
+			assert.Equal(t, test.expected, result, name, test.input)
+		}
+	}
+}
+
+// TestRunTwice checks that an executable can be run again with another
+// environment.
+func TestRunTwice(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		program, err := engine.Compile(parser.Parse(`x * 2`))
+		require.NoError(t, err, name)
+		for _, x := range []int64{1, 2} {
+			result, err := program.Run(map[string]interface{}{"x": x})
+			require.NoError(t, err, name)
+			assert.Equal(t, x*2, result, name)
+		}
+	}
+}
+
+// TestRunError checks that the machines panicking on invalid operations
+// report an error instead.
+func TestRunError(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		program, err := engine.Compile(parser.Parse(`s - 1`))
+		require.NoError(t, err, name)
+		_, err = program.Run(env)
+		assert.Error(t, err, name)
+		program, err = engine.Compile(parser.Parse(`int(1.0 / 0.0)`))
+		require.NoError(t, err, name)
+		_, err = program.Run(env)
+		assert.EqualError(t, err, "cannot convert +Inf (float64) to int", name)
+	}
+}
+
+// withoutFunctions are the engines rejecting `fn`.
+var withoutFunctions = map[string]bool{"vm2": true, "vm3": true, "vm6": true, "vm7": true}
+
+// withoutIterators are the engines rejecting comprehensions.
+var withoutIterators = map[string]bool{"vm2": true, "vm6": true, "vm7": true}
+
+// TestFunctions checks that the machines without call frames reject `fn`
+// when compiling instead of failing at run time.
+func TestFunctions(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		program, err := engine.Compile(parser.Parse(`let a = 2; fn sq(x) = x * x; sq(a + 1)`))
+		if withoutFunctions[name] {
+			assert.EqualError(t, err, "user-defined function sq at position 11 is not supported by this engine", name)
+			continue
+		}
+		require.NoError(t, err, name)
+		result, err := program.Run(nil)
+		require.NoError(t, err, name)
+		assert.Equal(t, int64(9), result, name)
+	}
+}
+
+// TestComprehensions checks that the machines without iterators reject
+// comprehensions when compiling, wherever they are in the tree.
+func TestComprehensions(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		program, err := engine.Compile(parser.Parse(`let xs = [1, 2, 3]; x > 1 ? [y * x for y in xs if y > 1][1] : 0`))
+		if withoutIterators[name] {
+			assert.EqualError(t, err, "comprehension at position 28 is not supported by this engine", name)
+			continue
+		}
+		require.NoError(t, err, name)
+		result, err := program.Run(env)
+		require.NoError(t, err, name)
+		assert.Equal(t, int64(15), result, name)
+	}
+}
+
+func TestNegativeZero(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		program, err := engine.(Configurable).CompileWith(parser.Parse(`[0.0, -0.0, 1.0 / -0.0]`), Config{Optimize: true})
+		require.NoError(t, err, name)
+		result, err := program.Run(nil)
+		require.NoError(t, err, name)
+		values := result.([]interface{})
+		assert.False(t, math.Signbit(values[0].(float64)), name)
+		assert.True(t, math.Signbit(values[1].(float64)), name)
+		assert.Equal(t, math.Inf(-1), values[2], name)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	_, err := Lookup("vm8")
+	assert.EqualError(t, err, "unknown engine vm8")
+	assert.PanicsWithValue(t, "engine vm registered twice", func() { Register("vm", treeWalker{}) })
+}
+
+// TestConcurrentRun runs one executable from several goroutines with
+// different environments, to be run with -race. The engines supporting them
+// also run a program with a function and a comprehension.
+func TestConcurrentRun(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		inputs := []string{`let y = add(x, 1); [y * 2, s + string(y)]`}
+		if !withoutFunctions[name] {
+			inputs = append(inputs, `fn double(a) = a * 2; let y = add(x, 1); [double(y), s + string(y), [z * y for z in [1, 2]]]`)
+		}
+		for i, input := range inputs {
+			program, err := engine.Compile(parser.Parse(input))
+			require.NoError(t, err, name)
+			var wg sync.WaitGroup
+			for j := 0; j < 8; j++ {
+				wg.Add(1)
+				go func(x int64) {
+					defer wg.Done()
+					env := map[string]interface{}{"x": x, "s": "n", "add": func(a, b int64) int64 { return a + b }}
+					expected := []interface{}{x*2 + 2, "n" + fmt.Sprint(x+1)}
+					if i > 0 {
+						expected = append(expected, []interface{}{x + 1, 2 * (x + 1)})
+					}
+					for n := 0; n < 100; n++ {
+						result, err := program.Run(env)
+						assert.NoError(t, err, name)
+						assert.Equal(t, expected, result, name)
+					}
+				}(int64(j))
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// TestSharedTree checks that compiling with an environment leaves the types
+// out of the tree, which other goroutines may be compiling as well.
+func TestSharedTree(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		tree := parser.Parse(`add(x, 1) > 2`)
+		_, err = engine.(Configurable).CompileWith(tree, Config{Env: env, Optimize: true, Result: BoolResult})
+		require.NoError(t, err, name)
+		assert.Nil(t, tree.ValueType(), name)
+	}
+}
+
+type limitTest struct {
+	input  string
+	limits budget.Limits
+	err    error
+}
+
+var limitTests = []limitTest{
+	{`1 + 2 * 3`, budget.Limits{Instructions: 4}, &budget.InstructionLimitError{Limit: 4}},
+	{`1 + (2 + (3 + 4))`, budget.Limits{StackDepth: 3}, &budget.StackDepthError{Limit: 3}},
+	{`[1, 2, 3]`, budget.Limits{ArrayLength: 2}, &budget.ArrayLengthError{Limit: 2, Length: 3}},
+	{`[x for x in [1, 2]]`, budget.Limits{ArrayLength: 1}, &budget.ArrayLengthError{Limit: 1, Length: 2}},
+	{`"ab" + "cd"`, budget.Limits{StringLength: 3}, &budget.StringLengthError{Limit: 3, Length: 4}},
+	{`s + s`, budget.Limits{StringLength: 1}, &budget.StringLengthError{Limit: 1, Length: 2}},
+	{`[1, [2, [3, [4, [5]]]]]`, budget.Limits{StackDepth: 3}, &budget.StackDepthError{Limit: 3}},
+	{`fn f(n) = n > 0 ? f(n - 1) : 0; f(20)`, budget.Limits{StackDepth: 10}, &budget.StackDepthError{Limit: 10}},
+	{`1 + 2 * 3`, budget.Limits{Instructions: 6, StackDepth: 3, ArrayLength: 1, StringLength: 1}, nil},
+}
+
+// TestLimits runs limitTests on every engine but the evaluator, which rejects
+// limits, untyped and typed, skipping the constructs an engine rejects.
+func TestLimits(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		for _, test := range limitTests {
+			node := parser.Parse(test.input)
+			if withoutFunctions[name] && firstFunction(node) != nil ||
+				withoutIterators[name] && firstComprehension(node) != nil {
+				continue
+			}
+			for _, config := range []Config{{Limits: test.limits}, {Limits: test.limits, Env: env, Typed: true}} {
+				program, err := engine.(Configurable).CompileWith(node, config)
+				if name == "evaluator" {
+					assert.EqualError(t, err, "the evaluator does not support limits")
+					continue
+				}
+				require.NoError(t, err, name, test.input)
+				_, err = program.Run(env)
+				assert.Equal(t, test.err, err, name, test.input)
+			}
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		program, err := engine.Compile(parser.Parse(`add(x, 1) + stop(x)`))
+		require.NoError(t, err, name)
+		ctx, cancel := context.WithCancel(context.Background())
+		env := map[string]interface{}{
+			"x":    int64(1),
+			"add":  func(ctx context.Context, a, b int64) int64 { return a + b },
+			"stop": func(x int64) int64 { cancel(); return x },
+		}
+		_, err = program.RunContext(ctx, env)
+		var interrupted *budget.InterruptedError
+		assert.ErrorAs(t, err, &interrupted, name)
+		assert.ErrorIs(t, err, context.Canceled, name)
+	}
+}
+
+type base struct {
+	ID int64
+}
+
+type order struct {
+	base
+	Price    float64 `expr:"price"`
+	Customer string
+}
+
+func (o order) Total(n int64) float64 {
+	return o.Price * float64(n)
+}
+
+func (o *order) Label() string {
+	return fmt.Sprintf("%s#%d", o.Customer, o.ID)
+}
+
+var structTests = []engineTest{
+	{`price * 2`, 5.0},
+	{`ID + 1`, int64(8)},
+	{`Total(2)`, 5.0},
+	{`Label()`, "ann#7"},
+	{`Customer + "!"`, "ann!"},
+}
+
+// TestStructEnvironment runs every engine on a struct environment and a
+// pointer to it, resolving the names at runtime and at compile time.
+func TestStructEnvironment(t *testing.T) {
+	env := order{base: base{ID: 7}, Price: 2.5, Customer: "ann"}
+	configs := []Config{{}, {Env: env}, {Env: &env, Typed: true}}
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		for _, config := range configs {
+			for _, test := range structTests {
+				program, err := engine.(Configurable).CompileWith(parser.Parse(test.input), config)
+				require.NoError(t, err, name, test.input)
+				for _, env := range []interface{}{env, &env} {
+					result, err := program.Run(env)
+					require.NoError(t, err, name, test.input)
+					assert.Equal(t, test.expected, result, name, test.input)
+				}
+			}
+			program, err := engine.(Configurable).CompileWith(parser.Parse(`Customer + Label()`), config)
+			require.NoError(t, err, name)
+			_, err = program.Run((*order)(nil))
+			assert.EqualError(t, err, "cannot fetch Customer from *engine.order", name)
+			if withoutFunctions[name] {
+				continue
+			}
+			program, err = engine.(Configurable).CompileWith(parser.Parse(`fn total(n) = Total(n) + price; total(2)`), config)
+			require.NoError(t, err, name)
+			result, err := program.Run(&env)
+			require.NoError(t, err, name)
+			assert.Equal(t, 7.5, result, name)
+		}
+	}
+}
+
+type modeTest struct {
+	input    string
+	mode     builtin.Mode
+	env      interface{}
+	expected interface{}
+	err      string
+}
+
+var modeTests = []modeTest{
+	{`x + y`, builtin.Zero, map[string]int64{"x": 1}, int64(1), ""},
+	{`y`, builtin.Zero, env, nil, ""},
+	{`y is nil`, builtin.Lenient, map[string]int64{"x": 1}, true, ""},
+	{`let z = y; z`, builtin.Lenient, nil, nil, ""},
+	{`if price > 1 then x else y`, builtin.Lenient, order{}, nil, ""},
+	{`x + y`, builtin.Strict, map[string]int64{"x": 1, "y": 2}, int64(3), ""},
+	{`x + y`, builtin.Strict, map[string]int64{"x": 1}, nil, "unknown identifier `y` at col 5"},
+	{`price + y`, builtin.Strict, order{}, nil, "unknown identifier `y` at col 9"},
+	{`add(x, y)`, builtin.Strict, nil, nil, "unknown identifier `x` at col 5"},
+	{`1 + f(x)`, builtin.Lenient, env, nil, "unknown function `f` at col 5"},
+	{`1 + f(x)`, builtin.Strict, env, nil, "unknown function `f` at col 5"},
+	{`fn f() = y; f() is nil`, builtin.Lenient, map[string]int64{"x": 1}, true, ""},
+	{`fn f() = y; f()`, builtin.Strict, map[string]int64{"x": 1}, nil, "unknown identifier `y` at col 10"},
+	{`fn f(a) = g(a); f(x)`, builtin.Strict, map[string]int64{"x": 1}, nil, "unknown function `g` at col 11"},
+}
+
+// TestMode checks that every engine handles the names missing from the
+// environment alike in each mode.
+func TestMode(t *testing.T) {
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		for _, test := range modeTests {
+			if withoutFunctions[name] && strings.HasPrefix(test.input, "fn ") {
+				continue
+			}
+			program, err := engine.(Configurable).CompileWith(parser.Parse(test.input), Config{Mode: test.mode})
+			require.NoError(t, err, name, test.input)
+			result, err := program.Run(test.env)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err, name, test.input)
+				continue
+			}
+			require.NoError(t, err, name, test.input)
+			assert.Equal(t, test.expected, result, name, test.input)
+		}
+		_, err = engine.(Configurable).CompileWith(parser.Parse(`y`), Config{Env: env, Mode: builtin.Lenient})
+		assert.EqualError(t, err, "unknown identifier y at position 0", name)
+	}
+}
+
+// lookup is a Resolver loading the names on demand.
+type lookup func(name string) (interface{}, bool)
+
+func (l lookup) Lookup(name string) (interface{}, bool) {
+	return l(name)
+}
+
+var chainTests = []engineTest{
+	{`add(x, 1)`, int64(3)},
+	{`limit - x`, int64(8)},
+	{`price * 2`, 5.0},
+	{`s + Customer`, "bann"},
+	{`missing`, nil},
+}
+
+// TestChain runs every engine on a chain of a map, a resolver, a struct and
+// another map, the first environment having a name wins.
+func TestChain(t *testing.T) {
+	var loads []string
+	chain := builtin.Chain{
+		map[string]interface{}{"x": int64(2)},
+		lookup(func(name string) (interface{}, bool) {
+			loads = append(loads, name)
+			return int64(10), name == "limit"
+		}),
+		order{Price: 2.5, Customer: "ann"},
+		env,
+	}
+	configs := []Config{{}, {Env: chain}, {Env: chain, Typed: true}}
+	for _, name := range Names() {
+		engine, err := Lookup(name)
+		require.NoError(t, err)
+		for _, config := range configs {
+			for _, test := range chainTests {
+				program, err := engine.(Configurable).CompileWith(parser.Parse(test.input), config)
+				require.NoError(t, err, name, test.input)
+				result, err := program.Run(chain)
+				require.NoError(t, err, name, test.input)
+				assert.Equal(t, test.expected, result, name, test.input)
+			}
+		}
+		program, err := engine.(Configurable).CompileWith(parser.Parse(`x + missing`), Config{Mode: builtin.Strict})
+		require.NoError(t, err, name)
+		_, err = program.Run(chain)
+		assert.EqualError(t, err, "unknown identifier `missing` at col 5", name)
+	}
+	assert.NotContains(t, loads, "x")
+}
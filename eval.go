@@ -1,13 +1,8 @@
 package main
 
 import (
-	"bachelor-thesis/evaluator"
+	"bachelor-thesis/engine"
 	"bachelor-thesis/parser"
-	"bachelor-thesis/vm"
-	"bachelor-thesis/vm/compiler"
-	"bachelor-thesis/vm2"
-	"bachelor-thesis/vm3"
-	"fmt"
 )
 
 type vmType int64
@@ -20,43 +15,23 @@ const (
 	register
 )
 
+// engines names the registered engine of every vmType.
+var engines = map[vmType]string{
+	treeTraversal:  "evaluator",
+	singleStack:    "vm",
+	multipleStacks: "vm2",
+	reflectBased:   "vm3",
+	register:       "vm5",
+}
+
 func Eval(input string, vmType vmType, env interface{}) (interface{}, error) {
-	tree := parser.Parse(input)
-	if vmType == treeTraversal {
-		evaluated, err := evaluator.Eval(tree, env)
-		if err != nil {
-			return nil, err
-		}
-		return evaluated, nil
-	} else {
-		program, err := compiler.Compile(tree)
-		if err != nil {
-			return nil, err
-		}
-		if vmType == singleStack {
-			vm := vm.New(program.Instructions, program.Constants)
-			err = vm.Run(env)
-			if err != nil {
-				return nil, err
-			}
-			return vm.StackTop(), nil
-		} else if vmType == multipleStacks {
-			vm := vm2.New(program.Instructions, program.Constants)
-			err = vm.Run(env)
-			if err != nil {
-				return nil, err
-			}
-			return vm.StackTop(), nil
-		} else if vmType == reflectBased {
-			vm := vm3.New(program.Instructions, program.Constants)
-			err = vm.Run(env)
-			if err != nil {
-				return nil, err
-			}
-			return vm.StackTop(), nil
-		} else if vmType == register {
-			return nil, fmt.Errorf("register based machine is not implemented now")
-		}
+	e, err := engine.Lookup(engines[vmType])
+	if err != nil {
+		return nil, err
+	}
+	program, err := e.Compile(parser.Parse(input))
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("undefined type of the virtual machine")
+	return program.Run(env)
 }
@@ -1,19 +1,66 @@
 package evaluator
 
 import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/parser/ast"
+	"context"
 	"fmt"
 	"math"
 	"reflect"
 )
 
+// MaxCallDepth bounds recursion of user-defined functions, each call
+// recurses into Eval and would otherwise overflow the Go stack.
+const MaxCallDepth = 1024
+
+// scope holds the `let` bindings and `fn` definitions of a program on top of
+// the user environment.
+type scope struct {
+	variables map[string]interface{}
+	functions map[string]*ast.FunctionNode
+	env       interface{}
+	depth     int
+	ctx       context.Context
+	mode      builtin.Mode
+}
+
+// EvalContext is Eval stopping with a *budget.InterruptedError once ctx is
+// done, checked at every call and every iteration of a comprehension; the
+// offset of the error is the position of that node. Functions of env taking a
+// context.Context as first parameter receive ctx.
+func EvalContext(ctx context.Context, node ast.Node, env interface{}) (interface{}, error) {
+	return EvalWith(ctx, node, env, builtin.Zero)
+}
+
+// EvalWith is EvalContext evaluating the names missing from env as mode says,
+// see builtin.Mode.
+func EvalWith(ctx context.Context, node ast.Node, env interface{}, mode builtin.Mode) (interface{}, error) {
+	return Eval(node, &scope{
+		variables: make(map[string]interface{}),
+		functions: make(map[string]*ast.FunctionNode),
+		env:       env,
+		ctx:       ctx,
+		mode:      mode,
+	})
+}
+
+// contextOf returns the context of a scope created by EvalContext.
+func contextOf(env interface{}) context.Context {
+	if s, ok := env.(*scope); ok && s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+// Eval evaluates the tree against env, any environment builtin.Fetch reads,
+// such as a map, a struct, a builtin.Resolver or a builtin.Chain of them.
 func Eval(node ast.Node, env interface{}) (interface{}, error) {
 	switch node.Type() {
 	case ast.NodeNumber:
 		return EvalNumber(node)
 	case ast.NodeIdentifier:
-		v := reflect.ValueOf(env)
-		return v.MapIndex(reflect.ValueOf(node.(*ast.IdentifierNode).Value)).Interface(), nil
+		return EvalIdentifier(node, env)
 	case ast.NodeString:
 		return node.(*ast.StringNode).Value, nil
 	case ast.NodeBool:
@@ -30,10 +77,77 @@ func Eval(node ast.Node, env interface{}) (interface{}, error) {
 		return EvalArray(node, env)
 	case ast.NodeMember:
 		return EvalIndex(node, env)
+	case ast.NodeChain:
+		return EvalChain(node, env)
+	case ast.NodeConditional:
+		return EvalConditional(node, env)
+	case ast.NodeCase:
+		return EvalCase(node, env)
+	case ast.NodeIs:
+		return EvalIs(node, env)
+	case ast.NodeProgram:
+		return EvalProgram(node, env)
+	case ast.NodeLet:
+		return EvalLet(node, env)
+	case ast.NodeFunction:
+		return nil, nil
+	case ast.NodeComprehension:
+		return EvalComprehension(node, env)
 	}
 	return nil, nil
 }
 
+func EvalIdentifier(node ast.Node, env interface{}) (interface{}, error) {
+	name := node.(*ast.IdentifierNode).Value
+	if s, ok := env.(*scope); ok {
+		if value, ok := s.variables[name]; ok {
+			return value, nil
+		}
+		if s.mode != builtin.Zero {
+			return builtin.Identifier{Name: name, Pos: node.Pos(), Mode: s.mode}.Get(s.env)
+		}
+		env = s.env
+	}
+	return builtin.Fetch(env, name)
+}
+
+func EvalProgram(node ast.Node, env interface{}) (interface{}, error) {
+	s := &scope{
+		variables: make(map[string]interface{}),
+		functions: make(map[string]*ast.FunctionNode),
+		env:       env,
+	}
+	if outer, ok := env.(*scope); ok {
+		s.env = outer.env
+		s.ctx = outer.ctx
+		s.mode = outer.mode
+	}
+	var value interface{}
+	var err error
+	for _, statement := range node.(*ast.ProgramNode).Statements {
+		if function, ok := statement.(*ast.FunctionNode); ok {
+			s.functions[function.Name] = function
+			continue
+		}
+		value, err = Eval(statement, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+func EvalLet(node ast.Node, env interface{}) (interface{}, error) {
+	value, err := Eval(node.(*ast.LetNode).Value, env)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := env.(*scope); ok {
+		s.variables[node.(*ast.LetNode).Name] = value
+	}
+	return value, nil
+}
+
 func EvalNumber(node ast.Node) (interface{}, error) {
 	if node.(*ast.NumberNode).IsInt {
 		return node.(*ast.NumberNode).Int64, nil
@@ -82,7 +196,92 @@ func EvalBinary(node ast.Node, env interface{}) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	switch node.(*ast.BinaryNode).Operator {
+	return evalBinaryOperation(node.(*ast.BinaryNode).Operator, left, right)
+}
+
+// EvalChain evaluates `a < b < c` as `a < b and b < c`, evaluating b once
+// and stopping at the first false comparison.
+func EvalChain(node ast.Node, env interface{}) (interface{}, error) {
+	chain := node.(*ast.ChainNode)
+	left, err := Eval(chain.Operands[0], env)
+	if err != nil {
+		return nil, err
+	}
+	var result interface{}
+	for i, operator := range chain.Operators {
+		right, err := Eval(chain.Operands[i+1], env)
+		if err != nil {
+			return nil, err
+		}
+		result, err = evalBinaryOperation(operator, left, right)
+		if err != nil {
+			return nil, err
+		}
+		if result == false {
+			return result, nil
+		}
+		left = right
+	}
+	return result, nil
+}
+
+func EvalConditional(node ast.Node, env interface{}) (interface{}, error) {
+	conditional := node.(*ast.ConditionalNode)
+	condition, err := Eval(conditional.Condition, env)
+	if err != nil {
+		return nil, err
+	}
+	ok, isBool := condition.(bool)
+	if !isBool {
+		return nil, fmt.Errorf("non-bool value in cond (%T)", condition)
+	}
+	if ok {
+		return Eval(conditional.Then, env)
+	}
+	return evalOrNil(conditional.Else, env)
+}
+
+func EvalCase(node ast.Node, env interface{}) (interface{}, error) {
+	caseNode := node.(*ast.CaseNode)
+	var subject interface{}
+	var err error
+	if caseNode.Subject != nil {
+		subject, err = Eval(caseNode.Subject, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, condition := range caseNode.Conditions {
+		value, err := Eval(condition, env)
+		if err != nil {
+			return nil, err
+		}
+		if caseNode.Subject != nil {
+			value, err = evalBinaryOperation("==", subject, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ok, isBool := value.(bool)
+		if !isBool {
+			return nil, fmt.Errorf("non-bool value in cond (%T)", value)
+		}
+		if ok {
+			return Eval(caseNode.Results[i], env)
+		}
+	}
+	return evalOrNil(caseNode.Else, env)
+}
+
+func evalOrNil(node ast.Node, env interface{}) (interface{}, error) {
+	if node == nil {
+		return nil, nil
+	}
+	return Eval(node, env)
+}
+
+func evalBinaryOperation(operator string, left, right interface{}) (interface{}, error) {
+	switch operator {
 	case "or":
 		switch l := left.(type) {
 		case bool:
@@ -353,7 +552,7 @@ func EvalBinary(node ast.Node, env interface{}) (interface{}, error) {
 			}
 		}
 	}
-	return nil, fmt.Errorf("undefined binary %q operator", node.(*ast.BinaryNode).Operator)
+	return nil, fmt.Errorf("undefined binary %q operator", operator)
 }
 
 func EvalArray(node ast.Node, env interface{}) (interface{}, error) {
@@ -368,6 +567,60 @@ func EvalArray(node ast.Node, env interface{}) (interface{}, error) {
 	return array, nil
 }
 
+// EvalComprehension binds the loop variables in a scope of their own, so they
+// shadow outer names only inside the comprehension.
+func EvalComprehension(node ast.Node, env interface{}) (interface{}, error) {
+	comprehension := node.(*ast.ComprehensionNode)
+	collection, err := Eval(comprehension.Collection, env)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := builtin.Entries(collection, len(comprehension.Variables))
+	if err != nil {
+		return nil, err
+	}
+	inner := &scope{variables: make(map[string]interface{}), env: env}
+	if s, ok := env.(*scope); ok {
+		for name, value := range s.variables {
+			inner.variables[name] = value
+		}
+		inner.functions = s.functions
+		inner.env = s.env
+		inner.depth = s.depth
+		inner.ctx = s.ctx
+		inner.mode = s.mode
+	}
+	ctx := contextOf(env)
+	array := make([]interface{}, 0)
+	for _, entry := range entries {
+		if err := budget.Interrupted(ctx, node.Pos()); err != nil {
+			return nil, err
+		}
+		for i, name := range comprehension.Variables {
+			inner.variables[name] = entry[i]
+		}
+		if comprehension.Condition != nil {
+			condition, err := Eval(comprehension.Condition, inner)
+			if err != nil {
+				return nil, err
+			}
+			ok, isBool := condition.(bool)
+			if !isBool {
+				return nil, fmt.Errorf("non-bool value in cond (%T)", condition)
+			}
+			if !ok {
+				continue
+			}
+		}
+		value, err := Eval(comprehension.Element, inner)
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+	return array, nil
+}
+
 func EvalIndex(node ast.Node, env interface{}) (interface{}, error) {
 	array, err := Eval(node.(*ast.MemberNode).Node, env)
 	if err != nil {
@@ -390,13 +643,26 @@ func EvalIndex(node ast.Node, env interface{}) (interface{}, error) {
 	return nil, nil
 }
 
+func EvalIs(node ast.Node, env interface{}) (interface{}, error) {
+	value, err := Eval(node.(*ast.IsNode).Node, env)
+	if err != nil {
+		return nil, err
+	}
+	return builtin.Is(value, node.(*ast.IsNode).TypeName), nil
+}
+
 func EvalFunctionCall(node ast.Node, env interface{}) (interface{}, error) {
 	node = node.(*ast.CallNode)
 	name := node.(*ast.CallNode).Callee.(*ast.IdentifierNode).Value
-	fn, ok := getFunc(env, name)
-	if !ok {
-		return nil, fmt.Errorf("undefined: %v", name)
+	if s, ok := env.(*scope); ok {
+		if function, ok := s.functions[name]; ok {
+			return evalUserFunction(node.(*ast.CallNode), function, s)
+		}
+	}
+	if index, ok := builtin.Lookup(name); ok {
+		return evalBuiltin(node.(*ast.CallNode), index, env)
 	}
+	ctx := contextOf(env)
 
 	in := make([]reflect.Value, 0)
 
@@ -407,8 +673,20 @@ func EvalFunctionCall(node ast.Node, env interface{}) (interface{}, error) {
 		}
 		in = append(in, reflect.ValueOf(i))
 	}
+	// the callee is looked up after the arguments, as the machines do
+	fn, err := getFunc(env, node.(*ast.CallNode).Callee.(*ast.IdentifierNode))
+	if err != nil {
+		return nil, err
+	}
 
-	out := reflect.ValueOf(fn).Call(in)
+	if err := budget.Interrupted(ctx, node.Pos()); err != nil {
+		return nil, err
+	}
+	f := reflect.ValueOf(fn)
+	out := f.Call(builtin.WithContext(ctx, f, in))
+	if err := budget.Interrupted(ctx, node.Pos()); err != nil {
+		return nil, err
+	}
 
 	if len(out) == 0 {
 		return nil, nil
@@ -422,29 +700,62 @@ func EvalFunctionCall(node ast.Node, env interface{}) (interface{}, error) {
 	return nil, nil
 }
 
-func getFunc(val interface{}, i interface{}) (interface{}, bool) {
-	v := reflect.ValueOf(val)
-	d := v
-	if v.Kind() == reflect.Ptr {
-		d = v.Elem()
+func evalUserFunction(node *ast.CallNode, function *ast.FunctionNode, s *scope) (interface{}, error) {
+	if len(node.Arguments) != len(function.Parameters) {
+		return nil, fmt.Errorf("%s() expects %d arguments, got %d", function.Name, len(function.Parameters), len(node.Arguments))
 	}
-
-	switch d.Kind() {
-	case reflect.Map:
-		value := d.MapIndex(reflect.ValueOf(i))
-		if value.IsValid() && value.CanInterface() {
-			return value.Interface(), true
-		}
-	case reflect.Struct:
-		name := reflect.ValueOf(i).String()
-		method := v.MethodByName(name)
-		if method.IsValid() && method.CanInterface() {
-			return method.Interface(), true
+	if s.depth >= MaxCallDepth {
+		return nil, fmt.Errorf("maximum call depth %d exceeded in %s()", MaxCallDepth, function.Name)
+	}
+	if err := budget.Interrupted(contextOf(s), node.Pos()); err != nil {
+		return nil, err
+	}
+	call := &scope{
+		variables: make(map[string]interface{}, len(function.Parameters)),
+		functions: s.functions,
+		env:       s.env,
+		depth:     s.depth + 1,
+		ctx:       s.ctx,
+		mode:      s.mode,
+	}
+	for i, parameter := range function.Parameters {
+		value, err := Eval(node.Arguments[i], s)
+		if err != nil {
+			return nil, err
 		}
-		value := d.FieldByName(name)
-		if value.IsValid() && value.CanInterface() {
-			return value.Interface(), true
+		call.variables[parameter] = value
+	}
+	return Eval(function.Body, call)
+}
+
+func evalBuiltin(node *ast.CallNode, index int, env interface{}) (interface{}, error) {
+	b := builtin.Builtins[index]
+	if len(node.Arguments) != 1 {
+		return nil, fmt.Errorf("%s() expects 1 argument, got %d", b.Name, len(node.Arguments))
+	}
+	value, err := Eval(node.Arguments[0], env)
+	if err != nil {
+		return nil, err
+	}
+	return b.Call(value)
+}
+
+// getFunc looks up the callee in the environment, a missing one is reported
+// as its mode says.
+func getFunc(val interface{}, callee *ast.IdentifierNode) (interface{}, error) {
+	if s, ok := val.(*scope); ok {
+		val = s.env
+		if s.mode != builtin.Zero {
+			value, err := builtin.Identifier{Name: callee.Value, Pos: callee.Pos(), Mode: s.mode, Function: true}.Get(val)
+			if err == nil && value == nil {
+				err = fmt.Errorf("undefined: %v", callee.Value)
+			}
+			return value, err
 		}
 	}
-	return nil, false
+	value, err := builtin.Fetch(val, callee.Value)
+	if err != nil || value == nil {
+		return nil, fmt.Errorf("undefined: %v", callee.Value)
+	}
+	return value, nil
 }
@@ -1,8 +1,11 @@
 package evaluator
 
 import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/parser"
 	"bachelor-thesis/parser/ast"
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -99,6 +102,55 @@ var evaluatorTests = []evaluatorTest{{"true", true},
 	{`false and false or true`, true},
 	{`("qym" < "qyi") and ("tvzew" < "i") or ("bv" <= "xw")`, true},
 	{`("kt" >= "cwcg") and ("pppvp" > "xqqew") or ("geh" <= "wst") and ("je" != "wvvkr") or ("oejgc" < "obsjo") and ("r" != "ml") or ("bkyay" >= "hqdnn")`, true},
+	{"1 < 2 < 3", true},
+	{"1 < 3 < 2", false},
+	{"3 < 1 < 2", false},
+	{"1 < 2 <= 2 < 3", true},
+	{"3 > 2.5 >= 2 > 1", true},
+	{`"a" < "b" < "c"`, true},
+	{"1 < 2 == true", true},
+	{"1 == 1 == true", true},
+	{"2 > 1 != false", true},
+	{`if 1 < 2 then "a" else "b"`, "a"},
+	{`if 1 > 2 then "a" else "b"`, "b"},
+	{`if false then 1`, nil},
+	{`if 1 > 2 then "A" else if 1 > 0 then "B" else "C"`, "B"},
+	{`(if true then 1 else 2) + 10`, int64(11)},
+	{`case "warn" when "ok" then 1 when "warn" then 2 else 3 end`, int64(2)},
+	{`case "none" when "ok" then 1 when "warn" then 2 else 3 end`, int64(3)},
+	{`case 5 when 1 then "one" end`, nil},
+	{`case when 1 > 2 then "a" when 2 > 1 then "b" end`, "b"},
+	{`int("42") + 1`, int64(43)},
+	{`int(4.7)`, int64(4)},
+	{`float("1.5") * 2`, 3.0},
+	{`float(3)`, 3.0},
+	{`string(3) + "px"`, "3px"},
+	{`string(2.5)`, "2.5"},
+	{`bool("true") and true`, true},
+	{`bool(0)`, false},
+	{`"a" is string`, true},
+	{`1 is float`, false},
+	{`1.5 is float`, true},
+	{`[1] is array`, true},
+	{`1 + 2 is int and "a" is string`, true},
+	{`1; 2; 3`, int64(3)},
+	{`"a"; "b";`, "b"},
+	{`let x = 2; x * x`, int64(4)},
+	{`let x = 1; let x = x + 1; x`, int64(2)},
+	{`let s = "ab"; let n = 3; s + string(n)`, "ab3"},
+	{`let x = 5`, int64(5)},
+	{`[x * 2 for x in [1, -2, 3] if x > 0]`, []interface{}{int64(2), int64(6)}},
+	{`[i for i, x in ["a", "b"]]`, []interface{}{int64(0), int64(1)}},
+	{`[x for x in []]`, []interface{}{}},
+	{`[[y * x for y in [1, 2]] for x in [1, 10]]`, []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{int64(10), int64(20)}}},
+	{`let x = 0; [x for x in [1, 2]]; x`, int64(0)},
+	{`1 < 2 ? "a" : "b"`, "a"},
+	{`1 > 2 ? "a" : 2 > 1 ? "b" : "c"`, "b"},
+	{`fn sq(x) = x * x; sq(3) + sq(4)`, int64(25)},
+	{`fn double(xs) = [x * 2 for x in xs]; double([1, 2])`, []interface{}{int64(2), int64(4)}},
+	{`fn fact(n) = n <= 1 ? 1 : n * fact(n - 1); fact(5)`, int64(120)},
+	{`fn clamp(x, lo, hi) = x < lo ? lo : (x > hi ? hi : x); [clamp(-1, 0, 10), clamp(5, 0, 10), clamp(11, 0, 10)]`, []interface{}{int64(0), int64(5), int64(10)}},
+	{`fn one() = 1; let x = one(); x + one()`, int64(2)},
 }
 
 func TestEvaluator(t *testing.T) {
@@ -137,6 +189,50 @@ var evaluatorTestsWithEnvironment = []evaluatorTestWithEnvironment{
 		map[string]interface{}{"a": 1.2, "b": 2.3, "add": func(a, b int64) int64 { return a + b }},
 		6.5,
 	},
+	{`0 < x <= 10`,
+		map[string]interface{}{"x": int64(10)},
+		true,
+	},
+	{`0 < x <= 10`,
+		map[string]interface{}{"x": int64(11)},
+		false,
+	},
+	{`if score > 90 then "A" else if score > 80 then "B" else "C"`,
+		map[string]interface{}{"score": int64(85)},
+		"B",
+	},
+	{`case status when "ok" then 1 when "warn" then fail() else fail() end`,
+		map[string]interface{}{"status": "ok", "fail": func() int64 { panic("branch must not be evaluated") }},
+		int64(1),
+	},
+	{`if flag then 1 else fail()`,
+		map[string]interface{}{"flag": true, "fail": func() int64 { panic("branch must not be evaluated") }},
+		int64(1),
+	},
+	{`let total = a + b; total * 2`,
+		map[string]interface{}{"a": 1.5, "b": 2.5},
+		8.0,
+	},
+	{`let a = a * 2; a + 1`,
+		map[string]interface{}{"a": int64(5)},
+		int64(11),
+	},
+	{`[k + "=" + string(v) for k, v in m if v > 1]`,
+		map[string]interface{}{"m": map[string]interface{}{"c": int64(3), "a": int64(1), "b": int64(2)}},
+		[]interface{}{"b=2", "c=3"},
+	},
+	{`[k for k in m]`,
+		map[string]interface{}{"m": map[string]interface{}{"b": 1.0, "a": 2.0}},
+		[]interface{}{"a", "b"},
+	},
+	{`[x / 2 for x in xs]`,
+		map[string]interface{}{"xs": []float64{1, 3}},
+		[]interface{}{0.5, 1.5},
+	},
+	{`fn clamp(x, lo, hi) = x < lo ? lo : (x > hi ? hi : x); clamp(a, 0, 10)`,
+		map[string]interface{}{"a": int64(42)},
+		int64(10),
+	},
 }
 
 func TestEvaluatorWithEnvironment(t *testing.T) {
@@ -150,3 +246,84 @@ func TestEvaluatorWithEnvironment(t *testing.T) {
 		assert.Equal(t, test.expected, evaluated)
 	}
 }
+
+func TestChainEvaluatesOperandOnce(t *testing.T) {
+	calls := 0
+	env := map[string]interface{}{"x": func() int64 {
+		calls++
+		return 5
+	}}
+	evaluated, err := Eval(parser.Parse("0 < x() <= 10"), env)
+	require.NoError(t, err)
+	assert.Equal(t, true, evaluated)
+	assert.Equal(t, 1, calls)
+}
+
+func TestConversionError(t *testing.T) {
+	_, err := Eval(parser.Parse(`int("abc") + 1`), nil)
+	assert.EqualError(t, err, `cannot convert "abc" (string) to int`)
+	_, err = Eval(parser.Parse(`float()`), nil)
+	assert.EqualError(t, err, "float() expects 1 argument, got 0")
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	_, err := Eval(parser.Parse(`fn f(x) = f(x + 1); f(0)`), nil)
+	assert.EqualError(t, err, "maximum call depth 1024 exceeded in f()")
+	_, err = Eval(parser.Parse(`fn f(x, y) = x; f(1)`), nil)
+	assert.EqualError(t, err, "f() expects 2 arguments, got 1")
+}
+
+func TestIterateError(t *testing.T) {
+	_, err := Eval(parser.Parse(`[x for x in 1]`), nil)
+	assert.EqualError(t, err, "cannot iterate over int64")
+	_, err = Eval(parser.Parse(`[x for x in [1] if x]`), nil)
+	assert.EqualError(t, err, "non-bool value in cond (int64)")
+}
+
+type contextKey struct{}
+
+func TestEvalContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey{}, int64(10)))
+	defer cancel()
+	env := map[string]interface{}{
+		"get":  func(ctx context.Context, x int64) int64 { return ctx.Value(contextKey{}).(int64) + x },
+		"stop": func(x int64) int64 { cancel(); return x },
+		"xs":   []interface{}{int64(1), int64(2)},
+	}
+	value, err := EvalContext(ctx, parser.Parse(`get(1)`), env)
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), value)
+	value, err = EvalContext(ctx, parser.Parse(`let a = get(1); fn f(x) = get(x); [f(x) for x in [a]]`), env)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(21)}, value)
+
+	_, err = EvalContext(ctx, parser.Parse(`1 + stop(1)`), env)
+	assert.Equal(t, &budget.InterruptedError{Offset: 4, Err: context.Canceled}, err)
+	_, err = EvalContext(ctx, parser.Parse(`[x for x in xs]`), env)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestEvalWith(t *testing.T) {
+	env := map[string]int64{"x": 1}
+	value, err := Eval(parser.Parse(`y`), env)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), value)
+	value, err = EvalWith(context.Background(), parser.Parse(`let z = 2; [y, z, x]`), env, builtin.Lenient)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{nil, int64(2), int64(1)}, value)
+	_, err = EvalWith(context.Background(), parser.Parse(`fn f(a) = a + y; f(x)`), env, builtin.Strict)
+	assert.EqualError(t, err, "unknown identifier `y` at col 15")
+	_, err = EvalWith(context.Background(), parser.Parse(`[g(a) for a in [x]]`), env, builtin.Lenient)
+	assert.EqualError(t, err, "unknown function `g` at col 2")
+}
+
+func TestEvalChain(t *testing.T) {
+	globals := map[string]interface{}{"rate": 0.5, "double": func(x float64) float64 { return x * 2 }}
+	request := map[string]interface{}{"amount": 10.0, "rate": 0.25}
+	value, err := Eval(parser.Parse(`double(amount * rate)`), builtin.Chain{request, globals})
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, value)
+	value, err = Eval(parser.Parse(`let x = rate; [x, missing]`), builtin.Chain{globals, request})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{0.5, nil}, value)
+}
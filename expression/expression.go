@@ -0,0 +1,160 @@
+package expression
+
+import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/engine"
+	"bachelor-thesis/parser"
+	"context"
+	"fmt"
+)
+
+// DefaultEngine runs the programs compiled without the Engine option.
+const DefaultEngine = "vm"
+
+// Program is a compiled source, executed with Run. A program can be shared
+// by goroutines, each run takes an idle machine of the program.
+type Program struct {
+	Source     string
+	executable engine.Executable
+}
+
+// Option configures Compile.
+type Option func(options *options)
+
+type options struct {
+	engine     string
+	config     engine.Config
+	configured bool
+}
+
+// Env type checks the program against an environment, given as a value of
+// its type, a reflect.Type or a checker.Schema, so that unknown identifiers
+// and invalid operations are reported by Compile. The fields and methods of a
+// struct environment are also resolved by Compile instead of on every Run.
+func Env(env interface{}) Option {
+	return func(options *options) {
+		options.config.Env = env
+		options.configured = true
+	}
+}
+
+// AsBool, AsInt64 and AsFloat64 require the program to produce a value of
+// that type. The type is checked by Compile when it is known and by Run
+// otherwise; an int64 result satisfies AsFloat64 and is converted.
+func AsBool() Option {
+	return result(engine.BoolResult)
+}
+
+func AsInt64() Option {
+	return result(engine.Int64Result)
+}
+
+func AsFloat64() Option {
+	return result(engine.Float64Result)
+}
+
+func result(result engine.Result) Option {
+	return func(options *options) {
+		options.config.Result = result
+		options.configured = true
+	}
+}
+
+// Engine selects the registered engine running the program, see
+// engine.Names.
+func Engine(name string) Option {
+	return func(options *options) { options.engine = name }
+}
+
+// Optimize sets the optimization level. Level 0, the default, compiles the
+// program as written. Level 1 folds constants and removes identities. Level 2
+// also selects the typed instructions on vm4, vm6 and vm7, for the operands
+// whose type is known from Env.
+func Optimize(level int) Option {
+	return func(options *options) {
+		options.config.Optimize = level >= 1
+		options.config.Typed = level >= 2
+		options.configured = true
+	}
+}
+
+// Limits bounds every run of the program, Run returns one of the errors of
+// the budget package when a limit is exceeded. It is not supported by the
+// evaluator engine.
+func Limits(limits budget.Limits) Option {
+	return func(options *options) {
+		options.config.Limits = limits
+		options.configured = true
+	}
+}
+
+// Strict makes Run fail with "unknown identifier `x` at col N" for a name
+// missing from the environment, and Lenient evaluates it to nil. Without
+// either a missing name is the zero value of the elements of a map
+// environment. Calling a missing function fails in both modes, and with Env
+// every unknown name is reported by Compile.
+func Strict() Option {
+	return mode(builtin.Strict)
+}
+
+func Lenient() Option {
+	return mode(builtin.Lenient)
+}
+
+func mode(mode builtin.Mode) Option {
+	return func(options *options) {
+		options.config.Mode = mode
+		options.configured = true
+	}
+}
+
+// Compile parses and compiles the source.
+func Compile(src string, opts ...Option) (program *Program, err error) {
+	options := &options{engine: DefaultEngine}
+	for _, option := range opts {
+		option(options)
+	}
+	e, err := engine.Lookup(options.engine)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// the parser reports syntax errors by panicking
+		if r := recover(); r != nil {
+			parseError, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			err = parseError
+		}
+	}()
+	tree := parser.Parse(src)
+	var executable engine.Executable
+	if configurable, ok := e.(engine.Configurable); ok {
+		executable, err = configurable.CompileWith(tree, options.config)
+	} else if options.configured {
+		return nil, fmt.Errorf("engine %s does not accept options", options.engine)
+	} else {
+		executable, err = e.Compile(tree)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Program{Source: src, executable: executable}, nil
+}
+
+// Run executes the program against an environment and returns its value. The
+// environment is a map with string keys, a struct, a builtin.Resolver looking
+// names up on demand, or a builtin.Chain of environments in which the first
+// one having a name wins.
+func Run(p *Program, env interface{}) (interface{}, error) {
+	return p.executable.Run(env)
+}
+
+// RunContext is Run stopping with a *budget.InterruptedError, which unwraps
+// to ctx.Err(), once ctx is done. Functions of env taking a context.Context as
+// first parameter receive ctx.
+func RunContext(ctx context.Context, p *Program, env interface{}) (interface{}, error) {
+	return p.executable.RunContext(ctx, env)
+}
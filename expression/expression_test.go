@@ -0,0 +1,128 @@
+package expression
+
+import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/checker"
+	"bachelor-thesis/engine"
+	"bachelor-thesis/parser/ast"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var schema = checker.Schema{
+	"Price": reflect.TypeOf(0.0),
+	"Count": reflect.TypeOf(int64(0)),
+	"Name":  reflect.TypeOf(""),
+}
+
+type env map[string]interface{}
+
+type expressionTest struct {
+	input    string
+	options  []Option
+	env      interface{}
+	expected interface{}
+	err      string
+}
+
+var expressionTests = []expressionTest{
+	{`1 + 2`, nil, nil, int64(3), ""},
+	{`add(1, 2)`, nil, map[string]interface{}{"add": func(a, b int64) int64 { return a + b }}, int64(3), ""},
+	{`Price * 2 > 10`, []Option{Env(schema), AsBool()}, env{"Price": 6.0}, true, ""},
+	{`Count * 1 + 0`, []Option{Env(schema), Optimize(2), AsInt64()}, env{"Count": int64(3)}, int64(3), ""},
+	{`Count`, []Option{Env(schema), AsFloat64()}, env{"Count": int64(3)}, 3.0, ""},
+	{`Name + "!"`, []Option{Env(schema), Optimize(1)}, env{"Name": "a"}, "a!", ""},
+	{`x`, []Option{AsBool()}, map[string]interface{}{"x": "a"}, nil, `expected bool result, got "a" (string)`},
+	{`"a"`, []Option{AsInt64()}, nil, nil, "expected int64 result, got string"},
+	{`Name - 1`, []Option{Env(schema)}, nil, nil, "invalid operation: string - int64 at position 5"},
+	{`Missing`, []Option{Env(schema)}, nil, nil, "unknown identifier Missing at position 0"},
+	{`1 is number`, nil, nil, nil, `Parse error: unknown type "number"`},
+	{`Count`, nil, env{}, nil, ""},
+	{`Count is nil`, []Option{Lenient()}, map[string]int64{}, true, ""},
+	{`Count + 1`, []Option{Strict()}, env{}, nil, "unknown identifier `Count` at col 1"},
+	{`Missing`, []Option{Env(schema), Lenient()}, nil, nil, "unknown identifier Missing at position 0"},
+	{`Price * Count`, []Option{Env(builtin.Chain{env{"Count": int64(1)}, schema})}, builtin.Chain{env{"Count": int64(3)}, env{"Price": 2.0, "Count": int64(9)}}, 6.0, ""},
+}
+
+func TestCompileAndRun(t *testing.T) {
+	for _, name := range []string{"evaluator", "vm", "vm2", "vm3", "vm4", "vm5", "vm6", "vm7"} {
+		for _, test := range expressionTests {
+			program, err := Compile(test.input, append(test.options, Engine(name))...)
+			var result interface{}
+			if err == nil {
+				result, err = Run(program, test.env)
+			}
+			if test.err != "" {
+				require.Error(t, err, name, test.input)
+				assert.Contains(t, err.Error(), test.err, name, test.input)
+				continue
+			}
+			require.NoError(t, err, name, test.input)
+			assert.Equal(t, test.expected, result, name, test.input)
+		}
+	}
+}
+
+func TestDefaultEngine(t *testing.T) {
+	program, err := Compile(`x * 2`)
+	require.NoError(t, err)
+	assert.Equal(t, `x * 2`, program.Source)
+	for _, x := range []int64{1, 2} {
+		result, err := Run(program, map[string]interface{}{"x": x})
+		require.NoError(t, err)
+		assert.Equal(t, x*2, result)
+	}
+}
+
+func TestUnknownEngine(t *testing.T) {
+	_, err := Compile(`1`, Engine("vm8"))
+	assert.EqualError(t, err, "unknown engine vm8")
+}
+
+// plain is an engine without a Config.
+type plain struct{}
+
+func (plain) Compile(node ast.Node) (engine.Executable, error) {
+	return nil, errors.New("compiled without options")
+}
+
+func init() {
+	engine.Register("plain", plain{})
+}
+
+func TestEngineWithoutOptions(t *testing.T) {
+	_, err := Compile(`1`, Engine("plain"))
+	assert.EqualError(t, err, "compiled without options")
+	_, err = Compile(`1`, Engine("plain"), AsInt64())
+	assert.EqualError(t, err, "engine plain does not accept options")
+}
+
+func TestLimits(t *testing.T) {
+	program, err := Compile(`[1, 2, 3]`, Limits(budget.Limits{ArrayLength: 2}))
+	require.NoError(t, err)
+	_, err = Run(program, nil)
+	var lengthError *budget.ArrayLengthError
+	require.ErrorAs(t, err, &lengthError)
+	assert.Equal(t, 3, lengthError.Length)
+	_, err = Compile(`1`, Engine("evaluator"), Limits(budget.Limits{Instructions: 10}))
+	assert.EqualError(t, err, "the evaluator does not support limits")
+}
+
+func TestRunContext(t *testing.T) {
+	program, err := Compile(`wait(1)`)
+	require.NoError(t, err)
+	env := map[string]interface{}{"wait": func(ctx context.Context, x int64) (int64, error) {
+		<-ctx.Done()
+		return x, ctx.Err()
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = RunContext(ctx, program, env)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,232 @@
+package optimizer
+
+import (
+	"bachelor-thesis/evaluator"
+	"bachelor-thesis/parser/ast"
+	"reflect"
+	"strconv"
+)
+
+var (
+	intType   = reflect.TypeOf(int64(0))
+	floatType = reflect.TypeOf(float64(0))
+	boolType  = reflect.TypeOf(true)
+)
+
+// Optimize folds operations on literals into a single literal and removes
+// identities such as `x * 1`, `x + 0`, `not not x` and `true and x`.
+//
+// An operation is folded only when evaluating it succeeds, so expressions
+// failing at runtime (`1 / 0`, `"a" + 1`) are kept and still fail there.
+// Identities are removed only when the checker has annotated the remaining
+// operand with a type for which they hold.
+//
+// The given tree is left as it is: the nodes on the way to a rewrite are
+// copied and the returned tree shares the others with it.
+func Optimize(node ast.Node) ast.Node {
+	switch n := node.(type) {
+	case *ast.UnaryNode:
+		c := *n
+		c.Node = Optimize(n.Node)
+		if inner, ok := c.Node.(*ast.UnaryNode); ok && c.Operator == "not" && inner.Operator == "not" &&
+			inner.Node.ValueType() == boolType {
+			return inner.Node
+		}
+		return fold(&c, c.Node)
+	case *ast.BinaryNode:
+		c := *n
+		c.Left = Optimize(n.Left)
+		c.Right = Optimize(n.Right)
+		if simplified := simplify(&c); simplified != nil {
+			return simplified
+		}
+		if (c.Operator == "/" || c.Operator == "%") && isZero(c.Right) {
+			return &c
+		}
+		return fold(&c, c.Left, c.Right)
+	case *ast.ChainNode:
+		c := *n
+		c.Operands = optimizeAll(n.Operands)
+		return fold(&c, c.Operands...)
+	case *ast.IsNode:
+		c := *n
+		c.Node = Optimize(n.Node)
+		return fold(&c, c.Node)
+	case *ast.ConditionalNode:
+		c := *n
+		c.Condition = Optimize(n.Condition)
+		c.Then = Optimize(n.Then)
+		if n.Else != nil {
+			c.Else = Optimize(n.Else)
+		}
+		return &c
+	case *ast.CaseNode:
+		c := *n
+		if n.Subject != nil {
+			c.Subject = Optimize(n.Subject)
+		}
+		c.Conditions = optimizeAll(n.Conditions)
+		c.Results = optimizeAll(n.Results)
+		if n.Else != nil {
+			c.Else = Optimize(n.Else)
+		}
+		return &c
+	case *ast.ProgramNode:
+		c := *n
+		c.Statements = optimizeAll(n.Statements)
+		return &c
+	case *ast.LetNode:
+		c := *n
+		c.Value = Optimize(n.Value)
+		return &c
+	case *ast.FunctionNode:
+		c := *n
+		c.Body = Optimize(n.Body)
+		return &c
+	case *ast.CallNode:
+		c := *n
+		c.Arguments = optimizeAll(n.Arguments)
+		return &c
+	case *ast.ArrayNode:
+		c := *n
+		c.Nodes = optimizeAll(n.Nodes)
+		return &c
+	case *ast.MemberNode:
+		c := *n
+		c.Node = Optimize(n.Node)
+		c.Property = Optimize(n.Property)
+		return &c
+	case *ast.ComprehensionNode:
+		c := *n
+		c.Element = Optimize(n.Element)
+		c.Collection = Optimize(n.Collection)
+		if n.Condition != nil {
+			c.Condition = Optimize(n.Condition)
+		}
+		return &c
+	}
+	return node
+}
+
+func optimizeAll(nodes []ast.Node) []ast.Node {
+	optimized := make([]ast.Node, len(nodes))
+	for i, node := range nodes {
+		optimized[i] = Optimize(node)
+	}
+	return optimized
+}
+
+// simplify returns the operand left of an identity, or nil.
+func simplify(node *ast.BinaryNode) ast.Node {
+	switch node.Operator {
+	case "+":
+		// only for ints, -0.0 + 0 is 0.0
+		if isInt(node.Right, 0) && node.Left.ValueType() == intType {
+			return node.Left
+		}
+		if isInt(node.Left, 0) && node.Right.ValueType() == intType {
+			return node.Right
+		}
+	case "-":
+		if isInt(node.Right, 0) && isNumber(node.Left) {
+			return node.Left
+		}
+	case "*":
+		if isInt(node.Right, 1) && isNumber(node.Left) {
+			return node.Left
+		}
+		if isInt(node.Left, 1) && isNumber(node.Right) {
+			return node.Right
+		}
+	case "and":
+		if isBool(node.Left, true) && node.Right.ValueType() == boolType {
+			return node.Right
+		}
+	case "or":
+		if isBool(node.Left, false) && node.Right.ValueType() == boolType {
+			return node.Right
+		}
+	}
+	return nil
+}
+
+// fold replaces node with the literal it evaluates to when all operands are
+// literals.
+func fold(node ast.Node, operands ...ast.Node) ast.Node {
+	for _, operand := range operands {
+		if !isLiteral(operand) {
+			return node
+		}
+	}
+	value, ok := eval(node)
+	if !ok {
+		return node
+	}
+	literal := newLiteral(value)
+	if literal == nil {
+		return node
+	}
+	literal.SetPos(node.Pos())
+	if value != nil {
+		literal.SetValueType(reflect.TypeOf(value))
+	} else {
+		literal.SetValueType(node.ValueType())
+	}
+	return literal
+}
+
+// eval evaluates a literal operation, the tree walker panics on some
+// invalid operands instead of returning an error.
+func eval(node ast.Node) (value interface{}, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	value, err := evaluator.Eval(node, nil)
+	return value, err == nil
+}
+
+func newLiteral(value interface{}) ast.Node {
+	switch v := value.(type) {
+	case int64:
+		return &ast.NumberNode{Value: strconv.FormatInt(v, 10), Int64: v, IsInt: true, NodeType: ast.NodeNumber}
+	case float64:
+		return &ast.NumberNode{Value: strconv.FormatFloat(v, 'g', -1, 64), Float64: v, IsFloat: true, NodeType: ast.NodeNumber}
+	case string:
+		return &ast.StringNode{Value: v, NodeType: ast.NodeString}
+	case bool:
+		return &ast.BoolNode{Value: v, NodeType: ast.NodeBool}
+	case nil:
+		return &ast.NilNode{NodeType: ast.NodeNil}
+	}
+	return nil
+}
+
+func isLiteral(node ast.Node) bool {
+	switch node.Type() {
+	case ast.NodeNumber, ast.NodeString, ast.NodeBool, ast.NodeNil:
+		return true
+	}
+	return false
+}
+
+func isZero(node ast.Node) bool {
+	number, ok := node.(*ast.NumberNode)
+	return ok && (number.IsInt && number.Int64 == 0 || number.IsFloat && number.Float64 == 0)
+}
+
+func isInt(node ast.Node, value int64) bool {
+	number, ok := node.(*ast.NumberNode)
+	return ok && number.IsInt && number.Int64 == value
+}
+
+func isBool(node ast.Node, value bool) bool {
+	b, ok := node.(*ast.BoolNode)
+	return ok && b.Value == value
+}
+
+func isNumber(node ast.Node) bool {
+	t := node.ValueType()
+	return t == intType || t == floatType
+}
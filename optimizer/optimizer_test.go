@@ -0,0 +1,92 @@
+package optimizer
+
+import (
+	"bachelor-thesis/checker"
+	"bachelor-thesis/parser"
+	"bachelor-thesis/parser/ast"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"reflect"
+	"testing"
+)
+
+type optimizerTest struct {
+	input    string
+	env      checker.Schema
+	expected string
+}
+
+var optimizerTests = []optimizerTest{
+	{"1 + 2 * 3", nil, "7"},
+	{"1 + 2 + 3 + 4 + 5", nil, "15"},
+	{"1.5 + 1", nil, "2.5"},
+	{"7 % 4 ^ 1", nil, "3"},
+	{`"a" + "b" + "c"`, nil, `"abc"`},
+	{"1 < 2", nil, "true"},
+	{"1 < 2 <= 2", nil, "true"},
+	{`"a" == "b"`, nil, "false"},
+	{"not true or false", nil, "false"},
+	{"1 is int", nil, "true"},
+	{"x + (2 * 3)", nil, "x + 6"},
+	{"[1 + 1, x]", nil, "[2, x]"},
+	{"if x then 1 + 1 else 2 * 2", nil, "if x then 2 else 4"},
+	{"let y = 2 * 2; y + 1", nil, "let y = 4; y + 1"},
+	{"fn f(a) = a * (1 + 1); f(2)", nil, "fn f(a) = a * 2; f(2)"},
+
+	// Failing operations are kept.
+	{"1 / 0", nil, "1 / 0"},
+	{"1 % 0", nil, "1 % 0"},
+	{"1.5 / 0", nil, "1.5 / 0"},
+	{`"a" + 1`, nil, `"a" + 1`},
+	{"not 1", nil, "not 1"},
+
+	// Identities need an operand of known type.
+	{"x * 1", nil, "x * 1"},
+	{"x * 1", checker.Schema{"x": reflect.TypeOf(int64(0))}, "x"},
+	{"1 * x + 0", checker.Schema{"x": reflect.TypeOf(int64(0))}, "x"},
+	{"1 * x + 0", checker.Schema{"x": reflect.TypeOf(0.0)}, "x + 0"},
+	{"0 + x", checker.Schema{"x": reflect.TypeOf(0.0)}, "0 + x"},
+	{"x - 0", checker.Schema{"x": reflect.TypeOf(0.0)}, "x"},
+	{"x + (1 - 1)", checker.Schema{"x": reflect.TypeOf(int64(0))}, "x"},
+	{"x + 0", checker.Schema{"x": reflect.TypeOf((*interface{})(nil)).Elem()}, "x + 0"},
+	{"not not x", checker.Schema{"x": reflect.TypeOf(true)}, "x"},
+	{"not not x", nil, "not not x"},
+	{"true and x", checker.Schema{"x": reflect.TypeOf(true)}, "x"},
+	{"false or x", checker.Schema{"x": reflect.TypeOf(true)}, "x"},
+	{"true and x", checker.Schema{"x": reflect.TypeOf((*interface{})(nil)).Elem()}, "true and x"},
+}
+
+func TestOptimize(t *testing.T) {
+	for _, test := range optimizerTests {
+		node := parser.Parse(test.input)
+		if test.env != nil {
+			_, err := checker.Check(node, test.env)
+			require.NoError(t, err, test.input)
+		}
+		expected := ast.Print(parser.Parse(test.expected))
+		assert.Equal(t, expected, ast.Print(Optimize(node)), test.input)
+	}
+}
+
+func TestFoldedLiteral(t *testing.T) {
+	node := parser.Parse("x + -(2 * 3)")
+	_, err := checker.Check(node, checker.Schema{"x": reflect.TypeOf(0.0)})
+	require.NoError(t, err)
+	right := Optimize(node).(*ast.BinaryNode).Right.(*ast.NumberNode)
+	assert.Equal(t, int64(-6), right.Int64)
+	assert.Equal(t, "-6", right.Value)
+	assert.Equal(t, 4, right.Pos())
+	assert.Equal(t, reflect.TypeOf(int64(0)), right.ValueType())
+}
+
+// TestInputUnchanged checks that the engines can optimize a tree their caller
+// still uses.
+func TestInputUnchanged(t *testing.T) {
+	node := parser.Parse(`let y = x * 1 + (2 + 3); [not not (y > 1), case y when 1 + 1 then 2 * 2 end]`)
+	_, err := checker.Check(node, checker.Schema{"x": reflect.TypeOf(int64(0))})
+	require.NoError(t, err)
+	before := ast.Print(node)
+	optimized := Optimize(node)
+	assert.Equal(t, before, ast.Print(node))
+	assert.NotEqual(t, before, ast.Print(optimized))
+}
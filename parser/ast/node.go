@@ -1,9 +1,39 @@
 package ast
 
+import "reflect"
+
 type NodeType int
 
 type Node interface {
 	Type() NodeType
+	Pos() int
+	SetPos(pos int)
+	ValueType() reflect.Type
+	SetValueType(t reflect.Type)
+}
+
+// info is embedded in every node: the offset of the node in the source and
+// the type of its value once the checker has inferred it.
+type info struct {
+	pos       int
+	valueType reflect.Type
+}
+
+func (info *info) Pos() int {
+	return info.pos
+}
+
+func (info *info) SetPos(pos int) {
+	info.pos = pos
+}
+
+// ValueType is nil until the node has been checked.
+func (info *info) ValueType() reflect.Type {
+	return info.valueType
+}
+
+func (info *info) SetValueType(t reflect.Type) {
+	info.valueType = t
 }
 
 func (t NodeType) Type() NodeType {
@@ -12,6 +42,7 @@ func (t NodeType) Type() NodeType {
 
 type NumberNode struct {
 	NodeType
+	info
 	Value   string
 	IsInt   bool
 	Int64   int64
@@ -25,6 +56,7 @@ func (node *NumberNode) Type() NodeType {
 
 type IdentifierNode struct {
 	NodeType
+	info
 	Value string
 }
 
@@ -34,6 +66,7 @@ func (node *IdentifierNode) Type() NodeType {
 
 type StringNode struct {
 	NodeType
+	info
 	Value string
 }
 
@@ -43,6 +76,7 @@ func (node *StringNode) Type() NodeType {
 
 type BoolNode struct {
 	NodeType
+	info
 	Value bool
 }
 
@@ -52,6 +86,7 @@ func (node *BoolNode) Type() NodeType {
 
 type NilNode struct {
 	NodeType
+	info
 }
 
 func (node *NilNode) Type() NodeType {
@@ -60,6 +95,7 @@ func (node *NilNode) Type() NodeType {
 
 type UnaryNode struct {
 	NodeType
+	info
 	Operator string
 	Node     Node
 }
@@ -70,6 +106,7 @@ func (node *UnaryNode) Type() NodeType {
 
 type BinaryNode struct {
 	NodeType
+	info
 	Operator string
 	Left     Node
 	Right    Node
@@ -79,19 +116,123 @@ func (node *BinaryNode) Type() NodeType {
 	return NodeBinary
 }
 
+type ChainNode struct {
+	NodeType
+	info
+	Operators []string
+	Operands  []Node
+}
+
+func (node *ChainNode) Type() NodeType {
+	return NodeChain
+}
+
+type ConditionalNode struct {
+	NodeType
+	info
+	Condition Node
+	Then      Node
+	Else      Node
+}
+
+func (node *ConditionalNode) Type() NodeType {
+	return NodeConditional
+}
+
+// CaseNode holds both `case x when 1 then ...` and `case when x > 1 then ...`,
+// the latter has no Subject.
+type CaseNode struct {
+	NodeType
+	info
+	Subject    Node
+	Conditions []Node
+	Results    []Node
+	Else       Node
+}
+
+func (node *CaseNode) Type() NodeType {
+	return NodeCase
+}
+
+// IsNode is a type test `x is string`.
+type IsNode struct {
+	NodeType
+	info
+	Node     Node
+	TypeName string
+}
+
+func (node *IsNode) Type() NodeType {
+	return NodeIs
+}
+
+// ProgramNode is a sequence of statements `a; b; c`, its value is the value of the last one.
+type ProgramNode struct {
+	NodeType
+	info
+	Statements []Node
+}
+
+func (node *ProgramNode) Type() NodeType {
+	return NodeProgram
+}
+
+type LetNode struct {
+	NodeType
+	info
+	Name  string
+	Value Node
+}
+
+func (node *LetNode) Type() NodeType {
+	return NodeLet
+}
+
+// FunctionNode is a definition `fn name(a, b) = body`.
+type FunctionNode struct {
+	NodeType
+	info
+	Name       string
+	Parameters []string
+	Body       Node
+}
+
+func (node *FunctionNode) Type() NodeType {
+	return NodeFunction
+}
+
 type CallNode struct {
 	NodeType
+	info
 	Callee    Node
 	Arguments []Node
 }
 
 type ArrayNode struct {
 	NodeType
+	info
 	Nodes []Node
 }
 
+// ComprehensionNode is `[Element for Variables in Collection if Condition]`.
+// With one variable it is bound to array elements or map keys, with two
+// to index and element or key and value. Condition is nil without `if`.
+type ComprehensionNode struct {
+	NodeType
+	info
+	Element    Node
+	Variables  []string
+	Collection Node
+	Condition  Node
+}
+
+func (node *ComprehensionNode) Type() NodeType {
+	return NodeComprehension
+}
+
 type MemberNode struct {
 	NodeType
+	info
 	Node     Node
 	Property Node
 }
@@ -107,4 +248,12 @@ const (
 	NodeCall
 	NodeArray
 	NodeMember
+	NodeChain
+	NodeConditional
+	NodeCase
+	NodeIs
+	NodeProgram
+	NodeLet
+	NodeFunction
+	NodeComprehension
 )
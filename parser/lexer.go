@@ -16,6 +16,7 @@ const (
 	itemBool
 	itemString
 	itemNil
+	itemKeyword
 	itemEOF = -1
 )
 
@@ -164,12 +165,14 @@ loop:
 			switch lexer.word() {
 			case "not":
 				lexer.emit(itemOperator)
-			case "or", "and":
+			case "or", "and", "is":
 				lexer.emit(itemOperator)
 			case "true", "false":
 				lexer.emit(itemBool)
 			case "nil":
 				lexer.emit(itemNil)
+			case "if", "then", "else", "case", "when", "end", "let", "fn", "for", "in":
+				lexer.emit(itemKeyword)
 			default:
 				lexer.emit(itemIdentifier)
 			}
@@ -203,6 +206,8 @@ func scan(lexer *Lexer) stateFn {
 			lexer.backup()
 		}
 		lexer.emit(itemOperator)
+	case strings.ContainsRune(";?:", r):
+		lexer.emit(itemOperator)
 	case isAlphaNumeric(r):
 		lexer.backup()
 		return lexIdentifier
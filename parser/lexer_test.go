@@ -95,6 +95,56 @@ var lexTests = []lexTest{
 			{tokenType: itemEOF},
 		},
 	},
+	{
+		`if a then 1 else 2`,
+		[]Token{
+			{tokenType: itemKeyword, val: "if"},
+			{tokenType: itemIdentifier, val: "a"},
+			{tokenType: itemKeyword, val: "then"},
+			{tokenType: itemNumber, val: "1"},
+			{tokenType: itemKeyword, val: "else"},
+			{tokenType: itemNumber, val: "2"},
+			{tokenType: itemEOF},
+		},
+	},
+	{
+		`case a when "b" then c end`,
+		[]Token{
+			{tokenType: itemKeyword, val: "case"},
+			{tokenType: itemIdentifier, val: "a"},
+			{tokenType: itemKeyword, val: "when"},
+			{tokenType: itemString, val: "b"},
+			{tokenType: itemKeyword, val: "then"},
+			{tokenType: itemIdentifier, val: "c"},
+			{tokenType: itemKeyword, val: "end"},
+			{tokenType: itemEOF},
+		},
+	},
+	{
+		`[x for x in xs]`,
+		[]Token{
+			{tokenType: itemBracket, val: "["},
+			{tokenType: itemIdentifier, val: "x"},
+			{tokenType: itemKeyword, val: "for"},
+			{tokenType: itemIdentifier, val: "x"},
+			{tokenType: itemKeyword, val: "in"},
+			{tokenType: itemIdentifier, val: "xs"},
+			{tokenType: itemBracket, val: "]"},
+			{tokenType: itemEOF},
+		},
+	},
+	{
+		`let a = 1; a`,
+		[]Token{
+			{tokenType: itemKeyword, val: "let"},
+			{tokenType: itemIdentifier, val: "a"},
+			{tokenType: itemOperator, val: "="},
+			{tokenType: itemNumber, val: "1"},
+			{tokenType: itemOperator, val: ";"},
+			{tokenType: itemIdentifier, val: "a"},
+			{tokenType: itemEOF},
+		},
+	},
 }
 
 func compareTokens(token1, token2 []Token) bool {
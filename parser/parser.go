@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/parser/ast"
 	"fmt"
 	"reflect"
@@ -30,6 +31,7 @@ var binaryOperators = map[string]int{
 	">=":  3,
 	"==":  3,
 	"!=":  3,
+	"is":  3,
 	"+":   4,
 	"-":   4,
 	"*":   5,
@@ -38,6 +40,15 @@ var binaryOperators = map[string]int{
 	"^":   5,
 }
 
+// comparisonOperators join chains like `0 < x <= 10`. Equality does not, so
+// `a < b == c` still compares the result of `a < b` with c.
+var comparisonOperators = map[string]bool{
+	"<":  true,
+	"<=": true,
+	">":  true,
+	">=": true,
+}
+
 func (parser *Parser) next() {
 	if parser.pos+1 >= len(parser.tokens) {
 		return
@@ -49,6 +60,14 @@ func (parser *Parser) next() {
 func (parser *Parser) parsePrimaryExpression() ast.Node {
 	token := parser.currToken
 	parser.next()
+	node := parser.parseLiteral(token)
+	if node != nil && !reflect.ValueOf(node).IsNil() {
+		node.SetPos(token.pos)
+	}
+	return node
+}
+
+func (parser *Parser) parseLiteral(token Token) ast.Node {
 	switch token.tokenType {
 	case itemNumber:
 		if strings.ContainsAny(token.val, ".eE") {
@@ -86,6 +105,7 @@ func (parser *Parser) parsePostfixExpression(node ast.Node) ast.Node {
 				Node:     node,
 				Property: from,
 			}
+			node.SetPos(currToken.pos)
 			if parser.currToken.val == "]" {
 				parser.next()
 			} else {
@@ -105,6 +125,7 @@ func (parser *Parser) parsePrimary() ast.Node {
 			parser.next()
 			expr := parser.parseExpression(unaryOperators[token.val])
 			node := &ast.UnaryNode{Operator: token.val, Node: expr}
+			node.SetPos(token.pos)
 			return parser.parsePostfixExpression(node)
 		}
 	case itemBracket:
@@ -118,7 +139,19 @@ func (parser *Parser) parsePrimary() ast.Node {
 			}
 			return parser.parsePostfixExpression(expr)
 		} else if token.val == "[" {
-			return parser.parsePostfixExpression(parser.parseArray())
+			array := parser.parseArray()
+			array.SetPos(token.pos)
+			return parser.parsePostfixExpression(array)
+		}
+	case itemKeyword:
+		if token.val == "if" {
+			node := parser.parseConditional()
+			node.SetPos(token.pos)
+			return node
+		} else if token.val == "case" {
+			node := parser.parseCase()
+			node.SetPos(token.pos)
+			return node
 		}
 	}
 	return parser.parsePrimaryExpression()
@@ -127,25 +160,159 @@ func (parser *Parser) parsePrimary() ast.Node {
 func (parser *Parser) parseExpression(precedence int) ast.Node {
 	left := parser.parsePrimary()
 	token := parser.currToken
+	comparison := false
 	for token.tokenType == itemOperator {
 		if token.tokenType == itemOperator {
 			if binaryOperators[token.val] > precedence {
 				parser.next()
+				if token.val == "is" {
+					left = parser.parseIs(left)
+					left.SetPos(token.pos)
+					comparison = false
+					token = parser.currToken
+					continue
+				}
 				right := parser.parseExpression(binaryOperators[token.val])
-				left = &ast.BinaryNode{
-					Operator: token.val,
-					Left:     left,
-					Right:    right,
+				if comparison && comparisonOperators[token.val] {
+					left = parser.parseChain(left, token.val, right)
+				} else {
+					left = &ast.BinaryNode{
+						Operator: token.val,
+						Left:     left,
+						Right:    right,
+					}
+					left.SetPos(token.pos)
 				}
+				comparison = comparisonOperators[token.val]
 				token = parser.currToken
 				continue
 			}
 		}
 		break
 	}
+	if precedence == 0 && parser.isOperator("?") {
+		pos := parser.currToken.pos
+		node := parser.parseTernary(left)
+		node.SetPos(pos)
+		return node
+	}
 	return left
 }
 
+// parseTernary parses `cond ? a : b` into the same node as `if cond then a else b`.
+func (parser *Parser) parseTernary(condition ast.Node) ast.Node {
+	parser.next()
+	then := parser.parseExpression(0)
+	parser.expectOperator(":")
+	return &ast.ConditionalNode{
+		Condition: condition,
+		Then:      then,
+		Else:      parser.parseExpression(0),
+		NodeType:  ast.NodeConditional,
+	}
+}
+
+// parseChain turns `a < b` followed by `<= c` into a single chain `a < b <= c`,
+// so the shared operand b is evaluated only once.
+func (parser *Parser) parseChain(left ast.Node, operator string, right ast.Node) ast.Node {
+	if chain, ok := left.(*ast.ChainNode); ok {
+		chain.Operators = append(chain.Operators, operator)
+		chain.Operands = append(chain.Operands, right)
+		return chain
+	}
+	binary := left.(*ast.BinaryNode)
+	chain := &ast.ChainNode{
+		Operators: []string{binary.Operator, operator},
+		Operands:  []ast.Node{binary.Left, binary.Right, right},
+		NodeType:  ast.NodeChain,
+	}
+	chain.SetPos(binary.Pos())
+	return chain
+}
+
+func (parser *Parser) parseIs(node ast.Node) ast.Node {
+	token := parser.currToken
+	if token.tokenType != itemIdentifier && token.tokenType != itemNil {
+		parser.errorf("type name is expected after 'is'")
+	}
+	if !builtin.IsType(token.val) {
+		parser.errorf("unknown type %q", token.val)
+	}
+	parser.next()
+	return &ast.IsNode{
+		Node:     node,
+		TypeName: token.val,
+		NodeType: ast.NodeIs,
+	}
+}
+
+func (parser *Parser) parseConditional() ast.Node {
+	parser.next()
+	condition := parser.parseExpression(0)
+	parser.expect("then")
+	then := parser.parseExpression(0)
+	var otherwise ast.Node
+	if parser.isKeyword("else") {
+		parser.next()
+		otherwise = parser.parseExpression(0)
+	}
+	return &ast.ConditionalNode{
+		Condition: condition,
+		Then:      then,
+		Else:      otherwise,
+		NodeType:  ast.NodeConditional,
+	}
+}
+
+func (parser *Parser) parseCase() ast.Node {
+	parser.next()
+	node := &ast.CaseNode{
+		Conditions: make([]ast.Node, 0),
+		Results:    make([]ast.Node, 0),
+		NodeType:   ast.NodeCase,
+	}
+	if !parser.isKeyword("when") {
+		node.Subject = parser.parseExpression(0)
+	}
+	for parser.isKeyword("when") {
+		parser.next()
+		node.Conditions = append(node.Conditions, parser.parseExpression(0))
+		parser.expect("then")
+		node.Results = append(node.Results, parser.parseExpression(0))
+	}
+	if len(node.Conditions) == 0 {
+		parser.errorf("'when' is expected")
+	}
+	if parser.isKeyword("else") {
+		parser.next()
+		node.Else = parser.parseExpression(0)
+	}
+	parser.expect("end")
+	return node
+}
+
+func (parser *Parser) isKeyword(keyword string) bool {
+	return parser.currToken.tokenType == itemKeyword && parser.currToken.val == keyword
+}
+
+func (parser *Parser) expect(keyword string) {
+	if !parser.isKeyword(keyword) {
+		parser.errorf("'%s' is expected", keyword)
+	}
+	parser.next()
+}
+
+func (parser *Parser) isOperator(operator string) bool {
+	return parser.currToken.tokenType == itemOperator && parser.currToken.val == operator
+}
+
+func (parser *Parser) expectOperator(operator string) {
+	if !parser.isOperator(operator) {
+		parser.errorf("'%s' is expected", operator)
+	}
+	parser.next()
+}
+
 func (parser *Parser) parseFunctionCall(token Token) ast.Node {
 	arguments := make([]ast.Node, 0)
 	for parser.currToken.val != ")" {
@@ -157,6 +324,9 @@ func (parser *Parser) parseFunctionCall(token Token) ast.Node {
 			}
 		} else {
 			parser.next()
+			if parser.currToken.val == ")" {
+				break
+			}
 		}
 		node := parser.parseExpression(0)
 		if node != nil && !reflect.ValueOf(node).IsNil() {
@@ -168,8 +338,10 @@ func (parser *Parser) parseFunctionCall(token Token) ast.Node {
 	if parser.currToken.val == ")" {
 		parser.next()
 	}
+	callee := &ast.IdentifierNode{Value: token.val, NodeType: ast.NodeIdentifier}
+	callee.SetPos(token.pos)
 	return &ast.CallNode{
-		Callee:    &ast.IdentifierNode{Value: token.val, NodeType: ast.NodeIdentifier},
+		Callee:    callee,
 		Arguments: arguments,
 		NodeType:  ast.NodeCall,
 	}
@@ -188,7 +360,13 @@ func (parser *Parser) parseArray() ast.Node {
 		} else {
 			parser.next()
 		}
+		if parser.currToken.val == "]" {
+			break
+		}
 		node := parser.parseExpression(0)
+		if len(nodes) == 0 && parser.isKeyword("for") {
+			return parser.parseComprehension(node)
+		}
 		if node != nil && !reflect.ValueOf(node).IsNil() {
 			nodes = append(nodes, node)
 		} else {
@@ -204,6 +382,37 @@ func (parser *Parser) parseArray() ast.Node {
 	}
 }
 
+func (parser *Parser) parseComprehension(element ast.Node) ast.Node {
+	parser.next()
+	node := &ast.ComprehensionNode{
+		Element:   element,
+		Variables: make([]string, 0, 2),
+		NodeType:  ast.NodeComprehension,
+	}
+	for {
+		if parser.currToken.tokenType != itemIdentifier {
+			parser.errorf("identifier is expected after 'for'")
+		}
+		node.Variables = append(node.Variables, parser.currToken.val)
+		parser.next()
+		if len(node.Variables) == 2 || !parser.isOperator(",") {
+			break
+		}
+		parser.next()
+	}
+	parser.expect("in")
+	node.Collection = parser.parseExpression(0)
+	if parser.isKeyword("if") {
+		parser.next()
+		node.Condition = parser.parseExpression(0)
+	}
+	if parser.currToken.val != "]" {
+		parser.errorf("']' is expected")
+	}
+	parser.next()
+	return node
+}
+
 func Parse(input string) ast.Node {
 	tokens := lex(input)
 
@@ -213,10 +422,90 @@ func Parse(input string) ast.Node {
 		currToken: tokens[0],
 	}
 
-	node := parser.parseExpression(0)
+	node := parser.parseProgram()
+	return node
+}
+
+func (parser *Parser) parseProgram() ast.Node {
+	statements := []ast.Node{parser.parseStatement()}
+	for parser.isOperator(";") {
+		parser.next()
+		if parser.currToken.tokenType == itemEOF {
+			break
+		}
+		statements = append(statements, parser.parseStatement())
+	}
+	if parser.currToken.tokenType != itemEOF {
+		parser.errorf("unexpected token %q at position %d", parser.currToken.val, parser.currToken.pos)
+	}
+	if len(statements) == 1 {
+		return statements[0]
+	}
+	return &ast.ProgramNode{
+		Statements: statements,
+		NodeType:   ast.NodeProgram,
+	}
+}
+
+func (parser *Parser) parseStatement() ast.Node {
+	token := parser.currToken
+	if parser.isKeyword("fn") {
+		node := parser.parseFunction()
+		node.SetPos(token.pos)
+		return node
+	}
+	if !parser.isKeyword("let") {
+		return parser.parseExpression(0)
+	}
+	parser.next()
+	name := parser.currToken
+	if name.tokenType != itemIdentifier {
+		parser.errorf("identifier is expected after 'let'")
+	}
+	parser.next()
+	parser.expectOperator("=")
+	node := &ast.LetNode{
+		Name:     name.val,
+		Value:    parser.parseExpression(0),
+		NodeType: ast.NodeLet,
+	}
+	node.SetPos(token.pos)
 	return node
 }
 
+func (parser *Parser) parseFunction() ast.Node {
+	parser.next()
+	name := parser.currToken
+	if name.tokenType != itemIdentifier {
+		parser.errorf("function name is expected after 'fn'")
+	}
+	parser.next()
+	if parser.currToken.val != "(" {
+		parser.errorf("'(' is expected")
+	}
+	parser.next()
+	parameters := make([]string, 0)
+	for parser.currToken.tokenType == itemIdentifier {
+		parameters = append(parameters, parser.currToken.val)
+		parser.next()
+		if !parser.isOperator(",") {
+			break
+		}
+		parser.next()
+	}
+	if parser.currToken.val != ")" {
+		parser.errorf("')' is expected")
+	}
+	parser.next()
+	parser.expectOperator("=")
+	return &ast.FunctionNode{
+		Name:       name.val,
+		Parameters: parameters,
+		Body:       parser.parseExpression(0),
+		NodeType:   ast.NodeFunction,
+	}
+}
+
 func (parser *Parser) errorf(format string, args ...any) {
 	format = fmt.Sprintf("Parse error: %s", format)
 	panic(fmt.Errorf(format, args...))
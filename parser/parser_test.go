@@ -3,6 +3,7 @@ package parser
 import (
 	"bachelor-thesis/parser/ast"
 	"fmt"
+	"github.com/stretchr/testify/assert"
 	"reflect"
 	"testing"
 )
@@ -175,14 +176,234 @@ var parseTests = []parseTest{
 			NodeType: ast.NodeArray,
 		},
 	},
+	{
+		"0 < x <= 10",
+		&ast.ChainNode{
+			Operators: []string{"<", "<="},
+			Operands: []ast.Node{&ast.NumberNode{Value: fmt.Sprint(0), Int64: 0, IsInt: true, IsFloat: false, NodeType: ast.NodeNumber},
+				&ast.IdentifierNode{Value: "x", NodeType: ast.NodeIdentifier},
+				&ast.NumberNode{Value: fmt.Sprint(10), Int64: 10, IsInt: true, IsFloat: false, NodeType: ast.NodeNumber}},
+			NodeType: ast.NodeChain,
+		},
+	},
+	{
+		"a < b + 1 < c and d",
+		&ast.BinaryNode{Operator: "and",
+			Left: &ast.ChainNode{
+				Operators: []string{"<", "<"},
+				Operands: []ast.Node{&ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+					&ast.BinaryNode{Operator: "+",
+						Left:  &ast.IdentifierNode{Value: "b", NodeType: ast.NodeIdentifier},
+						Right: &ast.NumberNode{Value: fmt.Sprint(1), Int64: 1, IsInt: true, IsFloat: false, NodeType: ast.NodeNumber}},
+					&ast.IdentifierNode{Value: "c", NodeType: ast.NodeIdentifier}},
+				NodeType: ast.NodeChain,
+			},
+			Right: &ast.IdentifierNode{Value: "d", NodeType: ast.NodeIdentifier}},
+	},
+	{
+		"a < b == c",
+		&ast.BinaryNode{Operator: "==",
+			Left: &ast.BinaryNode{Operator: "<",
+				Left:  &ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+				Right: &ast.IdentifierNode{Value: "b", NodeType: ast.NodeIdentifier}},
+			Right: &ast.IdentifierNode{Value: "c", NodeType: ast.NodeIdentifier}},
+	},
+	{
+		"(a < b) == c",
+		&ast.BinaryNode{Operator: "==",
+			Left: &ast.BinaryNode{Operator: "<",
+				Left:  &ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+				Right: &ast.IdentifierNode{Value: "b", NodeType: ast.NodeIdentifier}},
+			Right: &ast.IdentifierNode{Value: "c", NodeType: ast.NodeIdentifier}},
+	},
+	{
+		"if a then b else c",
+		&ast.ConditionalNode{
+			Condition: &ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+			Then:      &ast.IdentifierNode{Value: "b", NodeType: ast.NodeIdentifier},
+			Else:      &ast.IdentifierNode{Value: "c", NodeType: ast.NodeIdentifier},
+			NodeType:  ast.NodeConditional,
+		},
+	},
+	{
+		"if a then b else if c then d",
+		&ast.ConditionalNode{
+			Condition: &ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+			Then:      &ast.IdentifierNode{Value: "b", NodeType: ast.NodeIdentifier},
+			Else: &ast.ConditionalNode{
+				Condition: &ast.IdentifierNode{Value: "c", NodeType: ast.NodeIdentifier},
+				Then:      &ast.IdentifierNode{Value: "d", NodeType: ast.NodeIdentifier},
+				NodeType:  ast.NodeConditional,
+			},
+			NodeType: ast.NodeConditional,
+		},
+	},
+	{
+		`case a when "b" then c else d end`,
+		&ast.CaseNode{
+			Subject:    &ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+			Conditions: []ast.Node{&ast.StringNode{Value: "b", NodeType: ast.NodeString}},
+			Results:    []ast.Node{&ast.IdentifierNode{Value: "c", NodeType: ast.NodeIdentifier}},
+			Else:       &ast.IdentifierNode{Value: "d", NodeType: ast.NodeIdentifier},
+			NodeType:   ast.NodeCase,
+		},
+	},
+	{
+		`case when a then b end`,
+		&ast.CaseNode{
+			Conditions: []ast.Node{&ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier}},
+			Results:    []ast.Node{&ast.IdentifierNode{Value: "b", NodeType: ast.NodeIdentifier}},
+			NodeType:   ast.NodeCase,
+		},
+	},
+	{
+		"a + 1 is int and b is nil",
+		&ast.BinaryNode{Operator: "and",
+			Left: &ast.IsNode{
+				Node: &ast.BinaryNode{Operator: "+",
+					Left:  &ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+					Right: &ast.NumberNode{Value: fmt.Sprint(1), Int64: 1, IsInt: true, IsFloat: false, NodeType: ast.NodeNumber}},
+				TypeName: "int",
+				NodeType: ast.NodeIs,
+			},
+			Right: &ast.IsNode{
+				Node:     &ast.IdentifierNode{Value: "b", NodeType: ast.NodeIdentifier},
+				TypeName: "nil",
+				NodeType: ast.NodeIs,
+			}},
+	},
+	{
+		"let a = 1; foo(); a",
+		&ast.ProgramNode{
+			Statements: []ast.Node{
+				&ast.LetNode{Name: "a",
+					Value:    &ast.NumberNode{Value: fmt.Sprint(1), Int64: 1, IsInt: true, IsFloat: false, NodeType: ast.NodeNumber},
+					NodeType: ast.NodeLet},
+				&ast.CallNode{Callee: &ast.IdentifierNode{Value: "foo", NodeType: ast.NodeIdentifier},
+					Arguments: []ast.Node{},
+					NodeType:  ast.NodeCall},
+				&ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+			},
+			NodeType: ast.NodeProgram,
+		},
+	},
+	{
+		"a;",
+		&ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+	},
+	{
+		"[x for x in xs if x]",
+		&ast.ComprehensionNode{
+			Element:    &ast.IdentifierNode{Value: "x", NodeType: ast.NodeIdentifier},
+			Variables:  []string{"x"},
+			Collection: &ast.IdentifierNode{Value: "xs", NodeType: ast.NodeIdentifier},
+			Condition:  &ast.IdentifierNode{Value: "x", NodeType: ast.NodeIdentifier},
+			NodeType:   ast.NodeComprehension,
+		},
+	},
+	{
+		"[v for k, v in m]",
+		&ast.ComprehensionNode{
+			Element:    &ast.IdentifierNode{Value: "v", NodeType: ast.NodeIdentifier},
+			Variables:  []string{"k", "v"},
+			Collection: &ast.IdentifierNode{Value: "m", NodeType: ast.NodeIdentifier},
+			NodeType:   ast.NodeComprehension,
+		},
+	},
+	{
+		"a ? b : c",
+		&ast.ConditionalNode{
+			Condition: &ast.IdentifierNode{Value: "a", NodeType: ast.NodeIdentifier},
+			Then:      &ast.IdentifierNode{Value: "b", NodeType: ast.NodeIdentifier},
+			Else:      &ast.IdentifierNode{Value: "c", NodeType: ast.NodeIdentifier},
+			NodeType:  ast.NodeConditional,
+		},
+	},
+	{
+		"fn f(x, y) = x; f(1, 2)",
+		&ast.ProgramNode{
+			Statements: []ast.Node{
+				&ast.FunctionNode{Name: "f",
+					Parameters: []string{"x", "y"},
+					Body:       &ast.IdentifierNode{Value: "x", NodeType: ast.NodeIdentifier},
+					NodeType:   ast.NodeFunction},
+				&ast.CallNode{Callee: &ast.IdentifierNode{Value: "f", NodeType: ast.NodeIdentifier},
+					Arguments: []ast.Node{
+						&ast.NumberNode{Value: fmt.Sprint(1), Int64: 1, IsInt: true, IsFloat: false, NodeType: ast.NodeNumber},
+						&ast.NumberNode{Value: fmt.Sprint(2), Int64: 2, IsInt: true, IsFloat: false, NodeType: ast.NodeNumber},
+					},
+					NodeType: ast.NodeCall},
+			},
+			NodeType: ast.NodeProgram,
+		},
+	},
 }
 
 func TestParse(t *testing.T) {
 	for _, test := range parseTests {
 		parseResult := Parse(test.input)
+		clearPositions(parseResult)
 		if !reflect.DeepEqual(parseResult, test.expected) {
 			fmt.Println(ast.Print(parseResult))
 			t.Errorf("%s:\ngot\n\t%#v\nexpected\n\t%#v", test.input, parseResult, test.expected)
 		}
 	}
 }
+
+// clearPositions resets the offsets set by the parser, parseTests only
+// describe the shape of the tree.
+func clearPositions(node ast.Node) {
+	if node == nil || reflect.ValueOf(node).IsNil() {
+		return
+	}
+	node.SetPos(0)
+	nodeType := reflect.TypeOf((*ast.Node)(nil)).Elem()
+	v := reflect.ValueOf(node).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Type() == nodeType && !field.IsNil() {
+			clearPositions(field.Interface().(ast.Node))
+		} else if field.Type() == reflect.SliceOf(nodeType) {
+			for j := 0; j < field.Len(); j++ {
+				clearPositions(field.Index(j).Interface().(ast.Node))
+			}
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	node := Parse(`let x = a + foo([b][0]); not x`).(*ast.ProgramNode)
+	let := node.Statements[0].(*ast.LetNode)
+	binary := let.Value.(*ast.BinaryNode)
+	call := binary.Right.(*ast.CallNode)
+	member := call.Arguments[0].(*ast.MemberNode)
+	unary := node.Statements[1].(*ast.UnaryNode)
+	assert.Equal(t, 0, let.Pos())
+	assert.Equal(t, 8, binary.Left.Pos())
+	assert.Equal(t, 10, binary.Pos())
+	assert.Equal(t, 12, call.Pos())
+	assert.Equal(t, 12, call.Callee.Pos())
+	assert.Equal(t, 16, member.Node.Pos())
+	assert.Equal(t, 19, member.Pos())
+	assert.Equal(t, 20, member.Property.Pos())
+	assert.Equal(t, 25, unary.Pos())
+	assert.Equal(t, 29, unary.Node.Pos())
+
+	conditional := Parse(`[1] is array == (0 < 1 < 2) ? 1 : 2`).(*ast.ConditionalNode)
+	assert.Equal(t, 28, conditional.Pos())
+	assert.Equal(t, 13, conditional.Condition.Pos())
+	assert.Equal(t, 19, conditional.Condition.(*ast.BinaryNode).Right.Pos())
+}
+
+func TestParseError(t *testing.T) {
+	for _, input := range []string{"if a b", "case a end", "case a when b then c", "a is integer", "a is 1", "a b", "1 + 2 )", "let 1 = 2", "let a 2", "a ? b", "fn f x = x", "fn (x) = x", "fn f(x) x", "[x for in xs]", "[x for x xs]", "[x for x in xs", "[x for a, b, c in xs]"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected parse error", input)
+				}
+			}()
+			Parse(input)
+		}()
+	}
+}
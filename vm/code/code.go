@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
 type Opcode byte
@@ -13,6 +14,9 @@ type Instructions []byte
 const (
 	OpConstant Opcode = iota
 	OpPop
+	OpDup
+	OpSwap
+	OpRot
 
 	OpTrue
 	OpFalse
@@ -33,6 +37,7 @@ const (
 	OpGreaterOrEqual
 	OpJumpIfTrue
 	OpJumpIfFalse
+	OpJump
 
 	OpMinus
 
@@ -43,6 +48,73 @@ const (
 
 	OpCall
 	OpLoadConst
+
+	OpBuiltin
+	OpIs
+
+	OpGetLocal
+	OpSetLocal
+
+	OpCallLocal
+	OpReturn
+
+	OpIterInit
+	OpIterNext
+	OpAppend
+	OpLoop
+
+	// Result checks emitted last by compiler.AsBool, AsInt64 and AsFloat64.
+	OpAsBool
+	OpAsInt
+	OpAsFloat
+
+	// Typed instructions, emitted with compiler.Typed when the types of the
+	// operands are known. They are executed by vm4, vm6 and vm7.
+	OpPushInt
+	OpPushFloat
+	OpPushStr
+
+	OpAddInt
+	OpSubInt
+	OpMulInt
+	OpDivInt
+	OpModInt
+	OpExpInt
+	OpMinusInt
+
+	OpAddFloat
+	OpSubFloat
+	OpMulFloat
+	OpDivFloat
+	OpExpFloat
+	OpMinusFloat
+
+	OpConcatStr
+
+	OpEqInt
+	OpNeInt
+	OpLtInt
+	OpGtInt
+	OpLeInt
+	OpGeInt
+
+	OpEqFloat
+	OpNeFloat
+	OpLtFloat
+	OpGtFloat
+	OpLeFloat
+	OpGeFloat
+
+	OpEqStr
+	OpNeStr
+	OpLtStr
+	OpGtStr
+	OpLeStr
+	OpGeStr
+
+	// OpWide prefixes an instruction whose operands are four bytes wide,
+	// see Make.
+	OpWide
 )
 
 type Definition struct {
@@ -54,6 +126,9 @@ var definitions = map[Opcode]*Definition{
 
 	OpPop:      {"OpPop", []int{}},
 	OpConstant: {"OpConstant", []int{2}},
+	OpDup:      {"OpDup", []int{}},
+	OpSwap:     {"OpSwap", []int{}},
+	OpRot:      {"OpRot", []int{}},
 
 	OpTrue:  {"OpTrue", []int{}},
 	OpFalse: {"OpFalse", []int{}},
@@ -74,6 +149,7 @@ var definitions = map[Opcode]*Definition{
 	OpGreaterOrEqual: {"OpGreaterOrEqual", []int{}},
 	OpJumpIfTrue:     {"OpJumpIfTrue", []int{2}},
 	OpJumpIfFalse:    {"OpJumpIfFalse", []int{2}},
+	OpJump:           {"OpJump", []int{2}},
 
 	OpMinus: {"OpMinus", []int{}},
 
@@ -84,28 +160,110 @@ var definitions = map[Opcode]*Definition{
 
 	OpCall:      {"OpCall", []int{2}},
 	OpLoadConst: {"OpConstant", []int{2}},
+
+	OpBuiltin: {"OpBuiltin", []int{2}},
+	OpIs:      {"OpIs", []int{2}},
+
+	OpGetLocal: {"OpGetLocal", []int{2}},
+	OpSetLocal: {"OpSetLocal", []int{2}},
+
+	OpCallLocal: {"OpCallLocal", []int{2}},
+	OpReturn:    {"OpReturn", []int{}},
+
+	OpIterInit: {"OpIterInit", []int{2}},
+	OpIterNext: {"OpIterNext", []int{2}},
+	OpAppend:   {"OpAppend", []int{}},
+	OpLoop:     {"OpLoop", []int{2}},
+
+	OpAsBool:  {"OpAsBool", []int{}},
+	OpAsInt:   {"OpAsInt", []int{}},
+	OpAsFloat: {"OpAsFloat", []int{}},
+
+	OpPushInt:   {"OpPushInt", []int{2}},
+	OpPushFloat: {"OpPushFloat", []int{2}},
+	OpPushStr:   {"OpPushStr", []int{2}},
+
+	OpAddInt:   {"OpAddInt", []int{}},
+	OpSubInt:   {"OpSubInt", []int{}},
+	OpMulInt:   {"OpMulInt", []int{}},
+	OpDivInt:   {"OpDivInt", []int{}},
+	OpModInt:   {"OpModInt", []int{}},
+	OpExpInt:   {"OpExpInt", []int{}},
+	OpMinusInt: {"OpMinusInt", []int{}},
+
+	OpAddFloat:   {"OpAddFloat", []int{}},
+	OpSubFloat:   {"OpSubFloat", []int{}},
+	OpMulFloat:   {"OpMulFloat", []int{}},
+	OpDivFloat:   {"OpDivFloat", []int{}},
+	OpExpFloat:   {"OpExpFloat", []int{}},
+	OpMinusFloat: {"OpMinusFloat", []int{}},
+
+	OpConcatStr: {"OpConcatStr", []int{}},
+
+	OpEqInt: {"OpEqInt", []int{}},
+	OpNeInt: {"OpNeInt", []int{}},
+	OpLtInt: {"OpLtInt", []int{}},
+	OpGtInt: {"OpGtInt", []int{}},
+	OpLeInt: {"OpLeInt", []int{}},
+	OpGeInt: {"OpGeInt", []int{}},
+
+	OpEqFloat: {"OpEqFloat", []int{}},
+	OpNeFloat: {"OpNeFloat", []int{}},
+	OpLtFloat: {"OpLtFloat", []int{}},
+	OpGtFloat: {"OpGtFloat", []int{}},
+	OpLeFloat: {"OpLeFloat", []int{}},
+	OpGeFloat: {"OpGeFloat", []int{}},
+
+	OpEqStr: {"OpEqStr", []int{}},
+	OpNeStr: {"OpNeStr", []int{}},
+	OpLtStr: {"OpLtStr", []int{}},
+	OpGtStr: {"OpGtStr", []int{}},
+	OpLeStr: {"OpLeStr", []int{}},
+	OpGeStr: {"OpGeStr", []int{}},
+
+	OpWide: {"OpWide", []int{}},
 }
 
+// MaxOperand is the largest value of a two byte operand, larger ones are
+// written after OpWide in four bytes, up to MaxWideOperand.
+const (
+	MaxOperand     = math.MaxUint16
+	MaxWideOperand = math.MaxUint32
+)
+
+// Make encodes an instruction. When an operand exceeds MaxOperand the
+// instruction is prefixed with OpWide and all its operands take four bytes.
 func Make(op Opcode, operands ...int) Instructions {
 	def, ok := definitions[op]
 	if !ok {
 		return []byte{}
 	}
+	scale := 1
+	for _, o := range operands {
+		if o > MaxOperand {
+			scale = 2
+		}
+	}
 	instructionLen := 1
 	for _, w := range def.OperandWidths {
-		instructionLen += w
+		instructionLen += w * scale
 	}
 	instruction := make([]byte, instructionLen)
 	instruction[0] = byte(op)
 	offset := 1
 	for i, o := range operands {
-		width := def.OperandWidths[i]
+		width := def.OperandWidths[i] * scale
 		switch width {
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		}
 		offset += width
 	}
+	if scale == 2 {
+		return append(Instructions{byte(OpWide)}, instruction...)
+	}
 	return instruction
 }
 
@@ -121,14 +279,16 @@ func Lookup(op byte) (*Definition, error) {
 func (ins Instructions) String() string {
 	var out bytes.Buffer
 	i := 0
+	wide := false
 	for i < len(ins) {
 		def, err := Lookup(ins[i])
 		if err != nil {
 			fmt.Fprintf(&out, "ERROR: %s\n", err)
 			continue
 		}
-		operands, read := ReadOperands(def, ins[i+1:])
+		operands, read := readOperands(def, ins[i+1:], wide)
 		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+		wide = Opcode(ins[i]) == OpWide
 		i += 1 + read
 	}
 	return out.String()
@@ -155,11 +315,21 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 }
 
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
+	return readOperands(def, ins, false)
+}
+
+// readOperands reads operands of twice their width after OpWide.
+func readOperands(def *Definition, ins Instructions, wide bool) ([]int, int) {
 	operands := make([]int, len(def.OperandWidths))
 	offset := 0
 
 	for i, width := range def.OperandWidths {
+		if wide {
+			width *= 2
+		}
 		switch width {
+		case 4:
+			operands[i] = int(binary.BigEndian.Uint32(ins[offset:]))
 		case 2:
 			operands[i] = int(binary.BigEndian.Uint16(ins[offset:]))
 		case 1:
@@ -1,14 +1,111 @@
 package compiler
 
 import (
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/checker"
+	"bachelor-thesis/optimizer"
 	"bachelor-thesis/parser/ast"
 	"bachelor-thesis/vm/code"
+	"fmt"
+	"math"
+	"reflect"
 )
 
 type Compiler struct {
 	instructions []code.Instructions
 	constants    []interface{}
+	constantPool map[interface{}]int
+	jumps        []jump
 	mapEnv       bool
+	locals       map[string]int
+	functions    map[string]int
+	typed        bool
+	env          interface{}
+	fields       map[string]*builtin.Field
+	mode         builtin.Mode
+	expect       code.Opcode
+	optimize     bool
+	err          error
+}
+
+// Option configures Compile.
+type Option func(compiler *Compiler)
+
+// Typed checks the tree against env (see checker.Check) and emits the typed
+// instructions wherever the operand types are known, so the machine does not
+// dispatch on them at runtime. Only vm4, vm6 and vm7 execute typed programs.
+func Typed(env interface{}) Option {
+	return func(compiler *Compiler) {
+		compiler.typed = true
+		compiler.env = env
+	}
+}
+
+// Env resolves the fields and methods of a struct environment at compile time,
+// env being a value of its type or its reflect.Type, so OpLoadConst does not
+// look them up by name. Typed does the same with its env.
+func Env(env interface{}) Option {
+	return func(compiler *Compiler) { compiler.env = env }
+}
+
+// Mode sets what a name missing from the environment at runtime evaluates to,
+// see builtin.Mode. The names a struct Env resolves cannot be missing.
+func Mode(mode builtin.Mode) Option {
+	return func(compiler *Compiler) { compiler.mode = mode }
+}
+
+// Optimize folds constant operations and removes identities before compiling,
+// see optimizer.Optimize. Identities are removed only for operands of known
+// type, so it is most effective together with Typed.
+func Optimize() Option {
+	return func(compiler *Compiler) { compiler.optimize = true }
+}
+
+// AsBool, AsInt64 and AsFloat64 require the program to produce a value of
+// that type. The type is checked at compile time when it is known and by the
+// machine at the end of Run otherwise; an int64 result satisfies AsFloat64.
+func AsBool() Option {
+	return func(compiler *Compiler) { compiler.expect = code.OpAsBool }
+}
+
+func AsInt64() Option {
+	return func(compiler *Compiler) { compiler.expect = code.OpAsInt }
+}
+
+func AsFloat64() Option {
+	return func(compiler *Compiler) { compiler.expect = code.OpAsFloat }
+}
+
+var (
+	intType    = reflect.TypeOf(int64(0))
+	floatType  = reflect.TypeOf(float64(0))
+	stringType = reflect.TypeOf("")
+	boolType   = reflect.TypeOf(true)
+)
+
+// expectedTypes are the static result types accepted by each result check.
+var expectedTypes = map[code.Opcode][]reflect.Type{
+	code.OpAsBool:  {boolType},
+	code.OpAsInt:   {intType},
+	code.OpAsFloat: {floatType, intType},
+}
+
+// typedOpcodes maps a generic instruction to its variants for operands of
+// a single known type.
+var typedOpcodes = map[code.Opcode]map[reflect.Type]code.Opcode{
+	code.OpAdd:            {intType: code.OpAddInt, floatType: code.OpAddFloat, stringType: code.OpConcatStr},
+	code.OpSub:            {intType: code.OpSubInt, floatType: code.OpSubFloat},
+	code.OpMul:            {intType: code.OpMulInt, floatType: code.OpMulFloat},
+	code.OpDiv:            {intType: code.OpDivInt, floatType: code.OpDivFloat},
+	code.OpMod:            {intType: code.OpModInt},
+	code.OpExp:            {intType: code.OpExpInt, floatType: code.OpExpFloat},
+	code.OpMinus:          {intType: code.OpMinusInt, floatType: code.OpMinusFloat},
+	code.OpEqual:          {intType: code.OpEqInt, floatType: code.OpEqFloat, stringType: code.OpEqStr},
+	code.OpNotEqual:       {intType: code.OpNeInt, floatType: code.OpNeFloat, stringType: code.OpNeStr},
+	code.OpLessThan:       {intType: code.OpLtInt, floatType: code.OpLtFloat, stringType: code.OpLtStr},
+	code.OpGreaterThan:    {intType: code.OpGtInt, floatType: code.OpGtFloat, stringType: code.OpGtStr},
+	code.OpLessOrEqual:    {intType: code.OpLeInt, floatType: code.OpLeFloat, stringType: code.OpLeStr},
+	code.OpGreaterOrEqual: {intType: code.OpGeInt, floatType: code.OpGeFloat, stringType: code.OpGeStr},
 }
 
 // TODO: remove it?
@@ -20,9 +117,37 @@ func concatInstructions(s []code.Instructions) code.Instructions {
 	return out
 }
 
-func Compile(node ast.Node) (program *Program, err error) {
-	compiler := &Compiler{}
+func Compile(node ast.Node, options ...Option) (program *Program, err error) {
+	compiler := &Compiler{
+		constantPool: make(map[interface{}]int),
+		locals:       make(map[string]int),
+		functions:    make(map[string]int),
+	}
+	for _, option := range options {
+		option(compiler)
+	}
+	compiler.fields = builtin.FieldsOf(compiler.env)
+	if compiler.typed {
+		if _, err := checker.Check(node, compiler.env); err != nil {
+			return nil, err
+		}
+	}
+	if compiler.optimize {
+		node = optimizer.Optimize(node)
+	}
+	if compiler.expect != 0 {
+		if err := compiler.checkResult(node); err != nil {
+			return nil, err
+		}
+	}
 	compiler.compile(node)
+	if compiler.expect != 0 {
+		compiler.emit(compiler.expect)
+	}
+	compiler.resolveJumps()
+	if compiler.err != nil {
+		return nil, compiler.err
+	}
 	program = &Program{
 		Instructions: concatInstructions(compiler.instructions),
 		Constants:    compiler.constants,
@@ -30,6 +155,29 @@ func Compile(node ast.Node) (program *Program, err error) {
 	return program, nil
 }
 
+// checkResult rejects a program whose result type is known and does not match
+// the expected one. Without Typed the environment is unknown, so the tree is
+// checked with untyped variables and a failed check leaves it to runtime.
+func (compiler *Compiler) checkResult(node ast.Node) error {
+	t := node.ValueType()
+	if !compiler.typed {
+		var err error
+		t, err = checker.Infer(node, reflect.TypeOf(map[string]interface{}{}))
+		if err != nil {
+			return nil
+		}
+	}
+	if t.Kind() == reflect.Interface {
+		return nil
+	}
+	for _, expected := range expectedTypes[compiler.expect] {
+		if t == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected %s result, got %s", expectedTypes[compiler.expect][0], t)
+}
+
 func (compiler *Compiler) compile(node ast.Node) {
 	switch node.Type() {
 	case ast.NodeNumber:
@@ -52,23 +200,89 @@ func (compiler *Compiler) compile(node ast.Node) {
 		compiler.NodeArray(node.(*ast.ArrayNode))
 	case ast.NodeMember:
 		compiler.NodeMember(node.(*ast.MemberNode))
+	case ast.NodeChain:
+		compiler.NodeChain(node.(*ast.ChainNode))
+	case ast.NodeConditional:
+		compiler.NodeConditional(node.(*ast.ConditionalNode))
+	case ast.NodeCase:
+		compiler.NodeCase(node.(*ast.CaseNode))
+	case ast.NodeIs:
+		compiler.NodeIs(node.(*ast.IsNode))
+	case ast.NodeProgram:
+		compiler.NodeProgram(node.(*ast.ProgramNode))
+	case ast.NodeLet:
+		compiler.NodeLet(node.(*ast.LetNode))
+	case ast.NodeFunction:
+		compiler.NodeFunction(node.(*ast.FunctionNode))
+		compiler.emit(code.OpNil)
+	case ast.NodeComprehension:
+		compiler.NodeComprehension(node.(*ast.ComprehensionNode))
 	}
 }
 
 func (compiler *Compiler) NodeNumber(node *ast.NumberNode) {
 	if node.IsInt == true {
-		compiler.emit(code.OpConstant, compiler.addConstant(node.Int64))
+		compiler.emit(compiler.push(code.OpPushInt), compiler.addConstant(node.Int64))
 	} else if node.IsFloat == true {
-		compiler.emit(code.OpConstant, compiler.addConstant(node.Float64))
+		compiler.emit(compiler.push(code.OpPushFloat), compiler.addConstant(node.Float64))
 	}
 }
 
 func (compiler *Compiler) NodeIdentifier(node *ast.IdentifierNode) {
+	if slot, ok := compiler.locals[node.Value]; ok {
+		compiler.emit(code.OpGetLocal, slot)
+		return
+	}
+	compiler.load(node, false)
+}
+
+// load emits OpLoadConst reading an identifier, or a callee, from the
+// environment.
+func (compiler *Compiler) load(node *ast.IdentifierNode, function bool) {
+	if field, ok := compiler.fields[node.Value]; ok {
+		compiler.emit(code.OpLoadConst, compiler.addConstant(field))
+		return
+	}
+	if compiler.mode != builtin.Zero {
+		compiler.emit(code.OpLoadConst, compiler.addConstant(builtin.Identifier{
+			Name:     node.Value,
+			Pos:      node.Pos(),
+			Mode:     compiler.mode,
+			Function: function,
+		}))
+		return
+	}
 	compiler.emit(code.OpLoadConst, compiler.addConstant(node.Value))
 }
 
 func (compiler *Compiler) NodeString(node *ast.StringNode) {
-	compiler.emit(code.OpConstant, compiler.addConstant(node.Value))
+	compiler.emit(compiler.push(code.OpPushStr), compiler.addConstant(node.Value))
+}
+
+// push returns the typed push instruction for a literal, or OpConstant.
+func (compiler *Compiler) push(op code.Opcode) code.Opcode {
+	if compiler.typed {
+		return op
+	}
+	return code.OpConstant
+}
+
+// selectOpcode returns the typed variant of op when all operands have the
+// same type known to the checker.
+func (compiler *Compiler) selectOpcode(op code.Opcode, operands ...ast.Node) code.Opcode {
+	if !compiler.typed {
+		return op
+	}
+	t := operands[0].ValueType()
+	for _, operand := range operands[1:] {
+		if operand.ValueType() != t {
+			return op
+		}
+	}
+	if typed, ok := typedOpcodes[op][t]; ok {
+		return typed
+	}
+	return op
 }
 
 func (compiler *Compiler) NodeBool(node *ast.BoolNode) {
@@ -90,7 +304,7 @@ func (compiler *Compiler) NodeUnary(node *ast.UnaryNode) {
 		// Do nothing
 
 	case "-":
-		compiler.emit(code.OpMinus)
+		compiler.emit(compiler.selectOpcode(code.OpMinus, node.Node))
 	case "not":
 		compiler.emit(code.OpNot)
 	}
@@ -101,63 +315,63 @@ func (compiler *Compiler) NodeBinary(node *ast.BinaryNode) {
 	case "+":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpAdd)
+		compiler.emit(compiler.selectOpcode(code.OpAdd, node.Left, node.Right))
 
 	case "-":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpSub)
+		compiler.emit(compiler.selectOpcode(code.OpSub, node.Left, node.Right))
 
 	case "*":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpMul)
+		compiler.emit(compiler.selectOpcode(code.OpMul, node.Left, node.Right))
 
 	case "/":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpDiv)
+		compiler.emit(compiler.selectOpcode(code.OpDiv, node.Left, node.Right))
 
 	case "%":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpMod)
+		compiler.emit(compiler.selectOpcode(code.OpMod, node.Left, node.Right))
 
 	case "^":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpExp)
+		compiler.emit(compiler.selectOpcode(code.OpExp, node.Left, node.Right))
 
 	case "==":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
 		// TODO: check expr
-		compiler.emit(code.OpEqual)
+		compiler.emit(compiler.selectOpcode(code.OpEqual, node.Left, node.Right))
 
 	case "!=":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpNotEqual)
+		compiler.emit(compiler.selectOpcode(code.OpNotEqual, node.Left, node.Right))
 
 	case ">":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpGreaterThan)
+		compiler.emit(compiler.selectOpcode(code.OpGreaterThan, node.Left, node.Right))
 
 	case "<":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpLessThan)
+		compiler.emit(compiler.selectOpcode(code.OpLessThan, node.Left, node.Right))
 
 	case ">=":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpGreaterOrEqual)
+		compiler.emit(compiler.selectOpcode(code.OpGreaterOrEqual, node.Left, node.Right))
 
 	case "<=":
 		compiler.compile(node.Left)
 		compiler.compile(node.Right)
-		compiler.emit(code.OpLessOrEqual)
+		compiler.emit(compiler.selectOpcode(code.OpLessOrEqual, node.Left, node.Right))
 
 	case "or":
 		compiler.compile(node.Left)
@@ -175,12 +389,217 @@ func (compiler *Compiler) NodeBinary(node *ast.BinaryNode) {
 	}
 }
 
+// NodeChain compiles `a < b < c` as `a < b and b < c`, keeping a copy of b
+// on the stack instead of evaluating it twice.
+func (compiler *Compiler) NodeChain(node *ast.ChainNode) {
+	compiler.compile(node.Operands[0])
+	cleanups := make([]int, 0)
+	last := len(node.Operators) - 1
+	for i, operator := range node.Operators {
+		compiler.compile(node.Operands[i+1])
+		op := compiler.selectOpcode(comparisonOpcode(operator), node.Operands[i], node.Operands[i+1])
+		if i == last {
+			compiler.emit(op)
+			break
+		}
+		compiler.emit(code.OpDup)
+		compiler.emit(code.OpRot)
+		compiler.emit(op)
+		cleanups = append(cleanups, compiler.emit(code.OpJumpIfFalse, 12345))
+		compiler.emit(code.OpPop)
+	}
+	end := compiler.emit(code.OpJump, 12345)
+	for _, cleanup := range cleanups {
+		compiler.patchJump(cleanup)
+	}
+	// drop the shared operand left under the false result
+	compiler.emit(code.OpSwap)
+	compiler.emit(code.OpPop)
+	compiler.patchJump(end)
+}
+
+func (compiler *Compiler) NodeConditional(node *ast.ConditionalNode) {
+	compiler.compile(node.Condition)
+	otherwise := compiler.emit(code.OpJumpIfFalse, 12345)
+	compiler.emit(code.OpPop)
+	compiler.compile(node.Then)
+	end := compiler.emit(code.OpJump, 12345)
+	compiler.patchJump(otherwise)
+	compiler.emit(code.OpPop)
+	compiler.compileOrNil(node.Else)
+	compiler.patchJump(end)
+}
+
+// NodeCase compiles every `when` into a test and a jump to the next one, the
+// subject (if any) stays on the stack until a branch is chosen.
+func (compiler *Compiler) NodeCase(node *ast.CaseNode) {
+	if node.Subject != nil {
+		compiler.compile(node.Subject)
+	}
+	ends := make([]int, 0, len(node.Conditions))
+	for i, condition := range node.Conditions {
+		if node.Subject != nil {
+			compiler.emit(code.OpDup)
+			compiler.compile(condition)
+			compiler.emit(code.OpEqual)
+		} else {
+			compiler.compile(condition)
+		}
+		next := compiler.emit(code.OpJumpIfFalse, 12345)
+		compiler.emit(code.OpPop)
+		if node.Subject != nil {
+			compiler.emit(code.OpPop)
+		}
+		compiler.compile(node.Results[i])
+		ends = append(ends, compiler.emit(code.OpJump, 12345))
+		compiler.patchJump(next)
+		compiler.emit(code.OpPop)
+	}
+	if node.Subject != nil {
+		compiler.emit(code.OpPop)
+	}
+	compiler.compileOrNil(node.Else)
+	for _, end := range ends {
+		compiler.patchJump(end)
+	}
+}
+
+func (compiler *Compiler) compileOrNil(node ast.Node) {
+	if node == nil {
+		compiler.emit(code.OpNil)
+		return
+	}
+	compiler.compile(node)
+}
+
+func comparisonOpcode(operator string) code.Opcode {
+	switch operator {
+	case "==":
+		return code.OpEqual
+	case "!=":
+		return code.OpNotEqual
+	case ">":
+		return code.OpGreaterThan
+	case "<":
+		return code.OpLessThan
+	case ">=":
+		return code.OpGreaterOrEqual
+	default:
+		return code.OpLessOrEqual
+	}
+}
+
+// NodeProgram separates statements with OpPop. Function definitions produce
+// no value, so they neither push nor need a pop.
+func (compiler *Compiler) NodeProgram(node *ast.ProgramNode) {
+	pushed := false
+	for _, statement := range node.Statements {
+		if function, ok := statement.(*ast.FunctionNode); ok {
+			compiler.NodeFunction(function)
+			continue
+		}
+		if pushed {
+			compiler.emit(code.OpPop)
+		}
+		compiler.compile(statement)
+		pushed = true
+	}
+	if !pushed {
+		compiler.emit(code.OpNil)
+	}
+}
+
+// NodeFunction compiles the body with its own instructions and parameter
+// slots into a Function constant. The name is registered first so the body
+// can call itself.
+func (compiler *Compiler) NodeFunction(node *ast.FunctionNode) {
+	function := &Function{Name: node.Name, NumParameters: len(node.Parameters)}
+	compiler.functions[node.Name] = compiler.addConstant(function)
+	body := &Compiler{
+		constants:    compiler.constants,
+		constantPool: compiler.constantPool,
+		locals:       make(map[string]int),
+		functions:    compiler.functions,
+		typed:        compiler.typed,
+		env:          compiler.env,
+		fields:       compiler.fields,
+		mode:         compiler.mode,
+	}
+	for i, parameter := range node.Parameters {
+		body.locals[parameter] = i
+	}
+	body.compile(node.Body)
+	body.emit(code.OpReturn)
+	body.resolveJumps()
+	compiler.constants = body.constants
+	if body.err != nil {
+		compiler.err = body.err
+	}
+	function.Instructions = concatInstructions(body.instructions)
+	function.NumLocals = len(body.locals)
+}
+
+// NodeLet stores the value in a local slot and leaves it on the stack as the
+// value of the statement. The name is bound after the value is compiled, so
+// `let x = x + 1` reads x from the environment.
+func (compiler *Compiler) NodeLet(node *ast.LetNode) {
+	compiler.compile(node.Value)
+	slot, ok := compiler.locals[node.Name]
+	if !ok {
+		slot = compiler.newSlot()
+		compiler.locals[node.Name] = slot
+	}
+	compiler.emit(code.OpSetLocal, slot)
+}
+
+// newSlot returns a local slot not used by any visible name.
+func (compiler *Compiler) newSlot() int {
+	slot := 0
+	for _, used := range compiler.locals {
+		if used >= slot {
+			slot = used + 1
+		}
+	}
+	return slot
+}
+
+func (compiler *Compiler) NodeIs(node *ast.IsNode) {
+	compiler.compile(node.Node)
+	compiler.emit(code.OpIs, compiler.addConstant(node.TypeName))
+}
+
 func (compiler *Compiler) NodeCall(node *ast.CallNode) {
-	// TODO: implement
+	name := node.Callee.(*ast.IdentifierNode).Value
+	if index, ok := compiler.functions[name]; ok {
+		function := compiler.constants[index].(*Function)
+		if len(node.Arguments) != function.NumParameters {
+			compiler.err = fmt.Errorf("%s() expects %d arguments, got %d", name, function.NumParameters, len(node.Arguments))
+			return
+		}
+		for _, arg := range node.Arguments {
+			compiler.compile(arg)
+		}
+		compiler.emit(code.OpConstant, index)
+		compiler.emit(code.OpCallLocal, len(node.Arguments))
+		return
+	}
+	if index, ok := builtin.Lookup(name); ok {
+		if len(node.Arguments) != 1 {
+			compiler.err = fmt.Errorf("%s() expects 1 argument, got %d", name, len(node.Arguments))
+			return
+		}
+		compiler.compile(node.Arguments[0])
+		compiler.emit(code.OpBuiltin, index)
+		return
+	}
 	for _, arg := range node.Arguments {
 		compiler.compile(arg)
 	}
-	compiler.compile(node.Callee)
+	if slot, ok := compiler.locals[name]; ok {
+		compiler.emit(code.OpGetLocal, slot)
+	} else {
+		compiler.load(node.Callee.(*ast.IdentifierNode), true)
+	}
 	compiler.emit(code.OpCall, len(node.Arguments))
 }
 
@@ -191,6 +610,54 @@ func (compiler *Compiler) NodeArray(node *ast.ArrayNode) {
 	compiler.emit(code.OpArray, len(node.Nodes))
 }
 
+// NodeComprehension builds the result array under the iterator: OpIterNext
+// pushes the loop variables or jumps past the loop once the collection is
+// exhausted, OpAppend adds an element to the array and OpLoop jumps back.
+func (compiler *Compiler) NodeComprehension(node *ast.ComprehensionNode) {
+	compiler.emit(code.OpArray, 0)
+	compiler.compile(node.Collection)
+	compiler.emit(code.OpIterInit, len(node.Variables))
+
+	outer := make(map[string]int, len(compiler.locals))
+	for name, slot := range compiler.locals {
+		outer[name] = slot
+	}
+	slots := make([]int, len(node.Variables))
+	for i, name := range node.Variables {
+		slots[i] = compiler.newSlot()
+		compiler.locals[name] = slots[i]
+	}
+
+	loop := len(compiler.instructions)
+	end := compiler.emit(code.OpIterNext, 12345)
+	for i := len(slots) - 1; i >= 0; i-- {
+		compiler.emit(code.OpSetLocal, slots[i])
+		compiler.emit(code.OpPop)
+	}
+	skip := 0
+	if node.Condition != nil {
+		compiler.compile(node.Condition)
+		skip = compiler.emit(code.OpJumpIfFalse, 12345)
+		compiler.emit(code.OpPop)
+	}
+	compiler.compile(node.Element)
+	compiler.emit(code.OpAppend)
+	compiler.loop(loop)
+	if node.Condition != nil {
+		compiler.patchJump(skip)
+		compiler.emit(code.OpPop)
+		compiler.loop(loop)
+	}
+	compiler.patchJump(end)
+	compiler.locals = outer
+}
+
+// loop emits a backward jump to the instruction with the given index.
+func (compiler *Compiler) loop(start int) {
+	at := compiler.emit(code.OpLoop, 0) - 1
+	compiler.jumps = append(compiler.jumps, jump{at: at, target: start})
+}
+
 func (compiler *Compiler) NodeMember(node *ast.MemberNode) {
 	compiler.compile(node.Node)
 	compiler.compile(node.Property)
@@ -204,21 +671,105 @@ func (compiler *Compiler) addInstruction(ins code.Instructions) int {
 }
 
 func (compiler *Compiler) emit(op code.Opcode, operands ...int) int {
+	for _, operand := range operands {
+		if int64(operand) > code.MaxWideOperand && compiler.err == nil {
+			def, _ := code.Lookup(byte(op))
+			compiler.err = fmt.Errorf("operand %d of %s exceeds %d", operand, def.Name, int64(code.MaxWideOperand))
+		}
+	}
 	ins := code.Make(op, operands...)
 	pos := compiler.addInstruction(ins)
 	return pos
 }
 
+// MaxConstants is the size of the constant pool addressable by the operands
+// of wide instructions. It is an int64 as it does not fit in a 32-bit int.
+const MaxConstants int64 = code.MaxWideOperand + 1
+
+// maxConstants is MaxConstants, lowered by the tests.
+var maxConstants = MaxConstants
+
+// addConstant returns the index of constant in the pool, adding it when it is
+// not there yet. Literals and identifier names are looked up by type and
+// value, so int64(1) and float64(1) are separate entries while every use of
+// a name shares one. Floats are compared bit by bit, keeping 0.0 apart from
+// -0.0. Functions are always added.
 func (compiler *Compiler) addConstant(constant interface{}) int {
+	_, isFunction := constant.(*Function)
+	if !isFunction {
+		if index, ok := compiler.constantPool[poolKey(constant)]; ok {
+			return index
+		}
+	}
+	if int64(len(compiler.constants)) == maxConstants {
+		if compiler.err == nil {
+			compiler.err = fmt.Errorf("too many constants: the pool is limited to %d entries", maxConstants)
+		}
+		return 0
+	}
 	compiler.constants = append(compiler.constants, constant)
+	if !isFunction {
+		compiler.constantPool[poolKey(constant)] = len(compiler.constants) - 1
+	}
 	return len(compiler.constants) - 1
 }
 
+// floatBits keys a float constant by its bits, as == considers 0.0 and -0.0
+// equal.
+type floatBits uint64
+
+func poolKey(constant interface{}) interface{} {
+	if f, ok := constant.(float64); ok {
+		return floatBits(math.Float64bits(f))
+	}
+	return constant
+}
+
+// jump is a jump instruction and the index of the instruction it lands on,
+// its offset is written by resolveJumps.
+type jump struct {
+	at     int
+	target int
+}
+
+// patchJump makes the jump emitted at placeholder land after the last
+// emitted instruction.
 func (compiler *Compiler) patchJump(placeholder int) {
-	offset := len(compiler.instructions) - placeholder
-	tmp := 0
-	for i := 0; i < offset; i++ {
-		tmp += len(compiler.instructions[i+placeholder])
+	compiler.jumps = append(compiler.jumps, jump{at: placeholder - 1, target: len(compiler.instructions)})
+}
+
+// resolveJumps writes the offsets of all jumps once the instructions are
+// emitted. A jump over more than code.MaxOperand bytes becomes wide, which
+// moves the instructions after it, so the offsets are recomputed until no
+// jump changes its size.
+func (compiler *Compiler) resolveJumps() {
+	for resized := true; resized; {
+		resized = false
+		for _, jump := range compiler.jumps {
+			ins := compiler.instructions[jump.at]
+			op := code.Opcode(ins[0])
+			if op == code.OpWide {
+				op = code.Opcode(ins[1])
+			}
+			offset := 0
+			if jump.target > jump.at {
+				for _, skipped := range compiler.instructions[jump.at+1 : jump.target] {
+					offset += len(skipped)
+				}
+			} else {
+				for _, repeated := range compiler.instructions[jump.target : jump.at+1] {
+					offset += len(repeated)
+				}
+			}
+			if int64(offset) > code.MaxWideOperand {
+				compiler.err = fmt.Errorf("jump of %d bytes exceeds %d", offset, int64(code.MaxWideOperand))
+				return
+			}
+			patched := code.Make(op, offset)
+			if len(patched) != len(ins) {
+				resized = true
+			}
+			compiler.instructions[jump.at] = patched
+		}
 	}
-	compiler.instructions[placeholder-1], _ = code.UpdateOperands(compiler.instructions[placeholder-1], []int{tmp})
 }
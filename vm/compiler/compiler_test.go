@@ -1,10 +1,14 @@
 package compiler
 
 import (
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/parser"
 	"bachelor-thesis/vm/code"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"math"
+	"strings"
 	"testing"
 )
 
@@ -110,7 +114,7 @@ var compilerTests = []compilerTest{
 		`1 - 2 + 3 * 4 / 2 ^ 2 % 3`,
 		Program{
 			Constants: []interface{}{
-				int64(1), int64(2), int64(3), int64(4), int64(2), int64(2), int64(3),
+				int64(1), int64(2), int64(3), int64(4),
 			},
 			Instructions: concatInstructions([]code.Instructions{
 				code.Make(code.OpConstant, 0),
@@ -119,11 +123,11 @@ var compilerTests = []compilerTest{
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpConstant, 3),
 				code.Make(code.OpMul),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 1),
 				code.Make(code.OpDiv),
-				code.Make(code.OpConstant, 5),
+				code.Make(code.OpConstant, 1),
 				code.Make(code.OpExp),
-				code.Make(code.OpConstant, 6),
+				code.Make(code.OpConstant, 2),
 				code.Make(code.OpMod),
 				code.Make(code.OpAdd)}),
 		},
@@ -201,14 +205,14 @@ var compilerTests = []compilerTest{
 	{
 		"[1, 2, 3][1 + 1]",
 		Program{
-			Constants: []interface{}{int64(1), int64(2), int64(3), int64(1), int64(1)},
+			Constants: []interface{}{int64(1), int64(2), int64(3)},
 			Instructions: concatInstructions([]code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpAdd),
 				code.Make(code.OpIndex)}),
 		},
@@ -260,15 +264,353 @@ var compilerTests = []compilerTest{
 			}),
 		},
 	},
+	{
+		`1 < 2 <= 3`,
+		Program{
+			Constants: []interface{}{int64(1), int64(2), int64(3)},
+			Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDup),
+				code.Make(code.OpRot),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpJumpIfFalse, 8),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpLessOrEqual),
+				code.Make(code.OpJump, 2),
+				code.Make(code.OpSwap),
+				code.Make(code.OpPop),
+			}),
+		},
+	},
+	{
+		`if true then 1 else 2`,
+		Program{
+			Constants: []interface{}{int64(1), int64(2)},
+			Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpIfFalse, 7),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpJump, 4),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+			}),
+		},
+	},
+	{
+		`int("42") is int`,
+		Program{
+			Constants: []interface{}{"42", "int"},
+			Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpBuiltin, 0),
+				code.Make(code.OpIs, 1),
+			}),
+		},
+	},
+	{
+		`let a = 1; a + b`,
+		Program{
+			Constants: []interface{}{int64(1), "b"},
+			Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetLocal, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpLoadConst, 1),
+				code.Make(code.OpAdd),
+			}),
+		},
+	},
+}
+
+var comprehensionTest = compilerTest{
+	`[x for x in xs if x]`,
+	Program{
+		Constants: []interface{}{"xs"},
+		Instructions: concatInstructions([]code.Instructions{
+			code.Make(code.OpArray, 0),
+			code.Make(code.OpLoadConst, 0),
+			code.Make(code.OpIterInit, 1),
+			code.Make(code.OpIterNext, 22),
+			code.Make(code.OpSetLocal, 0),
+			code.Make(code.OpPop),
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpJumpIfFalse, 8),
+			code.Make(code.OpPop),
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpAppend),
+			code.Make(code.OpLoop, 21),
+			code.Make(code.OpPop),
+			code.Make(code.OpLoop, 25),
+		}),
+	},
+}
+
+var functionTest = compilerTest{
+	`fn inc(x) = x + 1; inc(2)`,
+	Program{
+		Constants: []interface{}{
+			&Function{
+				Name: "inc",
+				Instructions: concatInstructions([]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturn),
+				}),
+				NumParameters: 1,
+				NumLocals:     1,
+			},
+			int64(1),
+			int64(2),
+		},
+		Instructions: concatInstructions([]code.Instructions{
+			code.Make(code.OpConstant, 2),
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpCallLocal, 1),
+		}),
+	},
 }
 
 func TestCompiler(t *testing.T) {
-	for _, test := range compilerTests {
+	for _, test := range append(compilerTests, functionTest, comprehensionTest) {
 		tree := parser.Parse(test.input)
 		program, err := Compile(tree)
 		// print(program.Instructions.String())
 		require.NoError(t, err, test.input)
-		assert.Equal(t, test.program.Instructions, program.Instructions)
-		assert.Equal(t, test.program.Constants, program.Constants)
+		assert.Equal(t, test.program.Instructions, program.Instructions, test.input)
+		assert.Equal(t, test.program.Constants, program.Constants, test.input)
+	}
+}
+
+var typedCompilerTests = []compilerTest{
+	{
+		`1 + 2 * 3`,
+		Program{
+			Constants: []interface{}{int64(1), int64(2), int64(3)},
+			Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpPushInt, 0),
+				code.Make(code.OpPushInt, 1),
+				code.Make(code.OpPushInt, 2),
+				code.Make(code.OpMulInt),
+				code.Make(code.OpAddInt),
+			}),
+		},
+	},
+	{
+		`"a" + s < "b"`,
+		Program{
+			Constants: []interface{}{"a", "s", "b"},
+			Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpPushStr, 0),
+				code.Make(code.OpLoadConst, 1),
+				code.Make(code.OpConcatStr),
+				code.Make(code.OpPushStr, 2),
+				code.Make(code.OpLtStr),
+			}),
+		},
+	},
+	{
+		`-x < 1.5`,
+		Program{
+			Constants: []interface{}{"x", 1.5},
+			Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpLoadConst, 0),
+				code.Make(code.OpMinusFloat),
+				code.Make(code.OpPushFloat, 1),
+				code.Make(code.OpLtFloat),
+			}),
+		},
+	},
+	{
+		// mixed and unknown operand types keep the generic instructions
+		`1 + 1.5 + y`,
+		Program{
+			Constants: []interface{}{int64(1), 1.5, "y"},
+			Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpPushInt, 0),
+				code.Make(code.OpPushFloat, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpLoadConst, 2),
+				code.Make(code.OpAdd),
+			}),
+		},
+	},
+}
+
+func TestTypedCompiler(t *testing.T) {
+	env := map[string]interface{}{"s": "", "x": 0.0, "y": nil}
+	for _, test := range typedCompilerTests {
+		program, err := Compile(parser.Parse(test.input), Typed(env))
+		require.NoError(t, err, test.input)
+		assert.Equal(t, test.program.Instructions, program.Instructions, test.input)
+		assert.Equal(t, test.program.Constants, program.Constants, test.input)
 	}
+	_, err := Compile(parser.Parse(`s + 1`), Typed(env))
+	assert.EqualError(t, err, "invalid operation: string + int64 at position 2")
+}
+
+type user struct {
+	Name string `expr:"name"`
+}
+
+func (u user) Greet() string {
+	return "hi " + u.Name
+}
+
+// TestEnv checks that the names of a struct environment are resolved at
+// compile time, unlike `let` bindings and the names of other environments.
+func TestEnv(t *testing.T) {
+	fields := builtin.FieldsOf(user{})
+	program, err := Compile(parser.Parse(`let a = name; Greet() + a + other`), Env(user{}))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{fields["name"], fields["Greet"], "other"}, program.Constants)
+	// function bodies resolve the names too
+	program, err = Compile(parser.Parse(`fn f(x) = name + x; f("!")`), Env(user{}))
+	require.NoError(t, err)
+	assert.Contains(t, program.Constants, fields["name"])
+	assert.NotContains(t, program.Constants, "name")
+	program, err = Compile(parser.Parse(`name`), Env(map[string]interface{}{}))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"name"}, program.Constants)
+}
+
+func TestMode(t *testing.T) {
+	program, err := Compile(parser.Parse(`let a = 1; a + x + f(a, x)`), Mode(builtin.Strict))
+	require.NoError(t, err)
+	x := builtin.Identifier{Name: "x", Pos: 15, Mode: builtin.Strict}
+	f := builtin.Identifier{Name: "f", Pos: 19, Mode: builtin.Strict, Function: true}
+	assert.Contains(t, program.Constants, x)
+	assert.Contains(t, program.Constants, f)
+	assert.Contains(t, program.Constants, builtin.Identifier{Name: "x", Pos: 24, Mode: builtin.Strict})
+	program, err = Compile(parser.Parse(`name + x`), Env(user{}), Mode(builtin.Lenient))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{builtin.FieldsOf(user{})["name"], builtin.Identifier{Name: "x", Pos: 7, Mode: builtin.Lenient}}, program.Constants)
+}
+
+func TestCompilerError(t *testing.T) {
+	_, err := Compile(parser.Parse(`int(1, 2)`))
+	assert.EqualError(t, err, "int() expects 1 argument, got 2")
+	_, err = Compile(parser.Parse(`fn f(x, y) = x; f(1)`))
+	assert.EqualError(t, err, "f() expects 2 arguments, got 1")
+}
+
+func TestResultType(t *testing.T) {
+	program, err := Compile(parser.Parse(`1 + 2`), AsFloat64())
+	require.NoError(t, err)
+	assert.Equal(t, concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpAdd),
+		code.Make(code.OpAsFloat),
+	}), program.Instructions)
+
+	// checking the result leaves the caller's tree unannotated
+	tree := parser.Parse(`1 + 2`)
+	_, err = Compile(tree, AsInt64())
+	require.NoError(t, err)
+	assert.Nil(t, tree.ValueType())
+
+	// The result type of x is only known at runtime.
+	_, err = Compile(parser.Parse(`x`), AsBool())
+	assert.NoError(t, err)
+	_, err = Compile(parser.Parse(`"a" + 1`), AsBool())
+	assert.NoError(t, err)
+
+	_, err = Compile(parser.Parse(`1 < 2`), AsInt64())
+	assert.EqualError(t, err, "expected int64 result, got bool")
+	_, err = Compile(parser.Parse(`let x = 1.5; x * 2`), AsInt64())
+	assert.EqualError(t, err, "expected int64 result, got float64")
+	_, err = Compile(parser.Parse(`s + "!"`), Typed(map[string]interface{}{"s": ""}), AsFloat64())
+	assert.EqualError(t, err, "expected float64 result, got string")
+}
+
+func TestOptimize(t *testing.T) {
+	program, err := Compile(parser.Parse(`1 + 2 * 3 < 10`), Optimize())
+	require.NoError(t, err)
+	assert.Equal(t, code.Make(code.OpTrue), program.Instructions)
+
+	program, err = Compile(parser.Parse(`x * 1 + (2 - 2)`), Typed(map[string]interface{}{"x": int64(0)}), Optimize())
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"x"}, program.Constants)
+	assert.Equal(t, code.Make(code.OpLoadConst, 0), program.Instructions)
+
+	program, err = Compile(parser.Parse(`1 / 0`), Optimize())
+	require.NoError(t, err)
+	assert.Equal(t, concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpDiv),
+	}), program.Instructions)
+}
+
+func TestConstantPool(t *testing.T) {
+	program, err := Compile(parser.Parse(`x == "x" or x == 1 or x == 1.0 or x == 1`))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"x", int64(1), 1.0}, program.Constants)
+
+	// Function bodies share the pool of the program.
+	program, err = Compile(parser.Parse(`fn f(a) = a + x + 2; f(2) + x`))
+	require.NoError(t, err)
+	assert.Len(t, program.Constants, 3)
+	assert.Equal(t, []interface{}{"x", int64(2)}, program.Constants[1:])
+
+	// 0.0 == -0.0, but 1.0 / -0.0 needs the sign of the folded -0.0.
+	program, err = Compile(parser.Parse(`[0.0, -0.0, 1.0 / -0.0]`), Optimize())
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{0.0, 0.0, 1.0}, program.Constants)
+	assert.False(t, math.Signbit(program.Constants[0].(float64)))
+	assert.True(t, math.Signbit(program.Constants[1].(float64)))
+}
+
+// TestConstantPoolOverflow lowers the limit, a pool of MaxConstants entries
+// does not fit in memory.
+func TestConstantPoolOverflow(t *testing.T) {
+	defer func(max int64) { maxConstants = max }(maxConstants)
+	maxConstants = 1000
+	_, err := Compile(parser.Parse(sumOf(1000)))
+	require.NoError(t, err)
+	_, err = Compile(parser.Parse(sumOf(1001)))
+	assert.EqualError(t, err, "too many constants: the pool is limited to 1000 entries")
+	assert.Equal(t, int64(code.MaxWideOperand)+1, MaxConstants)
+}
+
+// sumOf returns "0+1+...+(n-1)", each term is a new constant.
+func sumOf(n int) string {
+	terms := make([]string, n)
+	for i := range terms {
+		terms[i] = fmt.Sprint(i)
+	}
+	return strings.Join(terms, "+")
+}
+
+func TestWideOperands(t *testing.T) {
+	program, err := Compile(parser.Parse(sumOf(100000)))
+	require.NoError(t, err)
+	require.Len(t, program.Constants, 100000)
+	last := concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 99999),
+		code.Make(code.OpAdd),
+	})
+	assert.Equal(t, code.Instructions{byte(code.OpWide), byte(code.OpConstant), 0, 1, 0x86, 0x9f}, last[:6])
+	assert.Equal(t, last, program.Instructions[len(program.Instructions)-len(last):])
+
+	// The jump over the sum needs a wide offset, the jump over the else branch not.
+	program, err = Compile(parser.Parse("x ? " + sumOf(30000) + " : 1"))
+	require.NoError(t, err)
+	ins := program.Instructions
+	jumpIfFalse := ins[3:9]
+	jump := ins[len(ins)-7 : len(ins)-4]
+	assert.Equal(t, code.Make(code.OpJumpIfFalse, len(ins)-9-4), jumpIfFalse)
+	assert.Equal(t, code.Make(code.OpJump, 4), jump)
+	assert.Equal(t, byte(code.OpWide), jumpIfFalse[0])
+}
+
+func TestWideLoop(t *testing.T) {
+	program, err := Compile(parser.Parse("[x + " + sumOf(30000) + " for x in xs]"))
+	require.NoError(t, err)
+	assert.Contains(t, program.Instructions.String(), "OpWide\n")
 }
@@ -4,8 +4,20 @@ import (
 	"bachelor-thesis/vm/code"
 )
 
-// Program TODO: move to vm
+// Program is the output of Compile. Neither the compiler nor the machines
+// modify a Program once Compile returns, so a single Program can be shared by
+// machines running in different goroutines; a machine itself can not.
+// TODO: move to vm
 type Program struct {
 	Instructions code.Instructions
 	Constants    []interface{}
 }
+
+// Function is a compiled `fn` definition, stored in Program.Constants and
+// invoked with code.OpCallLocal.
+type Function struct {
+	Name          string
+	Instructions  code.Instructions
+	NumParameters int
+	NumLocals     int
+}
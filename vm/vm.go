@@ -1,17 +1,42 @@
 package vm
 
 import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/vm/code"
+	"bachelor-thesis/vm/compiler"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"reflect"
 )
 
+// MaxCallDepth limits nested calls of user-defined functions, so a recursive
+// definition fails with an error instead of growing without bound.
+const MaxCallDepth = 1024
+
 type VM struct {
+	Limits       budget.Limits // bounds every Run, unlimited by default
 	constants    []interface{}
 	instructions code.Instructions
 	stack        []interface{}
+	locals       []interface{}
+	frames       []frame
+	sp           int
+	wide         bool // the next operand follows OpWide
+}
+
+// frame saves the caller's state while a user-defined function runs.
+type frame struct {
+	instructions code.Instructions
 	sp           int
+	locals       []interface{}
+}
+
+// iterator holds the loop variables of every iteration of a comprehension.
+type iterator struct {
+	entries [][]interface{}
+	pos     int
 }
 
 func New(instructions code.Instructions, constants []interface{}) *VM {
@@ -28,20 +53,56 @@ func (vm *VM) StackTop() interface{} {
 }
 
 func (vm *VM) Run(env interface{}) error {
+	return vm.RunContext(context.Background(), env)
+}
+
+// RunContext is Run stopping with a *budget.InterruptedError once ctx is done,
+// checked every budget.CheckInterval instructions and around calls. Functions
+// of env taking a context.Context as first parameter receive ctx.
+func (vm *VM) RunContext(ctx context.Context, env interface{}) error {
 	if vm.stack == nil {
 		vm.stack = make([]interface{}, 0, 2)
 	} else {
 		vm.stack = vm.stack[0:0]
 	}
+	if len(vm.frames) > 0 {
+		// a previous run stopped inside a function
+		vm.instructions = vm.frames[0].instructions
+		vm.locals = vm.frames[0].locals
+		vm.frames = vm.frames[0:0]
+	}
+	vm.locals = vm.locals[0:0]
 	vm.sp = 0
+	vm.wide = false
+	limited := vm.Limits != budget.Limits{}
+	done := ctx.Done()
+	executed := 0
 	for vm.sp < len(vm.instructions) {
+		if limited || done != nil {
+			executed++
+			if err := vm.Limits.Step(executed, len(vm.stack)+len(vm.frames)); err != nil {
+				return err
+			}
+			if done != nil && executed%budget.CheckInterval == 0 {
+				if err := budget.Interrupted(ctx, vm.sp); err != nil {
+					return err
+				}
+			}
+		}
 		switch code.Opcode(vm.instructions[vm.sp]) {
 		case code.OpConstant:
-			constIndex := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
+			constIndex := vm.operand()
 			vm.push(vm.constants[constIndex])
-			vm.sp += 2
 		case code.OpPop:
 			vm.pop()
+		case code.OpDup:
+			vm.stack = append(vm.stack, vm.stack[len(vm.stack)-1])
+		case code.OpSwap:
+			n := len(vm.stack)
+			vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-2]
+		case code.OpRot:
+			n := len(vm.stack)
+			vm.stack[n-3], vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-3], vm.stack[n-2]
 		case code.OpTrue:
 			vm.push(true)
 		case code.OpFalse:
@@ -51,7 +112,13 @@ func (vm *VM) Run(env interface{}) error {
 		case code.OpAdd:
 			a := vm.pop()
 			b := vm.pop()
-			vm.push(vm.executeAddOperation(b, a))
+			sum := vm.executeAddOperation(b, a)
+			if s, ok := sum.(string); ok {
+				if err := vm.Limits.Concat(len(s)); err != nil {
+					return err
+				}
+			}
+			vm.push(sum)
 		case code.OpSub:
 			a := vm.pop()
 			b := vm.pop()
@@ -77,8 +144,10 @@ func (vm *VM) Run(env interface{}) error {
 		case code.OpEqual, code.OpNotEqual, code.OpLessThan, code.OpGreaterThan, code.OpLessOrEqual, code.OpGreaterOrEqual:
 			vm.push(vm.executeComparisonOperation(code.Opcode(vm.instructions[vm.sp])))
 		case code.OpArray:
-			numElements := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			numElements := vm.operand()
+			if err := vm.Limits.Array(numElements); err != nil {
+				return err
+			}
 			array := make([]interface{}, numElements)
 			for i := numElements - 1; i >= 0; i-- {
 				array[i] = vm.pop()
@@ -92,21 +161,22 @@ func (vm *VM) Run(env interface{}) error {
 			v := vm.pop().(bool)
 			vm.push(!v)
 		case code.OpJumpIfTrue:
-			pos := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			pos := vm.operand()
 			if vm.StackTop().(bool) {
 				vm.sp += pos
 			}
 		case code.OpJumpIfFalse:
-			pos := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			pos := vm.operand()
 			if !vm.StackTop().(bool) {
 				vm.sp += pos
 			}
+		case code.OpJump:
+			pos := vm.operand()
+			vm.sp += pos
 		case code.OpCall:
 			fn := reflect.ValueOf(vm.pop())
-			size := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			offset := vm.sp
+			size := vm.operand()
 			in := make([]reflect.Value, size)
 			for i := int(size) - 1; i >= 0; i-- {
 				param := vm.pop()
@@ -116,35 +186,110 @@ func (vm *VM) Run(env interface{}) error {
 					in[i] = reflect.ValueOf(param)
 				}
 			}
-			out := fn.Call(in)
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
+			out := fn.Call(builtin.WithContext(ctx, fn, in))
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
 			if len(out) == 2 && out[1].Type() == reflect.TypeOf((*error)(nil)).Elem() && !out[1].IsNil() {
 				panic(out[1].Interface().(error))
 			}
 			vm.push(out[0].Interface())
+		case code.OpGetLocal:
+			slot := vm.operand()
+			vm.push(vm.locals[slot])
+		case code.OpSetLocal:
+			slot := vm.operand()
+			for len(vm.locals) <= slot {
+				vm.locals = append(vm.locals, nil)
+			}
+			vm.locals[slot] = vm.StackTop()
+		case code.OpCallLocal:
+			numArgs := vm.operand()
+			function := vm.pop().(*compiler.Function)
+			if len(vm.frames) >= MaxCallDepth {
+				return fmt.Errorf("maximum call depth %d exceeded in %s()", MaxCallDepth, function.Name)
+			}
+			locals := make([]interface{}, function.NumLocals)
+			for i := numArgs - 1; i >= 0; i-- {
+				locals[i] = vm.pop()
+			}
+			vm.frames = append(vm.frames, frame{instructions: vm.instructions, sp: vm.sp, locals: vm.locals})
+			vm.instructions = function.Instructions
+			vm.locals = locals
+			vm.sp = -1
+		case code.OpReturn:
+			caller := vm.frames[len(vm.frames)-1]
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			vm.instructions = caller.instructions
+			vm.locals = caller.locals
+			vm.sp = caller.sp
+		case code.OpIterInit:
+			variables := vm.operand()
+			entries, err := builtin.Entries(vm.pop(), variables)
+			if err != nil {
+				return err
+			}
+			vm.push(&iterator{entries: entries})
+		case code.OpIterNext:
+			pos := vm.operand()
+			it := vm.StackTop().(*iterator)
+			if it.pos == len(it.entries) {
+				vm.pop()
+				vm.sp += pos
+				break
+			}
+			vm.stack = append(vm.stack, it.entries[it.pos]...)
+			it.pos++
+		case code.OpAppend:
+			value := vm.pop()
+			n := len(vm.stack)
+			array := append(vm.stack[n-2].([]interface{}), value)
+			if err := vm.Limits.Array(len(array)); err != nil {
+				return err
+			}
+			vm.stack[n-2] = array
+		case code.OpLoop:
+			pos := vm.operand()
+			vm.sp -= pos
+		case code.OpBuiltin:
+			index := vm.operand()
+			value, err := builtin.Builtins[index].Call(vm.pop())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpIs:
+			constIndex := vm.operand()
+			vm.push(builtin.Is(vm.pop(), vm.constants[constIndex].(string)))
 		case code.OpLoadConst:
-			constIndex := binary.BigEndian.Uint16(vm.instructions[vm.sp+1:])
-			vm.sp += 2
-			v := reflect.ValueOf(env)
-			kind := v.Kind()
-			if kind == reflect.Invalid {
-				panic(fmt.Sprintf("cannot fetch %v from %T", vm.constants[constIndex], env))
+			value, err := builtin.Load(env, vm.constants[vm.operand()])
+			if err != nil {
+				return err
 			}
-
-			if kind == reflect.Ptr {
-				v = reflect.Indirect(v)
-				kind = v.Kind()
+			vm.push(value)
+		case code.OpAsBool:
+			value, err := builtin.AsBool(vm.pop())
+			if err != nil {
+				return err
 			}
-
-			switch kind {
-			case reflect.Map:
-				value := v.MapIndex(reflect.ValueOf(vm.constants[constIndex]))
-				if value.IsValid() {
-					vm.push(value.Interface())
-				} else {
-					elem := reflect.TypeOf(env).Elem()
-					vm.push(reflect.Zero(elem).Interface())
-				}
+			vm.push(value)
+		case code.OpAsInt:
+			value, err := builtin.AsInt64(vm.pop())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpAsFloat:
+			value, err := builtin.AsFloat64(vm.pop())
+			if err != nil {
+				return err
 			}
+			vm.push(value)
+		case code.OpWide:
+			vm.wide = true
 		default:
 			return fmt.Errorf("unsupported opcode: %d", code.Opcode(vm.instructions[vm.sp]))
 		}
@@ -153,6 +298,20 @@ func (vm *VM) Run(env interface{}) error {
 	return nil
 }
 
+// operand reads the operand of the current instruction and moves past it.
+// After OpWide the operand is four bytes instead of two.
+func (vm *VM) operand() int {
+	if vm.wide {
+		vm.wide = false
+		value := int(binary.BigEndian.Uint32(vm.instructions[vm.sp+1:]))
+		vm.sp += 4
+		return value
+	}
+	value := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
+	vm.sp += 2
+	return value
+}
+
 func (vm *VM) push(value interface{}) {
 	vm.stack = append(vm.stack, value)
 }
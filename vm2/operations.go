@@ -120,7 +120,7 @@ func (vm *VM) executeExponentiationOperation(a, b interface{}) interface{} {
 }
 
 func (vm *VM) executeMinusOperator() interface{} {
-	operand, _ := vm.pop()
+	operand := vm.popValue()
 	switch x := operand.(type) {
 	case int64:
 		return -x
@@ -286,9 +286,5 @@ func (vm *VM) executeIndexOperation(array interface{}, index interface{}) {
 		vm.push(nil)
 		return
 	}
-	switch t := arrayObject[i].(type) {
-	case int64, float64, bool, string:
-		vm.push(t)
-		return
-	}
+	vm.push(arrayObject[i])
 }
@@ -1,18 +1,33 @@
 package vm2
 
 import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/vm/code"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"reflect"
 )
 
 type VM struct {
+	Limits       budget.Limits // bounds every Run, unlimited by default
 	constants    []interface{}
 	instructions code.Instructions
 	stack        []interface{}
 	stackString  []string
+	locals       []interface{}
 	sp           int
+	wide         bool // the next operand follows OpWide
+}
+
+// onStackString marks the elements of stack whose value is held in
+// stackString, which tells a string apart from nil.
+type onStackString struct{}
+
+func isString(value interface{}) bool {
+	_, ok := value.(onStackString)
+	return ok
 }
 
 func New(instructions code.Instructions, constants []interface{}) *VM {
@@ -26,16 +41,20 @@ func New(instructions code.Instructions, constants []interface{}) *VM {
 }
 
 func (vm *VM) StackTop() interface{} {
-	if vm.stack[len(vm.stack)-1] != nil {
-		return vm.stack[len(vm.stack)-1]
-	} else if vm.stackString[len(vm.stackString)-1] != "" {
+	if isString(vm.stack[len(vm.stack)-1]) {
 		return vm.stackString[len(vm.stackString)-1]
-	} else {
-		return nil
 	}
+	return vm.stack[len(vm.stack)-1]
 }
 
 func (vm *VM) Run(env interface{}) error {
+	return vm.RunContext(context.Background(), env)
+}
+
+// RunContext is Run stopping with a *budget.InterruptedError once ctx is done,
+// checked every budget.CheckInterval instructions and around calls. Functions
+// of env taking a context.Context as first parameter receive ctx.
+func (vm *VM) RunContext(ctx context.Context, env interface{}) error {
 	if vm.stack == nil {
 		vm.stack = make([]interface{}, 0, 2)
 	} else {
@@ -46,18 +65,44 @@ func (vm *VM) Run(env interface{}) error {
 	} else {
 		vm.stackString = vm.stackString[0:0]
 	}
+	vm.locals = vm.locals[0:0]
 	vm.sp = 0
+	vm.wide = false
+	limited := vm.Limits != budget.Limits{}
+	done := ctx.Done()
+	executed := 0
 	for vm.sp < len(vm.instructions) {
+		if limited || done != nil {
+			executed++
+			if err := vm.Limits.Step(executed, len(vm.stack)); err != nil {
+				return err
+			}
+			if done != nil && executed%budget.CheckInterval == 0 {
+				if err := budget.Interrupted(ctx, vm.sp); err != nil {
+					return err
+				}
+			}
+		}
 		switch code.Opcode(vm.instructions[vm.sp]) {
 		case code.OpConstant:
-			constIndex := binary.BigEndian.Uint16(vm.instructions[vm.sp+1:])
-			vm.sp += 2
+			constIndex := vm.operand()
 			if int(constIndex) >= len(vm.constants) {
 				return fmt.Errorf("constant index out of range: %d", constIndex)
 			}
 			vm.push(vm.constants[constIndex])
 		case code.OpPop:
 			vm.pop()
+		case code.OpDup:
+			vm.stack = append(vm.stack, vm.stack[len(vm.stack)-1])
+			vm.stackString = append(vm.stackString, vm.stackString[len(vm.stackString)-1])
+		case code.OpSwap:
+			n := len(vm.stack)
+			vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-2]
+			vm.stackString[n-2], vm.stackString[n-1] = vm.stackString[n-1], vm.stackString[n-2]
+		case code.OpRot:
+			n := len(vm.stack)
+			vm.stack[n-3], vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-3], vm.stack[n-2]
+			vm.stackString[n-3], vm.stackString[n-2], vm.stackString[n-1] = vm.stackString[n-1], vm.stackString[n-3], vm.stackString[n-2]
 		case code.OpTrue:
 			vm.push(true)
 		case code.OpFalse:
@@ -67,119 +112,143 @@ func (vm *VM) Run(env interface{}) error {
 		case code.OpAdd:
 			a, as := vm.pop()
 			b, bs := vm.pop()
-			if a == nil && b == nil {
+			if isString(a) && isString(b) {
+				if err := vm.Limits.Concat(len(bs) + len(as)); err != nil {
+					return err
+				}
 				vm.push(bs + as)
 			} else {
-				vm.push(vm.executeAddOperation(b, a))
+				vm.push(vm.executeAddOperation(box(b, bs), box(a, as)))
 			}
 		case code.OpSub:
-			a, _ := vm.pop()
-			b, _ := vm.pop()
+			a := vm.popValue()
+			b := vm.popValue()
 			vm.push(vm.executeSubtractOperation(b, a))
 		case code.OpMul:
-			a, _ := vm.pop()
-			b, _ := vm.pop()
+			a := vm.popValue()
+			b := vm.popValue()
 			vm.push(vm.executeMultiplyOperation(a, b))
 		case code.OpDiv:
-			a, _ := vm.pop()
-			b, _ := vm.pop()
+			a := vm.popValue()
+			b := vm.popValue()
 			vm.push(vm.executeDivideOperation(b, a))
 		case code.OpMod:
-			a, _ := vm.pop()
-			b, _ := vm.pop()
+			a := vm.popValue()
+			b := vm.popValue()
 			vm.push(vm.executeRemainderOperation(b, a))
 		case code.OpExp:
-			a, _ := vm.pop()
-			b, _ := vm.pop()
+			a := vm.popValue()
+			b := vm.popValue()
 			vm.push(vm.executeExponentiationOperation(b, a))
 		case code.OpMinus:
 			vm.push(vm.executeMinusOperator())
 		case code.OpEqual, code.OpNotEqual, code.OpLessThan, code.OpGreaterThan, code.OpLessOrEqual, code.OpGreaterOrEqual:
 			a, as := vm.pop()
 			b, bs := vm.pop()
-			if a == nil && b == nil {
+			if isString(a) && isString(b) {
 				vm.push(vm.executeComparisonOperation(as, bs, code.Opcode(vm.instructions[vm.sp])))
 			} else {
-				vm.push(vm.executeComparisonOperation(a, b, code.Opcode(vm.instructions[vm.sp])))
+				vm.push(vm.executeComparisonOperation(box(a, as), box(b, bs), code.Opcode(vm.instructions[vm.sp])))
 			}
 		case code.OpArray:
-			numElements := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			numElements := vm.operand()
+			if err := vm.Limits.Array(numElements); err != nil {
+				return err
+			}
 			array := make([]interface{}, numElements)
 			for i := numElements - 1; i >= 0; i-- {
-				a, as := vm.pop()
-				if a == nil {
-					array[i] = as
-				} else {
-					array[i] = a
-				}
+				array[i] = vm.popValue()
 			}
 			vm.push(array)
 		case code.OpIndex:
-			index, _ := vm.pop()
-			array, _ := vm.pop()
+			index := vm.popValue()
+			array := vm.popValue()
 			vm.executeIndexOperation(array, index)
 		case code.OpNot:
-			v, _ := vm.pop()
-			vm.push(!v.(bool))
+			vm.push(!vm.popValue().(bool))
 		case code.OpJumpIfTrue:
-			pos := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			pos := vm.operand()
 			if vm.StackTop().(bool) {
 				vm.sp += pos
 			}
 		case code.OpJumpIfFalse:
-			pos := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			pos := vm.operand()
 			if !vm.StackTop().(bool) {
 				vm.sp += pos
 			}
+		case code.OpJump:
+			pos := vm.operand()
+			vm.sp += pos
 		case code.OpCall:
-			elem, _ := vm.pop()
-			fn := reflect.ValueOf(elem)
-			size := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			fn := reflect.ValueOf(vm.popValue())
+			offset := vm.sp
+			size := vm.operand()
 			in := make([]reflect.Value, size)
 			for i := int(size) - 1; i >= 0; i-- {
-				param, s := vm.pop()
-				if param == nil {
-					param = s
-				}
+				param := vm.popValue()
 				if param == nil && reflect.TypeOf(param) == nil {
 					in[i] = reflect.ValueOf(&param).Elem()
 				} else {
 					in[i] = reflect.ValueOf(param)
 				}
 			}
-			out := fn.Call(in)
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
+			out := fn.Call(builtin.WithContext(ctx, fn, in))
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
 			if len(out) == 2 && out[1].Type() == reflect.TypeOf((*error)(nil)).Elem() && !out[1].IsNil() {
 				panic(out[1].Interface().(error))
 			}
 			vm.push(out[0].Interface())
+		case code.OpGetLocal:
+			slot := vm.operand()
+			vm.push(vm.locals[slot])
+		case code.OpSetLocal:
+			slot := vm.operand()
+			for len(vm.locals) <= slot {
+				vm.locals = append(vm.locals, nil)
+			}
+			vm.locals[slot] = vm.popValue()
+			vm.push(vm.locals[slot])
+		case code.OpBuiltin:
+			index := vm.operand()
+			value, err := builtin.Builtins[index].Call(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpIs:
+			constIndex := vm.operand()
+			vm.push(builtin.Is(vm.popValue(), vm.constants[constIndex].(string)))
 		case code.OpLoadConst:
-			constIndex := binary.BigEndian.Uint16(vm.instructions[vm.sp+1:])
-			vm.sp += 2
-			v := reflect.ValueOf(env)
-			kind := v.Kind()
-			if kind == reflect.Invalid {
-				panic(fmt.Sprintf("cannot fetch %v from %T", vm.constants[constIndex], env))
+			value, err := builtin.Load(env, vm.constants[vm.operand()])
+			if err != nil {
+				return err
 			}
-
-			if kind == reflect.Ptr {
-				v = reflect.Indirect(v)
-				kind = v.Kind()
+			vm.push(value)
+		case code.OpAsBool:
+			value, err := builtin.AsBool(vm.popValue())
+			if err != nil {
+				return err
 			}
-
-			switch kind {
-			case reflect.Map:
-				value := v.MapIndex(reflect.ValueOf(vm.constants[constIndex]))
-				if value.IsValid() {
-					vm.push(value.Interface())
-				} else {
-					elem := reflect.TypeOf(env).Elem()
-					vm.push(reflect.Zero(elem).Interface())
-				}
+			vm.push(value)
+		case code.OpAsInt:
+			value, err := builtin.AsInt64(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpAsFloat:
+			value, err := builtin.AsFloat64(vm.popValue())
+			if err != nil {
+				return err
 			}
+			vm.push(value)
+		case code.OpWide:
+			vm.wide = true
 		default:
 			return fmt.Errorf("unsupported opcode: %d", code.Opcode(vm.instructions[vm.sp]))
 		}
@@ -188,11 +257,25 @@ func (vm *VM) Run(env interface{}) error {
 	return nil
 }
 
+// operand reads the operand of the current instruction and moves past it.
+// After OpWide the operand is four bytes instead of two.
+func (vm *VM) operand() int {
+	if vm.wide {
+		vm.wide = false
+		value := int(binary.BigEndian.Uint32(vm.instructions[vm.sp+1:]))
+		vm.sp += 4
+		return value
+	}
+	value := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
+	vm.sp += 2
+	return value
+}
+
 func (vm *VM) push(value interface{}) {
 	switch v := value.(type) {
 	case string:
 		vm.stackString = append(vm.stackString, v)
-		vm.stack = append(vm.stack, nil)
+		vm.stack = append(vm.stack, onStackString{})
 	default:
 		vm.stack = append(vm.stack, value)
 		vm.stackString = append(vm.stackString, "")
@@ -206,3 +289,16 @@ func (vm *VM) pop() (interface{}, string) {
 	vm.stack = vm.stack[:len(vm.stack)-1]
 	return value, valueString
 }
+
+// popValue pops the top element, taking it from stackString when stack marks
+// it as a string.
+func (vm *VM) popValue() interface{} {
+	return box(vm.pop())
+}
+
+func box(value interface{}, valueString string) interface{} {
+	if isString(value) {
+		return valueString
+	}
+	return value
+}
@@ -1,10 +1,15 @@
 package vm2
 
 import (
+	"bachelor-thesis/budget"
 	"bachelor-thesis/parser"
+	"bachelor-thesis/vm/code"
 	"bachelor-thesis/vm/compiler"
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -98,6 +103,45 @@ var vmTests = []vmTest{
 	{`false and false or true`, true},
 	{`("qym" < "qyi") and ("tvzew" < "i") or ("bv" <= "xw")`, true},
 	{`("kt" >= "cwcg") and ("pppvp" > "xqqew") or ("geh" <= "wst") and ("je" != "wvvkr") or ("oejgc" < "obsjo") and ("r" != "ml") or ("bkyay" >= "hqdnn")`, true},
+	{"1 < 2 < 3", true},
+	{"1 < 3 < 2", false},
+	{"3 < 1 < 2", false},
+	{"1 < 2 <= 2 < 3", true},
+	{"3 > 2.5 >= 2 > 1", true},
+	{`"a" < "b" < "c"`, true},
+	{"1 < 2 == true", true},
+	{"1 == 1 == true", true},
+	{"2 > 1 != false", true},
+	{`if 1 < 2 then "a" else "b"`, "a"},
+	{`if 1 > 2 then "a" else "b"`, "b"},
+	{`if false then 1`, nil},
+	{`if 1 > 2 then "A" else if 1 > 0 then "B" else "C"`, "B"},
+	{`(if true then 1 else 2) + 10`, int64(11)},
+	{`case "warn" when "ok" then 1 when "warn" then 2 else 3 end`, int64(2)},
+	{`case "none" when "ok" then 1 when "warn" then 2 else 3 end`, int64(3)},
+	{`case 5 when 1 then "one" end`, nil},
+	{`case when 1 > 2 then "a" when 2 > 1 then "b" end`, "b"},
+	{`int("42") + 1`, int64(43)},
+	{`int(4.7)`, int64(4)},
+	{`float("1.5") * 2`, 3.0},
+	{`float(3)`, 3.0},
+	{`string(3) + "px"`, "3px"},
+	{`string(2.5)`, "2.5"},
+	{`bool("true") and true`, true},
+	{`bool(0)`, false},
+	{`"a" is string`, true},
+	{`1 is float`, false},
+	{`1.5 is float`, true},
+	{`[1] is array`, true},
+	{`1 + 2 is int and "a" is string`, true},
+	{`1; 2; 3`, int64(3)},
+	{`"a"; "b";`, "b"},
+	{`let x = 2; x * x`, int64(4)},
+	{`let x = 1; let x = x + 1; x`, int64(2)},
+	{`let s = "ab"; let n = 3; s + string(n)`, "ab3"},
+	{`let x = 5`, int64(5)},
+	{`1 < 2 ? "a" : "b"`, "a"},
+	{`1 > 2 ? "a" : 2 > 1 ? "b" : "c"`, "b"},
 }
 
 func TestVM(t *testing.T) {
@@ -151,6 +195,34 @@ var vmTestsWithEnvironment = []vmTestWithEnvironment{
 		map[string]interface{}{"a": 1.2, "b": 2.3, "add": func(a, b int64) int64 { return a + b }},
 		6.5,
 	},
+	{`0 < x <= 10`,
+		map[string]interface{}{"x": int64(10)},
+		true,
+	},
+	{`0 < x <= 10`,
+		map[string]interface{}{"x": int64(11)},
+		false,
+	},
+	{`if score > 90 then "A" else if score > 80 then "B" else "C"`,
+		map[string]interface{}{"score": int64(85)},
+		"B",
+	},
+	{`case status when "ok" then 1 when "warn" then fail() else fail() end`,
+		map[string]interface{}{"status": "ok", "fail": func() int64 { panic("branch must not be evaluated") }},
+		int64(1),
+	},
+	{`if flag then 1 else fail()`,
+		map[string]interface{}{"flag": true, "fail": func() int64 { panic("branch must not be evaluated") }},
+		int64(1),
+	},
+	{`let total = a + b; total * 2`,
+		map[string]interface{}{"a": 1.5, "b": 2.5},
+		8.0,
+	},
+	{`let a = a * 2; a + 1`,
+		map[string]interface{}{"a": int64(5)},
+		int64(11),
+	},
 }
 
 func TestVMWithEnvironment(t *testing.T) {
@@ -165,3 +237,118 @@ func TestVMWithEnvironment(t *testing.T) {
 		testExpectedObject(t, test.expected, stackElem)
 	}
 }
+
+// zeroValueTests produce "", 0, nil and false, which the machine must tell
+// apart whichever stack holds them.
+var zeroValueTests = []vmTest{
+	{`""`, ""},
+	{`0`, int64(0)},
+	{`nil`, nil},
+	{`false`, false},
+	{`"" + ""`, ""},
+	{`1 - 1`, int64(0)},
+	{`[nil, 0, "", false][0]`, nil},
+	{`[nil, 0, "", false][1]`, int64(0)},
+	{`[nil, 0, "", false][2]`, ""},
+	{`[nil, 0, "", false][3]`, false},
+	{`[nil, 0, "", false]`, []interface{}{nil, int64(0), "", false}},
+	{`if true then "" else 0`, ""},
+	{`if false then "" else 0`, int64(0)},
+	{`if false then 0`, nil},
+	{`true ? false : ""`, false},
+	{`let x = ""; x`, ""},
+	{`let x = 0; x`, int64(0)},
+	{`"" == ""`, true},
+	{`0 == 0`, true},
+	{`s`, ""},
+	{`n`, int64(0)},
+	{`z`, nil},
+	{`b`, false},
+	{`id(s)`, ""},
+	{`id(n)`, int64(0)},
+	{`id(z)`, nil},
+	{`s + ""`, ""},
+	{`n * 2`, int64(0)},
+	{`[s, n, z, b]`, []interface{}{"", int64(0), nil, false}},
+}
+
+var zeroEnv = map[string]interface{}{
+	"s":  "",
+	"n":  int64(0),
+	"z":  nil,
+	"b":  false,
+	"id": func(v interface{}) interface{} { return v },
+}
+
+func TestZeroValues(t *testing.T) {
+	for _, test := range zeroValueTests {
+		program, err := compiler.Compile(parser.Parse(test.input))
+		require.NoError(t, err, test.input)
+		vm := New(program.Instructions, program.Constants)
+		err = vm.Run(zeroEnv)
+		require.NoError(t, err, test.input)
+		assert.Equal(t, test.expected, vm.StackTop(), test.input)
+	}
+}
+
+// TestWideOperands runs programs with more than 65536 constants and jumps over
+// more than 64KB of instructions, which need wide operands.
+func TestWideOperands(t *testing.T) {
+	terms := make([]string, 100000)
+	for i := range terms {
+		terms[i] = fmt.Sprint(i)
+	}
+	sum := strings.Join(terms, " + ")
+	for _, test := range []vmTest{
+		{sum, int64(100000 * 99999 / 2)},
+		{"true ? " + sum + " : 0", int64(100000 * 99999 / 2)},
+		{"false ? " + sum + " : 0", int64(0)},
+	} {
+		program, err := compiler.Compile(parser.Parse(test.input))
+		require.NoError(t, err)
+		vm := New(program.Instructions, program.Constants)
+		err = vm.Run(nil)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, vm.StackTop())
+	}
+}
+
+// TestLimits runs one limited program, the engine package tests every limit
+// on every machine.
+func TestLimits(t *testing.T) {
+	program, err := compiler.Compile(parser.Parse(`1 + (2 + (3 + 4))`))
+	require.NoError(t, err)
+	vm := New(program.Instructions, program.Constants)
+	vm.Limits = budget.Limits{StackDepth: 3}
+	assert.Equal(t, &budget.StackDepthError{Limit: 3}, vm.Run(nil))
+}
+
+type contextKey struct{}
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey{}, int64(10)))
+	defer cancel()
+	env := map[string]interface{}{
+		"get":  func(ctx context.Context, x int64) int64 { return ctx.Value(contextKey{}).(int64) + x },
+		"stop": func(x int64) int64 { cancel(); return x },
+	}
+	program, err := compiler.Compile(parser.Parse(`get(1)`))
+	require.NoError(t, err)
+	vm := New(program.Instructions, program.Constants)
+	require.NoError(t, vm.RunContext(ctx, env))
+	assert.Equal(t, int64(11), vm.StackTop())
+
+	program, err = compiler.Compile(parser.Parse(`stop(1) + get(1)`))
+	require.NoError(t, err)
+	err = New(program.Instructions, program.Constants).RunContext(ctx, env)
+	var interrupted *budget.InterruptedError
+	require.ErrorAs(t, err, &interrupted)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, code.OpCall, code.Opcode(program.Instructions[interrupted.Offset]))
+
+	// without calls the context is checked every budget.CheckInterval instructions
+	program, err = compiler.Compile(parser.Parse(strings.Repeat("1 + ", budget.CheckInterval) + "1"))
+	require.NoError(t, err)
+	err = New(program.Instructions, program.Constants).RunContext(ctx, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
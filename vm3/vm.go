@@ -1,17 +1,29 @@
 package vm3
 
 import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/vm/code"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"reflect"
 )
 
 type VM struct {
+	Limits       budget.Limits // bounds every Run, unlimited by default
 	constants    []interface{}
 	instructions code.Instructions
 	stack        []reflect.Value
+	locals       []reflect.Value
 	sp           int
+	wide         bool // the next operand follows OpWide
+}
+
+// iterator holds the loop variables of every iteration of a comprehension.
+type iterator struct {
+	entries [][]interface{}
+	pos     int
 }
 
 func New(instructions code.Instructions, constants []interface{}) *VM {
@@ -28,20 +40,50 @@ func (vm *VM) StackTop() interface{} {
 }
 
 func (vm *VM) Run(env interface{}) error {
+	return vm.RunContext(context.Background(), env)
+}
+
+// RunContext is Run stopping with a *budget.InterruptedError once ctx is done,
+// checked every budget.CheckInterval instructions and around calls. Functions
+// of env taking a context.Context as first parameter receive ctx.
+func (vm *VM) RunContext(ctx context.Context, env interface{}) error {
 	if vm.stack == nil {
 		vm.stack = make([]reflect.Value, 0, 2)
 	} else {
 		vm.stack = vm.stack[0:0]
 	}
+	vm.locals = vm.locals[0:0]
 	vm.sp = 0
+	vm.wide = false
+	limited := vm.Limits != budget.Limits{}
+	done := ctx.Done()
+	executed := 0
 	for vm.sp < len(vm.instructions) {
+		if limited || done != nil {
+			executed++
+			if err := vm.Limits.Step(executed, len(vm.stack)); err != nil {
+				return err
+			}
+			if done != nil && executed%budget.CheckInterval == 0 {
+				if err := budget.Interrupted(ctx, vm.sp); err != nil {
+					return err
+				}
+			}
+		}
 		switch code.Opcode(vm.instructions[vm.sp]) {
 		case code.OpConstant:
-			constIndex := binary.BigEndian.Uint16(vm.instructions[vm.sp+1:])
-			vm.sp += 2
+			constIndex := vm.operand()
 			vm.push(reflect.ValueOf(vm.constants[constIndex]))
 		case code.OpPop:
 			vm.pop()
+		case code.OpDup:
+			vm.stack = append(vm.stack, vm.stack[len(vm.stack)-1])
+		case code.OpSwap:
+			n := len(vm.stack)
+			vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-2]
+		case code.OpRot:
+			n := len(vm.stack)
+			vm.stack[n-3], vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-3], vm.stack[n-2]
 		case code.OpTrue:
 			vm.push(reflect.ValueOf(true))
 		case code.OpFalse:
@@ -52,7 +94,13 @@ func (vm *VM) Run(env interface{}) error {
 		case code.OpAdd:
 			a := vm.pop()
 			b := vm.pop()
-			vm.push(vm.executeAddOperation(b, a))
+			sum := vm.executeAddOperation(b, a)
+			if sum.Kind() == reflect.String {
+				if err := vm.Limits.Concat(sum.Len()); err != nil {
+					return err
+				}
+			}
+			vm.push(sum)
 		case code.OpSub:
 			a := vm.pop()
 			b := vm.pop()
@@ -80,8 +128,10 @@ func (vm *VM) Run(env interface{}) error {
 			b := vm.pop()
 			vm.push(vm.executeComparisonOperation(b, a, code.Opcode(vm.instructions[vm.sp])))
 		case code.OpArray:
-			numElements := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			numElements := vm.operand()
+			if err := vm.Limits.Array(numElements); err != nil {
+				return err
+			}
 			array := make([]interface{}, numElements)
 			for i := numElements - 1; i >= 0; i-- {
 				array[i] = vm.pop().Interface()
@@ -95,51 +145,117 @@ func (vm *VM) Run(env interface{}) error {
 			v := vm.pop()
 			vm.push(reflect.ValueOf(!v.Bool()))
 		case code.OpJumpIfTrue:
-			pos := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			pos := vm.operand()
 			if vm.StackTop().(bool) {
 				vm.sp += pos
 			}
 		case code.OpJumpIfFalse:
-			pos := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			pos := vm.operand()
 			if !vm.StackTop().(bool) {
 				vm.sp += pos
 			}
+		case code.OpJump:
+			pos := vm.operand()
+			vm.sp += pos
 		case code.OpCall:
 			fn := vm.pop()
-			size := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			offset := vm.sp
+			size := vm.operand()
 			in := make([]reflect.Value, size)
 			for i := int(size) - 1; i >= 0; i-- {
 				in[i] = vm.pop()
 			}
-			out := fn.Call(in)
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
+			out := fn.Call(builtin.WithContext(ctx, fn, in))
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
 			vm.push(out[0])
-		case code.OpLoadConst:
-			constIndex := binary.BigEndian.Uint16(vm.instructions[vm.sp+1:])
-			vm.sp += 2
-			v := reflect.ValueOf(env)
-			kind := v.Kind()
-			if kind == reflect.Invalid {
-				panic(fmt.Sprintf("cannot fetch %v from %T", vm.constants[constIndex], env))
+		case code.OpGetLocal:
+			slot := vm.operand()
+			vm.push(vm.locals[slot])
+		case code.OpSetLocal:
+			slot := vm.operand()
+			for len(vm.locals) <= slot {
+				vm.locals = append(vm.locals, reflect.Value{})
 			}
-
-			if kind == reflect.Ptr {
-				v = reflect.Indirect(v)
-				kind = v.Kind()
+			vm.locals[slot] = vm.stack[len(vm.stack)-1]
+		case code.OpIterInit:
+			variables := vm.operand()
+			entries, err := builtin.Entries(vm.pop().Interface(), variables)
+			if err != nil {
+				return err
 			}
-
-			switch kind {
-			case reflect.Map:
-				value := v.MapIndex(reflect.ValueOf(vm.constants[constIndex]))
-				if value.IsValid() {
-					vm.push(value.Elem())
+			vm.push(reflect.ValueOf(&iterator{entries: entries}))
+		case code.OpIterNext:
+			pos := vm.operand()
+			it := vm.stack[len(vm.stack)-1].Interface().(*iterator)
+			if it.pos == len(it.entries) {
+				vm.pop()
+				vm.sp += pos
+				break
+			}
+			for _, value := range it.entries[it.pos] {
+				if value == nil {
+					vm.push(reflect.ValueOf(&value).Elem())
 				} else {
-					elem := reflect.TypeOf(env)
-					vm.push(reflect.Zero(elem).Elem())
+					vm.push(reflect.ValueOf(value))
 				}
 			}
+			it.pos++
+		case code.OpAppend:
+			value := vm.pop()
+			n := len(vm.stack)
+			array := reflect.Append(vm.stack[n-2], value)
+			if err := vm.Limits.Array(array.Len()); err != nil {
+				return err
+			}
+			vm.stack[n-2] = array
+		case code.OpLoop:
+			pos := vm.operand()
+			vm.sp -= pos
+		case code.OpBuiltin:
+			index := vm.operand()
+			value, err := builtin.Builtins[index].Call(vm.popInterface())
+			if err != nil {
+				return err
+			}
+			vm.push(reflect.ValueOf(value))
+		case code.OpIs:
+			constIndex := vm.operand()
+			vm.push(reflect.ValueOf(builtin.Is(vm.pop().Interface(), vm.constants[constIndex].(string))))
+		case code.OpLoadConst:
+			value, err := builtin.Load(env, vm.constants[vm.operand()])
+			if err != nil {
+				return err
+			}
+			if value == nil {
+				vm.push(reflect.ValueOf(&value).Elem())
+			} else {
+				vm.push(reflect.ValueOf(value))
+			}
+		case code.OpAsBool:
+			value, err := builtin.AsBool(vm.popInterface())
+			if err != nil {
+				return err
+			}
+			vm.push(reflect.ValueOf(value))
+		case code.OpAsInt:
+			value, err := builtin.AsInt64(vm.popInterface())
+			if err != nil {
+				return err
+			}
+			vm.push(reflect.ValueOf(value))
+		case code.OpAsFloat:
+			value, err := builtin.AsFloat64(vm.popInterface())
+			if err != nil {
+				return err
+			}
+			vm.push(reflect.ValueOf(value))
+		case code.OpWide:
+			vm.wide = true
 		default:
 			return fmt.Errorf("unsupported opcode: %d", code.Opcode(vm.instructions[vm.sp]))
 		}
@@ -148,6 +264,20 @@ func (vm *VM) Run(env interface{}) error {
 	return nil
 }
 
+// operand reads the operand of the current instruction and moves past it.
+// After OpWide the operand is four bytes instead of two.
+func (vm *VM) operand() int {
+	if vm.wide {
+		vm.wide = false
+		value := int(binary.BigEndian.Uint32(vm.instructions[vm.sp+1:]))
+		vm.sp += 4
+		return value
+	}
+	value := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
+	vm.sp += 2
+	return value
+}
+
 func (vm *VM) push(value reflect.Value) {
 	vm.stack = append(vm.stack, value)
 }
@@ -157,3 +287,12 @@ func (vm *VM) pop() reflect.Value {
 	vm.stack = vm.stack[:len(vm.stack)-1]
 	return value
 }
+
+// popInterface pops the top element as an interface, a missing map entry is nil.
+func (vm *VM) popInterface() interface{} {
+	value := vm.pop()
+	if !value.IsValid() {
+		return nil
+	}
+	return value.Interface()
+}
@@ -1,13 +1,20 @@
 package vm4
 
 import (
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/vm/code"
+	"context"
 	"fmt"
+	"math"
+	"reflect"
 )
 
 func (vm *VM) executeAddOperation(a, b interface{}) interface{} {
 	switch x := a.(type) {
 	case int64:
 		switch y := b.(type) {
+		case int64:
+			return x + y
 		case float64:
 			return float64(x) + y
 		}
@@ -31,6 +38,8 @@ func (vm *VM) executeSubtractOperation(a, b interface{}) interface{} {
 	switch x := a.(type) {
 	case int64:
 		switch y := b.(type) {
+		case int64:
+			return x - y
 		case float64:
 			return float64(x) - y
 		}
@@ -44,11 +53,77 @@ func (vm *VM) executeSubtractOperation(a, b interface{}) interface{} {
 	}
 	panic(fmt.Sprintf("invalid operation: %T - %T", a, b))
 }
-func (vm *VM) executeMinusOperator() interface{} {
-	operand, operandInt := vm.pop()
-	if operand == nil {
-		return -operandInt
+
+func (vm *VM) executeMultiplyOperation(a, b interface{}) interface{} {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x * y
+		case float64:
+			return float64(x) * y
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return x * float64(y)
+		case float64:
+			return x * y
+		}
 	}
+	panic(fmt.Sprintf("invalid operation: %T * %T", a, b))
+}
+func (vm *VM) executeDivideOperation(a, b interface{}) interface{} {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x / y
+		case float64:
+			return float64(x) / y
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return x / float64(y)
+		case float64:
+			return x / y
+		}
+	}
+	panic(fmt.Sprintf("invalid operation: %T / %T", a, b))
+}
+func (vm *VM) executeRemainderOperation(a, b interface{}) interface{} {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x % y
+		}
+	}
+	panic(fmt.Sprintf("invalid operation: %T mod %T", a, b))
+}
+func (vm *VM) executeExponentiationOperation(a, b interface{}) interface{} {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return int64(math.Pow(float64(x), float64(y)))
+		case float64:
+			return math.Pow(float64(x), y)
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return math.Pow(x, float64(y))
+		case float64:
+			return math.Pow(x, y)
+		}
+	}
+	panic(fmt.Sprintf("invalid operation: %T ^ %T", a, b))
+}
+
+func (vm *VM) executeMinusOperator() interface{} {
+	operand := vm.popValue()
 	switch x := operand.(type) {
 	case int64:
 		return -x
@@ -57,3 +132,205 @@ func (vm *VM) executeMinusOperator() interface{} {
 	}
 	panic(fmt.Errorf("unsupported type for negation: %s", operand))
 }
+
+// compareInts compares two operands held in stackInt without boxing them.
+func compareInts(opcode code.Opcode, x, y int64) bool {
+	switch opcode {
+	case code.OpLessThan:
+		return x < y
+	case code.OpGreaterThan:
+		return x > y
+	case code.OpLessOrEqual:
+		return x <= y
+	case code.OpGreaterOrEqual:
+		return x >= y
+	case code.OpNotEqual:
+		return x != y
+	default:
+		return x == y
+	}
+}
+
+func (vm *VM) executeComparisonOperation(a interface{}, b interface{}, opcode code.Opcode) interface{} {
+	switch opcode {
+	case code.OpLessThan:
+		switch y := a.(type) {
+		case int64:
+			switch x := b.(type) {
+			case int64:
+				return x < y
+			case float64:
+				return x < float64(y)
+			}
+		case float64:
+			switch x := b.(type) {
+			case int64:
+				return float64(x) < y
+			case float64:
+				return x < y
+			}
+		case string:
+			switch x := b.(type) {
+			case string:
+				return x < y
+			}
+		}
+	case code.OpLessOrEqual:
+		switch y := a.(type) {
+		case int64:
+			switch x := b.(type) {
+			case int64:
+				return x <= y
+			case float64:
+				return x <= float64(y)
+			}
+		case float64:
+			switch x := b.(type) {
+			case int64:
+				return float64(x) <= y
+			case float64:
+				return x <= y
+			}
+		case string:
+			switch x := b.(type) {
+			case string:
+				return x <= y
+			}
+		}
+	case code.OpGreaterThan:
+		switch y := a.(type) {
+		case int64:
+			switch x := b.(type) {
+			case int64:
+				return x > y
+			case float64:
+				return x > float64(y)
+			}
+		case float64:
+			switch x := b.(type) {
+			case int64:
+				return float64(x) > y
+			case float64:
+				return x > y
+			}
+		case string:
+			switch x := b.(type) {
+			case string:
+				return x > y
+			}
+		}
+	case code.OpGreaterOrEqual:
+		switch y := a.(type) {
+		case int64:
+			switch x := b.(type) {
+			case int64:
+				return x >= y
+			case float64:
+				return x >= float64(y)
+			}
+		case float64:
+			switch x := b.(type) {
+			case int64:
+				return float64(x) >= y
+			case float64:
+				return x >= y
+			}
+		case string:
+			switch x := b.(type) {
+			case string:
+				return x >= y
+			}
+		}
+	case code.OpEqual:
+		switch y := a.(type) {
+		case bool:
+			switch x := b.(type) {
+			case bool:
+				return x == y
+			}
+		case int64:
+			switch x := b.(type) {
+			case int64:
+				return x == y
+			case float64:
+				return x == float64(y)
+			}
+		case float64:
+			switch x := b.(type) {
+			case int64:
+				return float64(x) == y
+			case float64:
+				return x == y
+			}
+		case string:
+			switch x := b.(type) {
+			case string:
+				return x == y
+			}
+		}
+	case code.OpNotEqual:
+		switch y := a.(type) {
+		case bool:
+			switch x := b.(type) {
+			case bool:
+				return x != y
+			}
+		case int64:
+			switch x := b.(type) {
+			case int64:
+				return x != y
+			case float64:
+				return x != float64(y)
+			}
+		case float64:
+			switch x := b.(type) {
+			case int64:
+				return float64(x) != y
+			case float64:
+				return x != y
+			}
+		case string:
+			switch x := b.(type) {
+			case string:
+				return x != y
+			}
+		}
+	}
+	panic(fmt.Sprintf("invalid operation: %T comparison %T", a, b))
+}
+
+func (vm *VM) executeIndexOperation(array interface{}, index interface{}) {
+	arrayObject := array.([]interface{})
+	i := index.(int64)
+	max := int64(len(arrayObject) - 1)
+	if i < 0 || i > max {
+		vm.push(nil)
+		return
+	}
+	vm.push(arrayObject[i])
+}
+
+// call calls an environment function, passing ctx when it takes a context. A
+// function may return an error as its second result.
+func call(ctx context.Context, fn interface{}, args []interface{}) (interface{}, error) {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%v is not a function", fn)
+	}
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		if arg == nil {
+			in[i] = reflect.ValueOf(&args[i]).Elem()
+		} else {
+			in[i] = reflect.ValueOf(arg)
+		}
+	}
+	out := f.Call(builtin.WithContext(ctx, f, in))
+	if len(out) == 0 {
+		return nil, nil
+	}
+	if len(out) == 2 && out[1].Type() == reflect.TypeOf((*error)(nil)).Elem() && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return out[0].Interface(), nil
+}
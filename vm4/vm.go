@@ -1,17 +1,52 @@
 package vm4
 
 import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/vm/code"
+	"bachelor-thesis/vm/compiler"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
+// MaxCallDepth limits nested calls of user-defined functions, so a recursive
+// definition fails with an error instead of growing without bound.
+const MaxCallDepth = 1024
+
 type VM struct {
+	Limits       budget.Limits // bounds every Run, unlimited by default
 	constants    []interface{}
 	instructions code.Instructions
 	stack        []interface{}
 	stackInt     []int64
+	locals       []interface{}
+	frames       []frame
+	sp           int
+	wide         bool // the next operand follows OpWide
+}
+
+// onStackInt marks the elements of stack whose value is held in stackInt,
+// which tells an int64 apart from nil.
+type onStackInt struct{}
+
+func isInt(value interface{}) bool {
+	_, ok := value.(onStackInt)
+	return ok
+}
+
+// frame saves the caller's state while a user-defined function runs.
+type frame struct {
+	instructions code.Instructions
 	sp           int
+	locals       []interface{}
+}
+
+// iterator holds the loop variables of every iteration of a comprehension.
+type iterator struct {
+	entries [][]interface{}
+	pos     int
 }
 
 func New(instructions code.Instructions, constants []interface{}) *VM {
@@ -25,14 +60,20 @@ func New(instructions code.Instructions, constants []interface{}) *VM {
 }
 
 func (vm *VM) StackTop() interface{} {
-	if vm.stack[len(vm.stack)-1] != nil {
-		return vm.stack[len(vm.stack)-1]
-	} else {
+	if isInt(vm.stack[len(vm.stack)-1]) {
 		return vm.stackInt[len(vm.stackInt)-1]
 	}
+	return vm.stack[len(vm.stack)-1]
 }
 
 func (vm *VM) Run(env interface{}) error {
+	return vm.RunContext(context.Background(), env)
+}
+
+// RunContext is Run stopping with a *budget.InterruptedError once ctx is done,
+// checked every budget.CheckInterval instructions and around calls. Functions
+// of env taking a context.Context as first parameter receive ctx.
+func (vm *VM) RunContext(ctx context.Context, env interface{}) error {
 	if vm.stack == nil {
 		vm.stack = make([]interface{}, 0, 2)
 	} else {
@@ -43,18 +84,50 @@ func (vm *VM) Run(env interface{}) error {
 	} else {
 		vm.stackInt = vm.stackInt[0:0]
 	}
+	if len(vm.frames) > 0 {
+		// a previous run stopped inside a function
+		vm.instructions = vm.frames[0].instructions
+		vm.locals = vm.frames[0].locals
+		vm.frames = vm.frames[0:0]
+	}
+	vm.locals = vm.locals[0:0]
 	vm.sp = 0
+	vm.wide = false
+	limited := vm.Limits != budget.Limits{}
+	done := ctx.Done()
+	executed := 0
 	for vm.sp < len(vm.instructions) {
+		if limited || done != nil {
+			executed++
+			if err := vm.Limits.Step(executed, len(vm.stack)+len(vm.frames)); err != nil {
+				return err
+			}
+			if done != nil && executed%budget.CheckInterval == 0 {
+				if err := budget.Interrupted(ctx, vm.sp); err != nil {
+					return err
+				}
+			}
+		}
 		switch code.Opcode(vm.instructions[vm.sp]) {
 		case code.OpConstant:
-			constIndex := binary.BigEndian.Uint16(vm.instructions[vm.sp+1:])
-			vm.sp += 2
+			constIndex := vm.operand()
 			if int(constIndex) >= len(vm.constants) {
 				return fmt.Errorf("constant index out of range: %d", constIndex)
 			}
 			vm.push(vm.constants[constIndex])
 		case code.OpPop:
 			vm.pop()
+		case code.OpDup:
+			vm.stack = append(vm.stack, vm.stack[len(vm.stack)-1])
+			vm.stackInt = append(vm.stackInt, vm.stackInt[len(vm.stackInt)-1])
+		case code.OpSwap:
+			n := len(vm.stack)
+			vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-2]
+			vm.stackInt[n-2], vm.stackInt[n-1] = vm.stackInt[n-1], vm.stackInt[n-2]
+		case code.OpRot:
+			n := len(vm.stack)
+			vm.stack[n-3], vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-3], vm.stack[n-2]
+			vm.stackInt[n-3], vm.stackInt[n-2], vm.stackInt[n-1] = vm.stackInt[n-1], vm.stackInt[n-3], vm.stackInt[n-2]
 		case code.OpTrue:
 			vm.push(true)
 		case code.OpFalse:
@@ -64,21 +137,318 @@ func (vm *VM) Run(env interface{}) error {
 		case code.OpAdd:
 			a, ai := vm.pop()
 			b, bi := vm.pop()
-			if a == nil && b == nil {
-				vm.push(bi + ai)
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi + ai)
 			} else {
-				vm.push(vm.executeAddOperation(b, a))
+				sum := vm.executeAddOperation(box(b, bi), box(a, ai))
+				if s, ok := sum.(string); ok {
+					if err := vm.Limits.Concat(len(s)); err != nil {
+						return err
+					}
+				}
+				vm.push(sum)
 			}
 		case code.OpSub:
 			a, ai := vm.pop()
 			b, bi := vm.pop()
-			if a == nil && b == nil {
-				vm.push(bi - ai)
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi - ai)
+			} else {
+				vm.push(vm.executeSubtractOperation(box(b, bi), box(a, ai)))
+			}
+		case code.OpMul:
+			a, ai := vm.pop()
+			b, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi * ai)
+			} else {
+				vm.push(vm.executeMultiplyOperation(box(b, bi), box(a, ai)))
+			}
+		case code.OpDiv:
+			a, ai := vm.pop()
+			b, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi / ai)
+			} else {
+				vm.push(vm.executeDivideOperation(box(b, bi), box(a, ai)))
+			}
+		case code.OpMod:
+			a, ai := vm.pop()
+			b, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi % ai)
 			} else {
-				vm.push(vm.executeAddOperation(b, a))
+				vm.push(vm.executeRemainderOperation(box(b, bi), box(a, ai)))
+			}
+		case code.OpExp:
+			a, ai := vm.pop()
+			b, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.pushInt(int64(math.Pow(float64(bi), float64(ai))))
+			} else {
+				vm.push(vm.executeExponentiationOperation(box(b, bi), box(a, ai)))
 			}
 		case code.OpMinus:
 			vm.push(vm.executeMinusOperator())
+		case code.OpEqual, code.OpNotEqual, code.OpLessThan, code.OpGreaterThan, code.OpLessOrEqual, code.OpGreaterOrEqual:
+			opcode := code.Opcode(vm.instructions[vm.sp])
+			a, ai := vm.pop()
+			b, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.push(compareInts(opcode, bi, ai))
+			} else {
+				vm.push(vm.executeComparisonOperation(box(a, ai), box(b, bi), opcode))
+			}
+		case code.OpArray:
+			numElements := vm.operand()
+			if err := vm.Limits.Array(numElements); err != nil {
+				return err
+			}
+			array := make([]interface{}, numElements)
+			for i := numElements - 1; i >= 0; i-- {
+				array[i] = vm.popValue()
+			}
+			vm.push(array)
+		case code.OpIndex:
+			index := vm.popValue()
+			array := vm.popValue()
+			vm.executeIndexOperation(array, index)
+		case code.OpNot:
+			v := vm.popValue().(bool)
+			vm.push(!v)
+		case code.OpJumpIfTrue:
+			pos := vm.operand()
+			if vm.StackTop().(bool) {
+				vm.sp += pos
+			}
+		case code.OpJumpIfFalse:
+			pos := vm.operand()
+			if !vm.StackTop().(bool) {
+				vm.sp += pos
+			}
+		case code.OpJump:
+			pos := vm.operand()
+			vm.sp += pos
+		case code.OpLoop:
+			pos := vm.operand()
+			vm.sp -= pos
+		case code.OpGetLocal:
+			slot := vm.operand()
+			vm.push(vm.locals[slot])
+		case code.OpSetLocal:
+			slot := vm.operand()
+			for len(vm.locals) <= slot {
+				vm.locals = append(vm.locals, nil)
+			}
+			vm.locals[slot] = vm.StackTop()
+		case code.OpCallLocal:
+			numArgs := vm.operand()
+			function := vm.popValue().(*compiler.Function)
+			if len(vm.frames) >= MaxCallDepth {
+				return fmt.Errorf("maximum call depth %d exceeded in %s()", MaxCallDepth, function.Name)
+			}
+			locals := make([]interface{}, function.NumLocals)
+			for i := numArgs - 1; i >= 0; i-- {
+				locals[i] = vm.popValue()
+			}
+			vm.frames = append(vm.frames, frame{instructions: vm.instructions, sp: vm.sp, locals: vm.locals})
+			vm.instructions = function.Instructions
+			vm.locals = locals
+			vm.sp = -1
+		case code.OpReturn:
+			caller := vm.frames[len(vm.frames)-1]
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			vm.instructions = caller.instructions
+			vm.locals = caller.locals
+			vm.sp = caller.sp
+		case code.OpIterInit:
+			variables := vm.operand()
+			entries, err := builtin.Entries(vm.popValue(), variables)
+			if err != nil {
+				return err
+			}
+			vm.push(&iterator{entries: entries})
+		case code.OpIterNext:
+			pos := vm.operand()
+			it := vm.StackTop().(*iterator)
+			if it.pos == len(it.entries) {
+				vm.pop()
+				vm.sp += pos
+				break
+			}
+			for _, value := range it.entries[it.pos] {
+				vm.push(value)
+			}
+			it.pos++
+		case code.OpAppend:
+			value := vm.popValue()
+			n := len(vm.stack)
+			array := append(vm.stack[n-2].([]interface{}), value)
+			if err := vm.Limits.Array(len(array)); err != nil {
+				return err
+			}
+			vm.stack[n-2] = array
+		case code.OpBuiltin:
+			index := vm.operand()
+			value, err := builtin.Builtins[index].Call(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpIs:
+			constIndex := vm.operand()
+			vm.push(builtin.Is(vm.popValue(), vm.constants[constIndex].(string)))
+		case code.OpLoadConst:
+			value, err := builtin.Load(env, vm.constants[vm.operand()])
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpCall:
+			offset := vm.sp
+			numArgs := vm.operand()
+			fn := vm.popValue()
+			args := make([]interface{}, numArgs)
+			for i := numArgs - 1; i >= 0; i-- {
+				args[i] = vm.popValue()
+			}
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
+			value, err := call(ctx, fn, args)
+			if err != nil {
+				return err
+			}
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpPushInt:
+			constIndex := vm.operand()
+			vm.pushInt(vm.constants[constIndex].(int64))
+		case code.OpPushFloat:
+			constIndex := vm.operand()
+			vm.pushBoxed(vm.constants[constIndex])
+		case code.OpPushStr:
+			constIndex := vm.operand()
+			vm.pushBoxed(vm.constants[constIndex])
+		case code.OpAddInt:
+			a, b := vm.popInts()
+			vm.pushInt(a + b)
+		case code.OpSubInt:
+			a, b := vm.popInts()
+			vm.pushInt(a - b)
+		case code.OpMulInt:
+			a, b := vm.popInts()
+			vm.pushInt(a * b)
+		case code.OpDivInt:
+			a, b := vm.popInts()
+			vm.pushInt(a / b)
+		case code.OpModInt:
+			a, b := vm.popInts()
+			vm.pushInt(a % b)
+		case code.OpExpInt:
+			a, b := vm.popInts()
+			vm.pushInt(int64(math.Pow(float64(a), float64(b))))
+		case code.OpMinusInt:
+			vm.pushInt(-vm.popInt())
+		case code.OpAddFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(a + b)
+		case code.OpSubFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(a - b)
+		case code.OpMulFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(a * b)
+		case code.OpDivFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(a / b)
+		case code.OpExpFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(math.Pow(a, b))
+		case code.OpMinusFloat:
+			vm.pushFloat(-vm.popFloat())
+		case code.OpConcatStr:
+			a, b := vm.popStrings()
+			if err := vm.Limits.Concat(len(a) + len(b)); err != nil {
+				return err
+			}
+			vm.pushString(a + b)
+		case code.OpEqInt:
+			a, b := vm.popInts()
+			vm.push(a == b)
+		case code.OpNeInt:
+			a, b := vm.popInts()
+			vm.push(a != b)
+		case code.OpLtInt:
+			a, b := vm.popInts()
+			vm.push(a < b)
+		case code.OpGtInt:
+			a, b := vm.popInts()
+			vm.push(a > b)
+		case code.OpLeInt:
+			a, b := vm.popInts()
+			vm.push(a <= b)
+		case code.OpGeInt:
+			a, b := vm.popInts()
+			vm.push(a >= b)
+		case code.OpEqFloat:
+			a, b := vm.popFloats()
+			vm.push(a == b)
+		case code.OpNeFloat:
+			a, b := vm.popFloats()
+			vm.push(a != b)
+		case code.OpLtFloat:
+			a, b := vm.popFloats()
+			vm.push(a < b)
+		case code.OpGtFloat:
+			a, b := vm.popFloats()
+			vm.push(a > b)
+		case code.OpLeFloat:
+			a, b := vm.popFloats()
+			vm.push(a <= b)
+		case code.OpGeFloat:
+			a, b := vm.popFloats()
+			vm.push(a >= b)
+		case code.OpEqStr:
+			a, b := vm.popStrings()
+			vm.push(a == b)
+		case code.OpNeStr:
+			a, b := vm.popStrings()
+			vm.push(a != b)
+		case code.OpLtStr:
+			a, b := vm.popStrings()
+			vm.push(a < b)
+		case code.OpGtStr:
+			a, b := vm.popStrings()
+			vm.push(a > b)
+		case code.OpLeStr:
+			a, b := vm.popStrings()
+			vm.push(a <= b)
+		case code.OpGeStr:
+			a, b := vm.popStrings()
+			vm.push(a >= b)
+		case code.OpAsBool:
+			value, err := builtin.AsBool(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpAsInt:
+			value, err := builtin.AsInt64(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpAsFloat:
+			value, err := builtin.AsFloat64(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpWide:
+			vm.wide = true
 		default:
 			return fmt.Errorf("unsupported opcode: %d", code.Opcode(vm.instructions[vm.sp]))
 		}
@@ -87,11 +457,25 @@ func (vm *VM) Run(env interface{}) error {
 	return nil
 }
 
+// operand reads the operand of the current instruction and moves past it.
+// After OpWide the operand is four bytes instead of two.
+func (vm *VM) operand() int {
+	if vm.wide {
+		vm.wide = false
+		value := int(binary.BigEndian.Uint32(vm.instructions[vm.sp+1:]))
+		vm.sp += 4
+		return value
+	}
+	value := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
+	vm.sp += 2
+	return value
+}
+
 func (vm *VM) push(value interface{}) {
 	switch v := value.(type) {
 	case int64:
 		vm.stackInt = append(vm.stackInt, v)
-		vm.stack = append(vm.stack, nil)
+		vm.stack = append(vm.stack, onStackInt{})
 	default:
 		vm.stack = append(vm.stack, value)
 		vm.stackInt = append(vm.stackInt, 0)
@@ -105,3 +489,75 @@ func (vm *VM) pop() (interface{}, int64) {
 	vm.stack = vm.stack[:len(vm.stack)-1]
 	return value, valueInt
 }
+
+// popValue pops the top element and boxes it back from whichever stack holds it.
+func (vm *VM) popValue() interface{} {
+	return box(vm.pop())
+}
+
+func box(value interface{}, valueInt int64) interface{} {
+	if isInt(value) {
+		return valueInt
+	}
+	return value
+}
+
+// The typed instructions know which stack holds their operands.
+
+func (vm *VM) pushInt(value int64) {
+	vm.stackInt = append(vm.stackInt, value)
+	vm.stack = append(vm.stack, onStackInt{})
+}
+
+func (vm *VM) pushFloat(value float64) {
+	vm.pushBoxed(value)
+}
+
+func (vm *VM) pushString(value string) {
+	vm.pushBoxed(value)
+}
+
+// pushBoxed pushes a value already stored in an interface, such as a
+// constant, without boxing it again.
+func (vm *VM) pushBoxed(value interface{}) {
+	vm.stack = append(vm.stack, value)
+	vm.stackInt = append(vm.stackInt, 0)
+}
+
+func (vm *VM) drop() {
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	vm.stackInt = vm.stackInt[:len(vm.stackInt)-1]
+}
+
+func (vm *VM) popInt() int64 {
+	value := vm.stackInt[len(vm.stackInt)-1]
+	vm.drop()
+	return value
+}
+
+func (vm *VM) popFloat() float64 {
+	value := vm.stack[len(vm.stack)-1].(float64)
+	vm.drop()
+	return value
+}
+
+func (vm *VM) popString() string {
+	value := vm.stack[len(vm.stack)-1].(string)
+	vm.drop()
+	return value
+}
+
+func (vm *VM) popInts() (int64, int64) {
+	b := vm.popInt()
+	return vm.popInt(), b
+}
+
+func (vm *VM) popFloats() (float64, float64) {
+	b := vm.popFloat()
+	return vm.popFloat(), b
+}
+
+func (vm *VM) popStrings() (string, string) {
+	b := vm.popString()
+	return vm.popString(), b
+}
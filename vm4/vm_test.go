@@ -1,10 +1,15 @@
 package vm4
 
 import (
+	"bachelor-thesis/budget"
 	"bachelor-thesis/parser"
+	"bachelor-thesis/vm/code"
 	"bachelor-thesis/vm/compiler"
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -14,15 +19,157 @@ type vmTest struct {
 }
 
 var vmTests = []vmTest{
-	{"true", true},
 	{"false", false},
+	{"nil", nil},
 	{"1", int64(1)},
 	{"-1", int64(-1)},
+	{"+1", int64(1)},
+	{"+1.1", 1.1},
 	{"2.4", 2.4},
 	{"-2.4", -2.4},
 	{"1 + 2", int64(3)},
+	{"1 + 2.1", 3.1},
 	{"1 - 2", int64(-1)},
+	{"1.1 - 2.2", -1.1},
+	{"1 * 2", int64(2)},
+	{"1 * 2.1", 2.1},
+	{"2.1 * 1", 2.1},
+	{"4 / 2", int64(2)},
+	{"4.1 / 2", 2.05},
+	{"4 / 2.5", 1.6},
+	{"2 ^ 2", int64(4)},
+	{"2 ^ 2.0", 4.0},
+	{"2.1 ^ 2", 4.41},
+	{"2.0 ^ 2.0", 4.0},
+	{"5 % 2", int64(1)},
+	{"1 < 2", true},
+	{"1 < 1", false},
+	{"2 <= 2", true},
+	{"2.1 <= 2", false},
+	{"2.1 <= 1.2", false},
+	{"2 <= 1.2", false},
+	{"1 > 0.2", true},
+	{"1.1 > 0", true},
+	{"1.1 >= 2.1", false},
+	{"1 >= 2", false},
+	{"1.1 > 2.2", false},
+	{"1.2 >= 0.2", true},
+	{"1.1 == 1.1", true},
+	{"1 == 2", false},
+	{"1 == 1", true},
+	{"1 != 2", true},
+	{"1.1 != 1.2", true},
+	{"(1.1 + 2.1) * 4.1", 13.12},
+	{"1.2 + 3  < 4", false},
+	{"(1 + 2) * 4", int64(12)},
+	{"5 * 2 + 10", int64(20)},
+	{"5 + 2 * 10", int64(25)},
+	{"10 / 2 * 2 + 10 - 5", int64(15)},
+	{"5 * (2 + 10)", int64(60)},
 	{"-5 + 10 + -5", int64(0)},
+	{"2 * 2 * 2 * 2 * 2", int64(32)},
+	{"1 - 2 + 3 * 4 / 2 ^ 2 % 3", int64(-1)},
+	{"true == true", true},
+	{"true == false", false},
+	{"true != false", true},
+	{"(1 < 2) == true", true},
+	{"(1 < 2) == false", false},
+	{`"aaa" == "aaa"`, true},
+	{`"aaa" != "aab"`, true},
+	{`"aaa" == "aab"`, false},
+	{`"hello"`, "hello"},
+	{`"hello " + "world!"`, "hello world!"},
+	{"[]", []interface{}{}},
+	{"[1, 2, 3.1]", []interface{}{int64(1), int64(2), 3.1}},
+	{"[1 + 2, 2 * 3]", []interface{}{int64(3), int64(6)}},
+	{"[1, 2, 3][1]", int64(2)},
+	{"[1, 2, 3][1 + 1]", int64(3)},
+	{`["a", 2][0]`, "a"},
+	{`[1, "a", 3 + 5, "c"][1]`, "a"},
+	{"not true", false},
+	{"not false", true},
+	{"true or false", true},
+	{"false or false", false},
+	{"true and false", false},
+	{"false and false", false},
+	{`false or true`, true},
+	{"(5 > 2) and (2 <= 3) == true", true},
+	{"(1 > 2) or (2 >= 3) == false", true},
+	{`"abc" < "bcd"`, true},
+	{`"abc" <= "bcd"`, true},
+	{`"abcd" > "abc"`, true},
+	{`"abc" >= "abcd"`, false},
+	{`("rv" == "t") and ("dntxr" > "c") or ("ssjy" == "l") or ("snso" < "uox") and ("qym" < "qyi") and ("tvzew" < "i") or ("bv" <= "xw")`, true},
+	{`false and false or true`, true},
+	{`("qym" < "qyi") and ("tvzew" < "i") or ("bv" <= "xw")`, true},
+	{`("kt" >= "cwcg") and ("pppvp" > "xqqew") or ("geh" <= "wst") and ("je" != "wvvkr") or ("oejgc" < "obsjo") and ("r" != "ml") or ("bkyay" >= "hqdnn")`, true},
+	{"1 < 2 < 3", true},
+	{"1 < 3 < 2", false},
+	{"3 < 1 < 2", false},
+	{"1 < 2 <= 2 < 3", true},
+	{"3 > 2.5 >= 2 > 1", true},
+	{`"a" < "b" < "c"`, true},
+	{"1 < 2 == true", true},
+	{"1 == 1 == true", true},
+	{"2 > 1 != false", true},
+	{`if 1 < 2 then "a" else "b"`, "a"},
+	{`if 1 > 2 then "a" else "b"`, "b"},
+	{`if false then 1`, nil},
+	{`if 1 > 2 then "A" else if 1 > 0 then "B" else "C"`, "B"},
+	{`(if true then 1 else 2) + 10`, int64(11)},
+	{`case "warn" when "ok" then 1 when "warn" then 2 else 3 end`, int64(2)},
+	{`case "none" when "ok" then 1 when "warn" then 2 else 3 end`, int64(3)},
+	{`case 5 when 1 then "one" end`, nil},
+	{`case when 1 > 2 then "a" when 2 > 1 then "b" end`, "b"},
+	{`int("42") + 1`, int64(43)},
+	{`int(4.7)`, int64(4)},
+	{`float("1.5") * 2`, 3.0},
+	{`float(3)`, 3.0},
+	{`string(3) + "px"`, "3px"},
+	{`string(2.5)`, "2.5"},
+	{`bool("true") and true`, true},
+	{`bool(0)`, false},
+	{`"a" is string`, true},
+	{`1 is float`, false},
+	{`1.5 is float`, true},
+	{`[1] is array`, true},
+	{`1 + 2 is int and "a" is string`, true},
+	{`1; 2; 3`, int64(3)},
+	{`"a"; "b";`, "b"},
+	{`let x = 2; x * x`, int64(4)},
+	{`let x = 1; let x = x + 1; x`, int64(2)},
+	{`let s = "ab"; let n = 3; s + string(n)`, "ab3"},
+	{`let x = 5`, int64(5)},
+	{`[x * 2 for x in [1, -2, 3] if x > 0]`, []interface{}{int64(2), int64(6)}},
+	{`[i for i, x in ["a", "b"]]`, []interface{}{int64(0), int64(1)}},
+	{`[x for x in []]`, []interface{}{}},
+	{`[[y * x for y in [1, 2]] for x in [1, 10]]`, []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{int64(10), int64(20)}}},
+	{`let x = 0; [x for x in [1, 2]]; x`, int64(0)},
+	{`1 < 2 ? "a" : "b"`, "a"},
+	{`1 > 2 ? "a" : 2 > 1 ? "b" : "c"`, "b"},
+	{`fn sq(x) = x * x; sq(3) + sq(4)`, int64(25)},
+	{`fn double(xs) = [x * 2 for x in xs]; double([1, 2])`, []interface{}{int64(2), int64(4)}},
+	{`fn fact(n) = n <= 1 ? 1 : n * fact(n - 1); fact(5)`, int64(120)},
+	{`fn clamp(x, lo, hi) = x < lo ? lo : (x > hi ? hi : x); [clamp(-1, 0, 10), clamp(5, 0, 10), clamp(11, 0, 10)]`, []interface{}{int64(0), int64(5), int64(10)}},
+	{`fn one() = 1; let x = one(); x + one()`, int64(2)},
+}
+
+var typedVMTests = []vmTest{
+	{"1", int64(1)},
+	{"-1", int64(-1)},
+	{"-2.4", -2.4},
+	{"1 + 2 * 3 - 4", int64(3)},
+	{"7 / 2", int64(3)},
+	{"7 % 4", int64(3)},
+	{"2 ^ 10", int64(1024)},
+	{"1.5 * 2.0 - 0.5 / 0.25", 1.0},
+	{"2.0 ^ 0.5 < 1.5", true},
+	{`"a" + "b" + "c"`, "abc"},
+	{`"abc" < "abd"`, true},
+	{`"a" != "a"`, false},
+	{"1 + 2 == 3", true},
+	{"2.5 >= 2.5", true},
+	{"3 > 4", false},
 }
 
 func TestVM(t *testing.T) {
@@ -38,6 +185,18 @@ func TestVM(t *testing.T) {
 	}
 }
 
+func TestTypedVM(t *testing.T) {
+	for _, test := range append(typedVMTests, vmTests...) {
+		tree := parser.Parse(test.input)
+		program, err := compiler.Compile(tree, compiler.Typed(nil))
+		require.NoError(t, err, test.input)
+		vm := New(program.Instructions, program.Constants)
+		err = vm.Run(nil)
+		require.NoError(t, err, test.input)
+		testExpectedObject(t, test.expected, vm.StackTop())
+	}
+}
+
 func testExpectedObject(
 	t *testing.T,
 	expected interface{},
@@ -48,3 +207,160 @@ func testExpectedObject(
 		assert.Equal(t, expected, actual)
 	}
 }
+
+type vmTestWithEnvironment struct {
+	input    string
+	env      interface{}
+	expected interface{}
+}
+
+var vmTestsWithEnvironment = []vmTestWithEnvironment{
+	{`foo("world")`,
+		map[string]interface{}{"foo": func(input string) string { return "hello " + input }},
+		"hello world",
+	},
+	{`add(1, 2)`,
+		map[string]interface{}{"add": func(a, b int64) int64 { return a + b }},
+		int64(3),
+	},
+	{`a + b`,
+		map[string]interface{}{"a": 1.2, "b": 2.3},
+		3.5,
+	},
+	{`a and b and not c`,
+		map[string]interface{}{"a": false, "b": true, "c": false},
+		false,
+	},
+	{`a + b + add(1, 2)`,
+		map[string]interface{}{"a": 1.2, "b": 2.3, "add": func(a, b int64) int64 { return a + b }},
+		6.5,
+	},
+	{`0 < x <= 10`,
+		map[string]interface{}{"x": int64(10)},
+		true,
+	},
+	{`0 < x <= 10`,
+		map[string]interface{}{"x": int64(11)},
+		false,
+	},
+	{`if score > 90 then "A" else if score > 80 then "B" else "C"`,
+		map[string]interface{}{"score": int64(85)},
+		"B",
+	},
+	{`case status when "ok" then 1 when "warn" then fail() else fail() end`,
+		map[string]interface{}{"status": "ok", "fail": func() int64 { panic("branch must not be evaluated") }},
+		int64(1),
+	},
+	{`if flag then 1 else fail()`,
+		map[string]interface{}{"flag": true, "fail": func() int64 { panic("branch must not be evaluated") }},
+		int64(1),
+	},
+	{`let total = a + b; total * 2`,
+		map[string]interface{}{"a": 1.5, "b": 2.5},
+		8.0,
+	},
+	{`let a = a * 2; a + 1`,
+		map[string]interface{}{"a": int64(5)},
+		int64(11),
+	},
+	{`[k + "=" + string(v) for k, v in m if v > 1]`,
+		map[string]interface{}{"m": map[string]interface{}{"c": int64(3), "a": int64(1), "b": int64(2)}},
+		[]interface{}{"b=2", "c=3"},
+	},
+	{`[k for k in m]`,
+		map[string]interface{}{"m": map[string]interface{}{"b": 1.0, "a": 2.0}},
+		[]interface{}{"a", "b"},
+	},
+	{`[x / 2 for x in xs]`,
+		map[string]interface{}{"xs": []float64{1, 3}},
+		[]interface{}{0.5, 1.5},
+	},
+	{`fn clamp(x, lo, hi) = x < lo ? lo : (x > hi ? hi : x); clamp(a, 0, 10)`,
+		map[string]interface{}{"a": int64(42)},
+		int64(10),
+	},
+}
+
+func TestVMWithEnvironment(t *testing.T) {
+	for _, test := range vmTestsWithEnvironment {
+		tree := parser.Parse(test.input)
+		program, err := compiler.Compile(tree)
+		vm := New(program.Instructions, program.Constants)
+		err = vm.Run(test.env)
+		require.NoError(t, err, test.input)
+		stackElem := vm.StackTop()
+		testExpectedObject(t, test.expected, stackElem)
+	}
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	program, err := compiler.Compile(parser.Parse(`fn f(x) = f(x + 1); f(0)`))
+	require.NoError(t, err)
+	vm := New(program.Instructions, program.Constants)
+	err = vm.Run(nil)
+	assert.EqualError(t, err, "maximum call depth 1024 exceeded in f()")
+}
+
+// TestWideOperands runs programs with more than 65536 constants and jumps over
+// more than 64KB of instructions, which need wide operands.
+func TestWideOperands(t *testing.T) {
+	terms := make([]string, 100000)
+	for i := range terms {
+		terms[i] = fmt.Sprint(i)
+	}
+	sum := strings.Join(terms, " + ")
+	for _, test := range []vmTest{
+		{sum, int64(100000 * 99999 / 2)},
+		{"true ? " + sum + " : 0", int64(100000 * 99999 / 2)},
+		{"false ? " + sum + " : 0", int64(0)},
+	} {
+		program, err := compiler.Compile(parser.Parse(test.input))
+		require.NoError(t, err)
+		vm := New(program.Instructions, program.Constants)
+		err = vm.Run(nil)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, vm.StackTop())
+	}
+}
+
+// TestLimits runs one limited program, the engine package tests every limit
+// on every machine.
+func TestLimits(t *testing.T) {
+	for _, options := range [][]compiler.Option{nil, {compiler.Typed(nil)}} {
+		program, err := compiler.Compile(parser.Parse(`1 + (2 + (3 + 4))`), options...)
+		require.NoError(t, err)
+		vm := New(program.Instructions, program.Constants)
+		vm.Limits = budget.Limits{StackDepth: 3}
+		assert.Equal(t, &budget.StackDepthError{Limit: 3}, vm.Run(nil))
+	}
+}
+
+type contextKey struct{}
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey{}, int64(10)))
+	defer cancel()
+	env := map[string]interface{}{
+		"get":  func(ctx context.Context, x int64) int64 { return ctx.Value(contextKey{}).(int64) + x },
+		"stop": func(x int64) int64 { cancel(); return x },
+	}
+	program, err := compiler.Compile(parser.Parse(`get(1)`))
+	require.NoError(t, err)
+	vm := New(program.Instructions, program.Constants)
+	require.NoError(t, vm.RunContext(ctx, env))
+	assert.Equal(t, int64(11), vm.StackTop())
+
+	program, err = compiler.Compile(parser.Parse(`stop(1) + get(1)`))
+	require.NoError(t, err)
+	err = New(program.Instructions, program.Constants).RunContext(ctx, env)
+	var interrupted *budget.InterruptedError
+	require.ErrorAs(t, err, &interrupted)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, code.OpCall, code.Opcode(program.Instructions[interrupted.Offset]))
+
+	// without calls the context is checked every budget.CheckInterval instructions
+	program, err = compiler.Compile(parser.Parse(strings.Repeat("1 + ", budget.CheckInterval) + "1"))
+	require.NoError(t, err)
+	err = New(program.Instructions, program.Constants).RunContext(ctx, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
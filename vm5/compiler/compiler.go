@@ -0,0 +1,788 @@
+package compiler
+
+import (
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/checker"
+	"bachelor-thesis/parser/ast"
+	"bachelor-thesis/vm5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var (
+	intType    = reflect.TypeOf(int64(0))
+	floatType  = reflect.TypeOf(float64(0))
+	stringType = reflect.TypeOf("")
+	boolType   = reflect.TypeOf(true)
+)
+
+// expectedTypes are the static result types accepted by each result check.
+var expectedTypes = map[int][]reflect.Type{
+	vm5.OpAsBool:  {boolType},
+	vm5.OpAsInt:   {intType},
+	vm5.OpAsFloat: {floatType, intType},
+}
+
+var binaryOpcodes = map[string]int{
+	"+":  vm5.OpAdd,
+	"-":  vm5.OpSub,
+	"*":  vm5.OpMul,
+	"/":  vm5.OpDiv,
+	"%":  vm5.OpMod,
+	"^":  vm5.OpExp,
+	"==": vm5.OpEqual,
+	"!=": vm5.OpNotEqual,
+	"<":  vm5.OpLessThan,
+	">":  vm5.OpGreaterThan,
+	"<=": vm5.OpLessOrEqual,
+	">=": vm5.OpGreaterOrEqual,
+}
+
+// Compiler lowers a tree to vm5 bytecode. Every expression is computed into
+// a register taken from the 16 registers of the machine. An operand waiting
+// for its sibling is held, and a held operand is spilled to a local slot
+// when the registers run out, to be loaded back when it is used.
+type Compiler struct {
+	instructions []byte
+	constants    []interface{}
+	constantPool map[interface{}]int
+	registers    [16]bool
+	held         []*operand
+	locals       map[string]int
+	functions    map[string]int
+	slots        []bool
+	expect       int
+	fields       map[string]*builtin.Field
+	mode         builtin.Mode
+	types        checker.Types
+	err          error
+}
+
+// Option configures Compile.
+type Option func(compiler *Compiler)
+
+// AsBool, AsInt64 and AsFloat64 require the program to produce a value of
+// that type, as the options of the stack compiler do.
+func AsBool() Option {
+	return func(compiler *Compiler) { compiler.expect = vm5.OpAsBool }
+}
+
+func AsInt64() Option {
+	return func(compiler *Compiler) { compiler.expect = vm5.OpAsInt }
+}
+
+func AsFloat64() Option {
+	return func(compiler *Compiler) { compiler.expect = vm5.OpAsFloat }
+}
+
+// Env resolves the fields and methods of a struct environment at compile time,
+// as the option of the stack compiler does.
+func Env(env interface{}) Option {
+	return func(compiler *Compiler) { compiler.fields = builtin.FieldsOf(env) }
+}
+
+// Mode sets what a name missing from the environment evaluates to, as the
+// option of the stack compiler does.
+func Mode(mode builtin.Mode) Option {
+	return func(compiler *Compiler) { compiler.mode = mode }
+}
+
+// operand is a value held in a register or spilled to a slot.
+type operand struct {
+	register byte
+	slot     int
+	spilled  bool
+}
+
+func Compile(node ast.Node, options ...Option) (program *vm5.Program, err error) {
+	compiler := &Compiler{
+		constantPool: make(map[interface{}]int),
+		locals:       make(map[string]int),
+		functions:    make(map[string]int),
+	}
+	for _, option := range options {
+		option(compiler)
+	}
+	// The types known without an environment select OpStringConcat for + and
+	// reject a result of the wrong type before running. They are kept aside,
+	// the tree may be compiled by other goroutines at the same time.
+	types, err := checker.InferTypes(node, reflect.TypeOf(map[string]interface{}{}))
+	compiler.types = types
+	if err == nil && compiler.expect != 0 {
+		if err := checkResult(types[node], compiler.expect); err != nil {
+			return nil, err
+		}
+	}
+	result := compiler.compile(node)
+	if result != vm5.ResultRegister {
+		compiler.emit(vm5.OpMove, vm5.ResultRegister, int(result))
+	}
+	if compiler.expect != 0 {
+		compiler.emit(compiler.expect, vm5.ResultRegister)
+	}
+	if compiler.err != nil {
+		return nil, compiler.err
+	}
+	return &vm5.Program{
+		Instructions: compiler.instructions,
+		Constants:    compiler.constants,
+	}, nil
+}
+
+func checkResult(t reflect.Type, expect int) error {
+	if t.Kind() == reflect.Interface {
+		return nil
+	}
+	for _, expected := range expectedTypes[expect] {
+		if t == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected %s result, got %s", expectedTypes[expect][0], t)
+}
+
+// compile emits the instructions computing node and returns the register
+// holding its value, which the caller frees.
+func (compiler *Compiler) compile(node ast.Node) byte {
+	switch node := node.(type) {
+	case *ast.NumberNode:
+		return compiler.NodeNumber(node)
+	case *ast.StringNode:
+		register := compiler.alloc()
+		compiler.emitIndex(vm5.OpStoreString, register, compiler.addConstant(node.Value))
+		return register
+	case *ast.BoolNode:
+		register := compiler.alloc()
+		value := 0
+		if node.Value {
+			value = 1
+		}
+		compiler.emit(vm5.OpStoreBool, int(register), value)
+		return register
+	case *ast.NilNode:
+		register := compiler.alloc()
+		compiler.emit(vm5.OpStoreNil, int(register))
+		return register
+	case *ast.IdentifierNode:
+		return compiler.NodeIdentifier(node)
+	case *ast.UnaryNode:
+		return compiler.NodeUnary(node)
+	case *ast.BinaryNode:
+		return compiler.NodeBinary(node)
+	case *ast.ChainNode:
+		return compiler.NodeChain(node)
+	case *ast.ConditionalNode:
+		return compiler.NodeConditional(node)
+	case *ast.CaseNode:
+		return compiler.NodeCase(node)
+	case *ast.CallNode:
+		return compiler.NodeCall(node)
+	case *ast.ProgramNode:
+		return compiler.NodeProgram(node)
+	case *ast.LetNode:
+		return compiler.NodeLet(node)
+	case *ast.ArrayNode:
+		return compiler.NodeArray(node)
+	case *ast.MemberNode:
+		return compiler.NodeMember(node)
+	case *ast.IsNode:
+		return compiler.NodeIs(node)
+	case *ast.ComprehensionNode:
+		return compiler.NodeComprehension(node)
+	case *ast.FunctionNode:
+		compiler.NodeFunction(node)
+		return compiler.compileOrNil(nil)
+	}
+	compiler.fail(fmt.Errorf("vm5 cannot compile %T at position %d", node, node.Pos()))
+	return 0
+}
+
+func (compiler *Compiler) NodeNumber(node *ast.NumberNode) byte {
+	register := compiler.alloc()
+	if node.IsInt {
+		compiler.emitIndex(vm5.OpStoreInt, register, compiler.addConstant(node.Int64))
+	} else {
+		compiler.emitIndex(vm5.OpStoreFloat, register, compiler.addConstant(node.Float64))
+	}
+	return register
+}
+
+// NodeIdentifier reads a `let` binding from its slot and anything else from
+// the environment.
+func (compiler *Compiler) NodeIdentifier(node *ast.IdentifierNode) byte {
+	register := compiler.alloc()
+	if slot, ok := compiler.locals[node.Value]; ok {
+		compiler.emitIndex(vm5.OpLoadLocal, register, slot)
+	} else {
+		compiler.emitIndex(vm5.OpLoadConst, register, compiler.name(node, false))
+	}
+	return register
+}
+
+// name adds the constant naming an identifier, or a callee, of the
+// environment: the field resolved by Env when there is one.
+func (compiler *Compiler) name(node *ast.IdentifierNode, function bool) int {
+	if field, ok := compiler.fields[node.Value]; ok {
+		return compiler.addConstant(field)
+	}
+	if compiler.mode != builtin.Zero {
+		return compiler.addConstant(builtin.Identifier{
+			Name:     node.Value,
+			Pos:      node.Pos(),
+			Mode:     compiler.mode,
+			Function: function,
+		})
+	}
+	return compiler.addConstant(node.Value)
+}
+
+// NodeUnary computes the operation in the register of its operand.
+func (compiler *Compiler) NodeUnary(node *ast.UnaryNode) byte {
+	register := compiler.compile(node.Node)
+	switch node.Operator {
+	case "-":
+		compiler.emit(vm5.OpMinus, int(register), int(register))
+	case "not":
+		compiler.emit(vm5.OpNot, int(register), int(register))
+	}
+	return register
+}
+
+func (compiler *Compiler) NodeBinary(node *ast.BinaryNode) byte {
+	switch node.Operator {
+	case "and":
+		return compiler.shortCircuit(vm5.OpJumpIfFalse, node)
+	case "or":
+		return compiler.shortCircuit(vm5.OpJumpIfTrue, node)
+	}
+	op, ok := binaryOpcodes[node.Operator]
+	if !ok {
+		compiler.fail(fmt.Errorf("vm5 cannot compile operator %s at position %d", node.Operator, node.Pos()))
+		return 0
+	}
+	if node.Operator == "+" && (compiler.types[node.Left] == stringType || compiler.types[node.Right] == stringType) {
+		op = vm5.OpStringConcat
+	}
+	left := compiler.hold(compiler.compile(node.Left))
+	right := compiler.compile(node.Right)
+	result := compiler.release(left)
+	compiler.emit(op, int(result), int(result), int(right))
+	compiler.free(right)
+	return result
+}
+
+// shortCircuit leaves the left value in the result register when it decides
+// the operation and moves the right value there otherwise.
+func (compiler *Compiler) shortCircuit(jump int, node *ast.BinaryNode) byte {
+	result := compiler.compile(node.Left)
+	compiler.spillHeld()
+	end := compiler.emitJump(jump, result)
+	right := compiler.compile(node.Right)
+	compiler.emit(vm5.OpMove, int(result), int(right))
+	compiler.free(right)
+	compiler.patchJump(end)
+	return result
+}
+
+// NodeChain compares the operands pairwise and stops at the first false
+// comparison, every operand is computed once.
+func (compiler *Compiler) NodeChain(node *ast.ChainNode) byte {
+	var ends []int
+	result := compiler.alloc()
+	left := compiler.compile(node.Operands[0])
+	for i, operator := range node.Operators {
+		if i > 0 {
+			compiler.spillHeld()
+			ends = append(ends, compiler.emitJump(vm5.OpJumpIfFalse, result))
+		}
+		held := compiler.hold(left)
+		right := compiler.compile(node.Operands[i+1])
+		left = compiler.release(held)
+		compiler.emit(binaryOpcodes[operator], int(result), int(left), int(right))
+		compiler.free(left)
+		left = right
+	}
+	compiler.free(left)
+	for _, end := range ends {
+		compiler.patchJump(end)
+	}
+	return result
+}
+
+func (compiler *Compiler) NodeConditional(node *ast.ConditionalNode) byte {
+	condition := compiler.compile(node.Condition)
+	compiler.spillHeld()
+	otherwise := compiler.emitJump(vm5.OpJumpIfFalse, condition)
+	compiler.free(condition)
+	result := compiler.compile(node.Then)
+	end := compiler.emitJump(vm5.OpJump)
+	compiler.patchJump(otherwise)
+	value := compiler.compileOrNil(node.Else)
+	compiler.emit(vm5.OpMove, int(result), int(value))
+	compiler.free(value)
+	compiler.patchJump(end)
+	return result
+}
+
+// NodeCase compares the subject with each condition in turn, the subject
+// is kept in a slot so that every comparison can load it.
+func (compiler *Compiler) NodeCase(node *ast.CaseNode) byte {
+	subject := -1
+	if node.Subject != nil {
+		register := compiler.compile(node.Subject)
+		subject = compiler.newSlot()
+		compiler.emitSlot(vm5.OpStoreLocal, subject, register)
+		compiler.free(register)
+	}
+	compiler.spillHeld()
+	result := compiler.alloc()
+	var ends []int
+	for i, condition := range node.Conditions {
+		value := compiler.compile(condition)
+		if subject >= 0 {
+			register := compiler.alloc()
+			compiler.emitIndex(vm5.OpLoadLocal, register, subject)
+			compiler.emit(vm5.OpEqual, int(value), int(register), int(value))
+			compiler.free(register)
+		}
+		next := compiler.emitJump(vm5.OpJumpIfFalse, value)
+		compiler.free(value)
+		value = compiler.compile(node.Results[i])
+		compiler.emit(vm5.OpMove, int(result), int(value))
+		compiler.free(value)
+		ends = append(ends, compiler.emitJump(vm5.OpJump))
+		compiler.patchJump(next)
+	}
+	value := compiler.compileOrNil(node.Else)
+	compiler.emit(vm5.OpMove, int(result), int(value))
+	compiler.free(value)
+	for _, end := range ends {
+		compiler.patchJump(end)
+	}
+	if subject >= 0 {
+		compiler.slots[subject] = false
+	}
+	return result
+}
+
+func (compiler *Compiler) compileOrNil(node ast.Node) byte {
+	if node == nil {
+		register := compiler.alloc()
+		compiler.emit(vm5.OpStoreNil, int(register))
+		return register
+	}
+	return compiler.compile(node)
+}
+
+// NodeCall calls a user-defined function, a builtin or a function of the
+// environment with the arguments loaded into registers, the result replaces
+// the first argument. More arguments than fit in one instruction are
+// collected into an array, as NodeArray does, replaced by the result.
+func (compiler *Compiler) NodeCall(node *ast.CallNode) byte {
+	callee, ok := node.Callee.(*ast.IdentifierNode)
+	if !ok {
+		compiler.fail(fmt.Errorf("vm5 cannot compile call at position %d", node.Pos()))
+		return 0
+	}
+	if index, ok := compiler.functions[callee.Value]; ok {
+		function := compiler.constants[index].(*vm5.Function)
+		if len(node.Arguments) != function.NumParameters {
+			compiler.fail(fmt.Errorf("%s() expects %d arguments, got %d", callee.Value, function.NumParameters, len(node.Arguments)))
+			return 0
+		}
+		if len(node.Arguments) > maxArrayOperands {
+			array := compiler.NodeArray(&ast.ArrayNode{Nodes: node.Arguments})
+			compiler.emitIndex(vm5.OpCallLocalArray, array, index, int(array))
+			return array
+		}
+		result, registers := compiler.arguments(node.Arguments)
+		compiler.emitIndex(vm5.OpCallLocal, result, index, append([]int{len(registers)}, registers...)...)
+		return result
+	}
+	if index, ok := builtin.Lookup(callee.Value); ok {
+		if len(node.Arguments) != 1 {
+			compiler.fail(fmt.Errorf("%s() expects 1 argument, got %d", callee.Value, len(node.Arguments)))
+			return 0
+		}
+		register := compiler.compile(node.Arguments[0])
+		compiler.emit(vm5.OpBuiltin, int(register), index, int(register))
+		return register
+	}
+	if len(node.Arguments) > maxArrayOperands {
+		array := compiler.NodeArray(&ast.ArrayNode{Nodes: node.Arguments})
+		compiler.emitIndex(vm5.OpCallArray, array, compiler.name(callee, true), int(array))
+		return array
+	}
+	result, registers := compiler.arguments(node.Arguments)
+	name := compiler.name(callee, true)
+	compiler.emitIndex(vm5.OpCall, result, name, append([]int{len(registers)}, registers...)...)
+	return result
+}
+
+// arguments loads the arguments of a call into registers and returns the
+// register of the result, all other registers are free after the call.
+func (compiler *Compiler) arguments(nodes []ast.Node) (byte, []int) {
+	arguments := make([]*operand, len(nodes))
+	for i, argument := range nodes {
+		arguments[i] = compiler.hold(compiler.compile(argument))
+	}
+	registers := make([]int, len(arguments))
+	for i, argument := range arguments {
+		registers[i] = int(compiler.release(argument))
+	}
+	if len(registers) == 0 {
+		return compiler.alloc(), registers
+	}
+	for _, register := range registers[1:] {
+		compiler.free(byte(register))
+	}
+	return byte(registers[0]), registers
+}
+
+// maxArrayOperands is the number of elements added to an array by one
+// instruction, longer arrays are built with OpArray and then OpAppend.
+const maxArrayOperands = 8
+
+func (compiler *Compiler) NodeArray(node *ast.ArrayNode) byte {
+	var array *operand
+	for start := 0; start == 0 || start < len(node.Nodes); start += maxArrayOperands {
+		end := start + maxArrayOperands
+		if end > len(node.Nodes) {
+			end = len(node.Nodes)
+		}
+		elements := make([]*operand, 0, end-start)
+		for _, element := range node.Nodes[start:end] {
+			elements = append(elements, compiler.hold(compiler.compile(element)))
+		}
+		registers := make([]int, len(elements))
+		for i, element := range elements {
+			registers[i] = int(compiler.release(element))
+		}
+		var result byte
+		if array == nil {
+			result = compiler.alloc()
+			compiler.emit(vm5.OpArray, append([]int{int(result), len(registers)}, registers...)...)
+		} else {
+			result = compiler.release(array)
+			compiler.emit(vm5.OpAppend, append([]int{int(result), len(registers)}, registers...)...)
+		}
+		for _, register := range registers {
+			compiler.free(byte(register))
+		}
+		array = compiler.hold(result)
+	}
+	return compiler.release(array)
+}
+
+func (compiler *Compiler) NodeMember(node *ast.MemberNode) byte {
+	array := compiler.hold(compiler.compile(node.Node))
+	index := compiler.compile(node.Property)
+	result := compiler.release(array)
+	compiler.emit(vm5.OpIndex, int(result), int(result), int(index))
+	compiler.free(index)
+	return result
+}
+
+func (compiler *Compiler) NodeIs(node *ast.IsNode) byte {
+	register := compiler.compile(node.Node)
+	index := compiler.addConstant(node.TypeName)
+	if index > math.MaxUint8 {
+		compiler.emit(vm5.OpWide)
+	}
+	compiler.emit(vm5.OpIs, int(register), int(register))
+	compiler.appendIndex(index)
+	return register
+}
+
+// NodeProgram frees the value of every statement but the last one.
+// Function definitions produce no value.
+func (compiler *Compiler) NodeProgram(node *ast.ProgramNode) byte {
+	computed := false
+	var result byte
+	for _, statement := range node.Statements {
+		if function, ok := statement.(*ast.FunctionNode); ok {
+			compiler.NodeFunction(function)
+			continue
+		}
+		if computed {
+			compiler.free(result)
+		}
+		result = compiler.compile(statement)
+		computed = true
+	}
+	if !computed {
+		return compiler.compileOrNil(nil)
+	}
+	return result
+}
+
+// NodeFunction compiles the body with its own registers and slots into a
+// Function constant, the parameters are in the first slots. The name is
+// registered first so the body can call itself.
+func (compiler *Compiler) NodeFunction(node *ast.FunctionNode) {
+	function := &vm5.Function{Name: node.Name, NumParameters: len(node.Parameters)}
+	compiler.functions[node.Name] = compiler.addConstant(function)
+	body := &Compiler{
+		constants:    compiler.constants,
+		constantPool: compiler.constantPool,
+		locals:       make(map[string]int),
+		functions:    compiler.functions,
+		slots:        make([]bool, len(node.Parameters)),
+		fields:       compiler.fields,
+		mode:         compiler.mode,
+		types:        compiler.types,
+	}
+	for i, parameter := range node.Parameters {
+		body.locals[parameter] = i
+		body.slots[i] = true
+	}
+	body.emit(vm5.OpReturn, int(body.compile(node.Body)))
+	compiler.constants = body.constants
+	if body.err != nil {
+		compiler.fail(body.err)
+	}
+	function.Instructions = body.instructions
+}
+
+// NodeComprehension appends to the array in its result register while the
+// iterator yields entries. OpIterNext jumps past the loop once the
+// collection is exhausted and OpLoop jumps back to it.
+func (compiler *Compiler) NodeComprehension(node *ast.ComprehensionNode) byte {
+	compiler.spillHeld()
+	result := compiler.alloc()
+	compiler.emit(vm5.OpArray, int(result), 0)
+	it := compiler.compile(node.Collection)
+	compiler.emit(vm5.OpIterInit, int(it), int(it), len(node.Variables))
+
+	outer := make(map[string]int, len(compiler.locals))
+	for name, slot := range compiler.locals {
+		outer[name] = slot
+	}
+	slots := make([]int, len(node.Variables))
+	for i, name := range node.Variables {
+		slots[i] = compiler.newSlot()
+		compiler.locals[name] = slots[i]
+	}
+
+	loop := len(compiler.instructions)
+	end := compiler.emitJump(vm5.OpIterNext, it)
+	for i, slot := range slots {
+		register := compiler.alloc()
+		compiler.emit(vm5.OpIterValue, int(register), int(it), i)
+		compiler.emitSlot(vm5.OpStoreLocal, slot, register)
+		compiler.free(register)
+	}
+	skip := -1
+	if node.Condition != nil {
+		condition := compiler.compile(node.Condition)
+		skip = compiler.emitJump(vm5.OpJumpIfFalse, condition)
+		compiler.free(condition)
+	}
+	element := compiler.compile(node.Element)
+	compiler.emit(vm5.OpAppend, int(result), 1, int(element))
+	compiler.free(element)
+	if skip >= 0 {
+		compiler.patchJump(skip)
+	}
+	compiler.emitLoop(loop)
+	compiler.patchJump(end)
+
+	compiler.free(it)
+	for _, slot := range slots {
+		compiler.slots[slot] = false
+	}
+	compiler.locals = outer
+	return result
+}
+
+// NodeLet stores the value in a slot of its own, the name is bound after
+// the value is computed so `let x = x + 1` reads x from the environment.
+func (compiler *Compiler) NodeLet(node *ast.LetNode) byte {
+	value := compiler.compile(node.Value)
+	slot := compiler.newSlot()
+	compiler.emitSlot(vm5.OpStoreLocal, slot, value)
+	compiler.locals[node.Name] = slot
+	return value
+}
+
+// alloc returns a free register, spilling the oldest held operand still in
+// a register when there is none.
+func (compiler *Compiler) alloc() byte {
+	for register, used := range compiler.registers {
+		if !used {
+			compiler.registers[register] = true
+			return byte(register)
+		}
+	}
+	for _, held := range compiler.held {
+		if !held.spilled {
+			compiler.spill(held)
+			compiler.registers[held.register] = true
+			return held.register
+		}
+	}
+	compiler.fail(fmt.Errorf("expression needs more than %d registers", len(compiler.registers)))
+	return 0
+}
+
+func (compiler *Compiler) free(register byte) {
+	compiler.registers[register] = false
+}
+
+func (compiler *Compiler) hold(register byte) *operand {
+	held := &operand{register: register}
+	compiler.held = append(compiler.held, held)
+	return held
+}
+
+// release returns the register of a held operand, loading it back first
+// when it was spilled.
+func (compiler *Compiler) release(held *operand) byte {
+	for i, h := range compiler.held {
+		if h == held {
+			compiler.held = append(compiler.held[:i], compiler.held[i+1:]...)
+			break
+		}
+	}
+	if !held.spilled {
+		return held.register
+	}
+	register := compiler.alloc()
+	compiler.emitIndex(vm5.OpLoadLocal, register, held.slot)
+	compiler.slots[held.slot] = false
+	return register
+}
+
+func (compiler *Compiler) spill(held *operand) {
+	held.slot = compiler.newSlot()
+	held.spilled = true
+	compiler.emitSlot(vm5.OpStoreLocal, held.slot, held.register)
+	compiler.free(held.register)
+}
+
+// spillHeld spills all held operands before instructions that may be
+// skipped at runtime, so the operands are in their slots whichever way the
+// program went.
+func (compiler *Compiler) spillHeld() {
+	for _, held := range compiler.held {
+		if !held.spilled {
+			compiler.spill(held)
+		}
+	}
+}
+
+func (compiler *Compiler) newSlot() int {
+	for slot, used := range compiler.slots {
+		if !used {
+			compiler.slots[slot] = true
+			return slot
+		}
+	}
+	compiler.slots = append(compiler.slots, true)
+	return len(compiler.slots) - 1
+}
+
+// addConstant returns the index of constant in the pool, adding it when it is
+// not there yet, as the stack compiler does.
+func (compiler *Compiler) addConstant(constant interface{}) int {
+	if index, ok := compiler.constantPool[poolKey(constant)]; ok {
+		return index
+	}
+	compiler.constants = append(compiler.constants, constant)
+	compiler.constantPool[poolKey(constant)] = len(compiler.constants) - 1
+	return len(compiler.constants) - 1
+}
+
+// floatBits keys a float constant by its bits, keeping 0.0 apart from -0.0.
+type floatBits uint64
+
+func poolKey(constant interface{}) interface{} {
+	if f, ok := constant.(float64); ok {
+		return floatBits(math.Float64bits(f))
+	}
+	return constant
+}
+
+func (compiler *Compiler) emit(op int, operands ...int) {
+	compiler.instructions = append(compiler.instructions, byte(op))
+	for _, operand := range operands {
+		compiler.instructions = append(compiler.instructions, byte(operand))
+	}
+}
+
+// emitIndex emits an instruction whose register operand is followed by a
+// constant index or slot, prefixed with OpWide when the index does not fit
+// in a byte.
+func (compiler *Compiler) emitIndex(op int, register byte, index int, operands ...int) {
+	if index > math.MaxUint8 {
+		compiler.emit(vm5.OpWide)
+	}
+	compiler.emit(op, int(register))
+	compiler.appendIndex(index)
+	for _, operand := range operands {
+		compiler.instructions = append(compiler.instructions, byte(operand))
+	}
+}
+
+// emitSlot emits OpStoreLocal, whose slot comes before the register.
+func (compiler *Compiler) emitSlot(op int, slot int, register byte) {
+	if slot > math.MaxUint8 {
+		compiler.emit(vm5.OpWide)
+	}
+	compiler.emit(op)
+	compiler.appendIndex(slot)
+	compiler.instructions = append(compiler.instructions, register)
+}
+
+func (compiler *Compiler) appendIndex(index int) {
+	switch {
+	case int64(index) > vm5.MaxWideOperand:
+		compiler.fail(fmt.Errorf("operand %d exceeds %d", index, int64(vm5.MaxWideOperand)))
+	case index > math.MaxUint8:
+		compiler.instructions = binary.BigEndian.AppendUint32(compiler.instructions, uint32(index))
+	default:
+		compiler.instructions = append(compiler.instructions, byte(index))
+	}
+}
+
+// emitJump emits a jump with a four byte offset written by patchJump and
+// returns the position of the offset.
+func (compiler *Compiler) emitJump(op int, operands ...byte) int {
+	compiler.emit(vm5.OpWide)
+	compiler.emit(op)
+	compiler.instructions = append(compiler.instructions, operands...)
+	compiler.instructions = append(compiler.instructions, 0, 0, 0, 0)
+	return len(compiler.instructions) - 4
+}
+
+// patchJump makes the jump land after the last emitted instruction. The
+// machine adds the offset to the position of the last byte of the jump.
+func (compiler *Compiler) patchJump(position int) {
+	offset := len(compiler.instructions) - (position + 3)
+	if int64(offset) > vm5.MaxWideOperand {
+		compiler.fail(fmt.Errorf("jump of %d bytes exceeds %d", offset, int64(vm5.MaxWideOperand)))
+		return
+	}
+	binary.BigEndian.PutUint32(compiler.instructions[position:], uint32(offset))
+}
+
+// emitLoop emits a jump back to start. The machine subtracts the offset from
+// the position of the last byte of the instruction.
+func (compiler *Compiler) emitLoop(start int) {
+	compiler.emit(vm5.OpWide, vm5.OpLoop, 0, 0, 0, 0)
+	position := len(compiler.instructions) - 1
+	offset := position - start
+	if int64(offset) > vm5.MaxWideOperand {
+		compiler.fail(fmt.Errorf("jump of %d bytes exceeds %d", offset, int64(vm5.MaxWideOperand)))
+		return
+	}
+	binary.BigEndian.PutUint32(compiler.instructions[position-3:], uint32(offset))
+}
+
+func (compiler *Compiler) fail(err error) {
+	if compiler.err == nil {
+		compiler.err = err
+	}
+}
@@ -0,0 +1,333 @@
+package compiler
+
+import (
+	"bachelor-thesis/builtin"
+	"bachelor-thesis/parser"
+	"bachelor-thesis/parser/ast"
+	"bachelor-thesis/vm5"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type compilerTest struct {
+	input   string
+	program vm5.Program
+}
+
+var compilerTests = []compilerTest{
+	{
+		`1 + 2`,
+		vm5.Program{
+			Instructions: []byte{
+				byte(vm5.OpStoreInt), 0, 0,
+				byte(vm5.OpStoreInt), 1, 1,
+				byte(vm5.OpAdd), 0, 0, 1,
+				byte(vm5.OpMove), vm5.ResultRegister, 0,
+			},
+			Constants: []interface{}{int64(1), int64(2)},
+		},
+	},
+	{
+		`x and true`,
+		vm5.Program{
+			Instructions: []byte{
+				byte(vm5.OpLoadConst), 0, 0,
+				byte(vm5.OpWide), byte(vm5.OpJumpIfFalse), 0, 0, 0, 0, 7,
+				byte(vm5.OpStoreBool), 1, 1,
+				byte(vm5.OpMove), 0, 1,
+				byte(vm5.OpMove), vm5.ResultRegister, 0,
+			},
+			Constants: []interface{}{"x"},
+		},
+	},
+}
+
+func TestCompiler(t *testing.T) {
+	for _, test := range compilerTests {
+		program, err := Compile(parser.Parse(test.input))
+		require.NoError(t, err, test.input)
+		assert.Equal(t, test.program, *program, test.input)
+	}
+}
+
+type runTest struct {
+	input    string
+	env      map[string]interface{}
+	expected interface{}
+}
+
+var runTests = []runTest{
+	{`1 + 2 * 3`, nil, int64(7)},
+	{`(1 + 2) * 3`, nil, int64(9)},
+	{`10 - 4 - 3`, nil, int64(3)},
+	{`7 % 4`, nil, int64(3)},
+	{`2 ^ 10`, nil, int64(1024)},
+	{`1.5 + 1`, nil, 2.5},
+	{`"a" + "b" + "c"`, nil, "abc"},
+	{`1 < 2`, nil, true},
+	{`1 < 2 < 3`, nil, true},
+	{`3 < 2 < 4`, nil, false},
+	{`1 < 3 > 2`, nil, true},
+	{`"a" == "a"`, nil, true},
+	{`true and false`, nil, false},
+	{`false or true`, nil, true},
+	{`1 > 2 or 2 > 1 and 3 > 2`, nil, true},
+	{`if 1 < 2 then "yes" else "no"`, nil, "yes"},
+	{`if 1 > 2 then "yes" else "no"`, nil, "no"},
+	{`case 2 when 1 then "one" when 2 then "two" else "many" end`, nil, "two"},
+	{`case 5 when 1 then "one" when 2 then "two" else "many" end`, nil, "many"},
+	{`case when 1 > 2 then "a" when 2 > 1 then "b" else "c" end`, nil, "b"},
+	{`let x = 2; let y = x * 3; x + y`, nil, int64(8)},
+	{`x + 1`, map[string]interface{}{"x": int64(41)}, int64(42)},
+	{`name + "!"`, map[string]interface{}{"name": "hi"}, "hi!"},
+	{`add(1, 2 * 3) + 1`, map[string]interface{}{"add": func(a, b int64) int64 { return a + b }}, int64(8)},
+	{`answer()`, map[string]interface{}{"answer": func() int64 { return 42 }}, int64(42)},
+	{`-(1 + 2)`, nil, int64(-3)},
+	{`-1.5 * 2`, nil, -3.0},
+	{`not (1 < 2)`, nil, false},
+	{`nil`, nil, nil},
+	{`1.5 <= 2`, nil, true},
+	{`7 / 2.0`, nil, 3.5},
+	{`if 1 > 2 then 1`, nil, nil},
+	{`case 3 when 1 then "one" end`, nil, nil},
+	{`[1, "a", nil]`, nil, []interface{}{int64(1), "a", nil}},
+	{`[]`, nil, []interface{}{}},
+	{`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10][9]`, nil, int64(10)},
+	{`[x, 4][i] * 2`, map[string]interface{}{"x": int64(1), "i": int64(1)}, int64(8)},
+	{`[1][3]`, nil, nil},
+	{`int("42") + 1`, nil, int64(43)},
+	{`string(1.5)`, nil, "1.5"},
+	{`x is string`, map[string]interface{}{"x": "a"}, true},
+	{`1 is float`, nil, false},
+	{`[x * 2 for x in [1, -2, 3] if x > 0]`, nil, []interface{}{int64(2), int64(6)}},
+	{`[i for i, x in ["a", "b"]]`, nil, []interface{}{int64(0), int64(1)}},
+	{`[[y * x for y in [1, 2]] for x in [1, 10]]`, nil, []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{int64(10), int64(20)}}},
+	{`let x = 0; [x for x in [1, 2]]; x`, nil, int64(0)},
+	{`[k for k, v in m if v > 1]`, map[string]interface{}{"m": map[string]int64{"a": 1, "b": 2}}, []interface{}{"b"}},
+	{`fn sq(x) = x * x; sq(3) + sq(4)`, nil, int64(25)},
+	{`fn fact(n) = n <= 1 ? 1 : n * fact(n - 1); fact(5)`, nil, int64(120)},
+	{`fn double(xs) = [x * 2 for x in xs]; double([1, 2])`, nil, []interface{}{int64(2), int64(4)}},
+	{`fn one() = 1; let x = one(); x + one()`, nil, int64(2)},
+	{`fn f(a) = a; 1 + (2 + f(3))`, nil, int64(6)},
+	{`fn f(a) = a`, nil, nil},
+}
+
+// nested returns `1 + (2 + (... + (n + last)))`, which holds n operands.
+func nested(n int, last string) string {
+	var builder strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&builder, "%d + (", i)
+	}
+	builder.WriteString(last)
+	builder.WriteString(strings.Repeat(")", n))
+	return builder.String()
+}
+
+func TestRun(t *testing.T) {
+	tests := append(runTests,
+		runTest{nested(17, "18"), nil, int64(171)},
+		runTest{nested(16, "if true then 17 else 0"), nil, int64(153)},
+		runTest{nested(15, "if 1 > 2 or 2 > 1 then 16 else 0") + " == 136", nil, true},
+		runTest{nested(15, "case 2 when 1 then 0 when 2 then 16 else 0 end"), nil, int64(136)},
+	)
+	for _, test := range tests {
+		program, err := Compile(parser.Parse(test.input))
+		require.NoError(t, err, test.input)
+		vm := vm5.New(*program)
+		err = vm.Run(test.env)
+		require.NoError(t, err, test.input)
+		assert.Equal(t, test.expected, vm.Result(), test.input)
+	}
+}
+
+type user struct {
+	Name string `expr:"name"`
+}
+
+func (u user) Greet(greeting string) string {
+	return greeting + " " + u.Name
+}
+
+func TestEnv(t *testing.T) {
+	fields := builtin.FieldsOf(user{})
+	program, err := Compile(parser.Parse(`Greet("hi") + name`), Env(user{}))
+	require.NoError(t, err)
+	assert.Contains(t, program.Constants, fields["name"])
+	assert.Contains(t, program.Constants, fields["Greet"])
+	vm := vm5.New(*program)
+	require.NoError(t, vm.Run(&user{Name: "ann"}))
+	assert.Equal(t, "hi annann", vm.Result())
+	program, err = Compile(parser.Parse(`fn f(x) = name + x; f("!")`), Env(user{}))
+	require.NoError(t, err)
+	assert.Contains(t, program.Constants, fields["name"])
+	assert.NotContains(t, program.Constants, "name")
+}
+
+func TestMode(t *testing.T) {
+	program, err := Compile(parser.Parse(`x + f(1)`), Mode(builtin.Lenient))
+	require.NoError(t, err)
+	assert.Contains(t, program.Constants, builtin.Identifier{Name: "x", Mode: builtin.Lenient})
+	assert.Contains(t, program.Constants, builtin.Identifier{Name: "f", Pos: 4, Mode: builtin.Lenient, Function: true})
+	vm := vm5.New(*program)
+	assert.EqualError(t, vm.Run(map[string]interface{}{"x": int64(1)}), "unknown function `f` at col 5")
+}
+
+func TestSpill(t *testing.T) {
+	program, err := Compile(parser.Parse(nested(15, "16")))
+	require.NoError(t, err)
+	assert.NotContains(t, string(program.Instructions), string(rune(vm5.OpStoreLocal)))
+
+	program, err = Compile(parser.Parse(nested(17, "18")))
+	require.NoError(t, err)
+	assert.Contains(t, string(program.Instructions), string([]byte{byte(vm5.OpStoreLocal), 0, 0}))
+	assert.Contains(t, string(program.Instructions), string(rune(vm5.OpLoadLocal)))
+}
+
+func TestManyArguments(t *testing.T) {
+	numbers := make([]string, 20)
+	parameters := make([]string, 17)
+	for i := range numbers {
+		numbers[i] = fmt.Sprint(i)
+	}
+	for i := range parameters {
+		parameters[i] = fmt.Sprintf("p%d", i)
+	}
+	env := map[string]interface{}{
+		"sum": func(xs ...int64) int64 {
+			total := int64(0)
+			for _, x := range xs {
+				total += x
+			}
+			return total
+		},
+	}
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"sum(" + strings.Join(numbers, ", ") + ")", int64(190)},
+		{"sum(" + strings.Join(numbers[:9], ", ") + ") * sum(" + strings.Join(numbers[:8], ", ") + ")", int64(36 * 28)},
+		{"fn f(" + strings.Join(parameters, ", ") + ") = p0 + p16; f(" + strings.Join(numbers[:17], ", ") + ")", int64(16)},
+		{"fn f(" + strings.Join(parameters, ", ") + ") = p16; f(" + strings.Join(numbers[:16], ", ") + ", f(" + strings.Join(numbers[1:18], ", ") + "))", int64(17)},
+	}
+	for _, test := range tests {
+		program, err := Compile(parser.Parse(test.input))
+		require.NoError(t, err, test.input)
+		vm := vm5.New(*program)
+		require.NoError(t, vm.Run(env), test.input)
+		assert.Equal(t, test.expected, vm.Result(), test.input)
+	}
+}
+
+func TestShortCircuit(t *testing.T) {
+	calls := 0
+	env := map[string]interface{}{"f": func() bool { calls++; return true }}
+	for _, input := range []string{`false and f()`, `true or f()`, `if true then 1 else f()`, `3 < 2 < f()`} {
+		program, err := Compile(parser.Parse(input))
+		require.NoError(t, err, input)
+		require.NoError(t, vm5.New(*program).Run(env), input)
+	}
+	assert.Equal(t, 0, calls)
+}
+
+func TestWideOperands(t *testing.T) {
+	terms := make([]string, 300)
+	for i := range terms {
+		terms[i] = fmt.Sprint(i)
+	}
+	program, err := Compile(parser.Parse(strings.Join(terms, " + ")))
+	require.NoError(t, err)
+	assert.Len(t, program.Constants, 300)
+	assert.Contains(t, string(program.Instructions), string([]byte{byte(vm5.OpWide), byte(vm5.OpStoreInt), 1, 0, 0, 1, 43}))
+	vm := vm5.New(*program)
+	require.NoError(t, vm.Run(nil))
+	assert.Equal(t, int64(299*300/2), vm.Result())
+
+	elements := make([]string, 70000)
+	for i := range elements {
+		elements[i] = fmt.Sprint(i)
+	}
+	program, err = Compile(parser.Parse("[" + strings.Join(elements, ", ") + "][69999]"))
+	require.NoError(t, err)
+	assert.Contains(t, string(program.Instructions), string([]byte{byte(vm5.OpWide), byte(vm5.OpStoreInt), 7, 0, 1, 0x11, 0x6f}))
+	vm = vm5.New(*program)
+	require.NoError(t, vm.Run(nil))
+	assert.Equal(t, int64(69999), vm.Result())
+}
+
+func TestSharedTree(t *testing.T) {
+	tree := parser.Parse(`fn f(x) = x + "!"; f("a") + "b"`).(*ast.ProgramNode)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			program, err := Compile(tree)
+			if assert.NoError(t, err) {
+				vm := vm5.New(*program)
+				assert.NoError(t, vm.Run(nil))
+				assert.Equal(t, "a!b", vm.Result())
+			}
+		}()
+	}
+	wg.Wait()
+	function := tree.Statements[0].(*ast.FunctionNode)
+	assert.Nil(t, tree.Statements[1].ValueType())
+	assert.Nil(t, function.Body.ValueType())
+	assert.Nil(t, function.Body.(*ast.BinaryNode).Left.ValueType())
+}
+
+func TestCompilerError(t *testing.T) {
+	_, err := Compile(parser.Parse(`int(1, 2)`))
+	assert.EqualError(t, err, "int() expects 1 argument, got 2")
+	_, err = Compile(parser.Parse(`fn f(a) = a; f()`))
+	assert.EqualError(t, err, "f() expects 1 arguments, got 0")
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	program, err := Compile(parser.Parse(`fn f(n) = f(n + 1); f(0)`))
+	require.NoError(t, err)
+	vm := vm5.New(*program)
+	assert.EqualError(t, vm.Run(nil), "maximum call depth 1024 exceeded in f()")
+
+	program, err = Compile(parser.Parse(`fn f(n) = n; f(1)`))
+	require.NoError(t, err)
+	vm = vm5.New(*program)
+	require.NoError(t, vm.Run(nil))
+	assert.Equal(t, int64(1), vm.Result())
+}
+
+func TestResultType(t *testing.T) {
+	tests := []struct {
+		input    string
+		option   Option
+		env      map[string]interface{}
+		expected interface{}
+		err      string
+	}{
+		{`1 < 2`, AsBool(), nil, true, ""},
+		{`x`, AsInt64(), map[string]interface{}{"x": int64(1)}, int64(1), ""},
+		{`1 + 1`, AsFloat64(), nil, 2.0, ""},
+		{`"a"`, AsBool(), nil, nil, "expected bool result, got string"},
+		{`x`, AsBool(), map[string]interface{}{"x": "a"}, nil, `expected bool result, got "a" (string)`},
+	}
+	for _, test := range tests {
+		program, err := Compile(parser.Parse(test.input), test.option)
+		if err == nil {
+			vm := vm5.New(*program)
+			err = vm.Run(test.env)
+			if err == nil {
+				assert.Equal(t, test.expected, vm.Result(), test.input)
+			}
+		}
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, test.input)
+		} else {
+			assert.NoError(t, err, test.input)
+		}
+	}
+}
@@ -1,6 +1,13 @@
 package vm5
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+)
+
+// MaxWideOperand is the largest constant index, slot or jump offset. They
+// take one byte, or four after OpWide as in the stack machines.
+const MaxWideOperand = math.MaxUint32
 
 var (
 	OpExit           = 0x00
@@ -25,6 +32,30 @@ var (
 	OpJumpIfFalse    = 0x19
 	OpLoadConst      = 0x20
 	OpStoreFloat     = 0x21
+	OpMove           = 0x22
+	OpJump           = 0x23
+	OpLoadLocal      = 0x24
+	OpStoreLocal     = 0x25
+	OpWide           = 0x26
+	OpStoreNil       = 0x27
+	OpMinus          = 0x28
+	OpNot            = 0x29
+	OpArray          = 0x30
+	OpAppend         = 0x31
+	OpIndex          = 0x32
+	OpBuiltin        = 0x33
+	OpIs             = 0x34
+	OpAsBool         = 0x35
+	OpAsInt          = 0x36
+	OpAsFloat        = 0x37
+	OpIterInit       = 0x38
+	OpIterNext       = 0x39
+	OpIterValue      = 0x40
+	OpLoop           = 0x41
+	OpCallLocal      = 0x42
+	OpReturn         = 0x43
+	OpCallArray      = 0x44
+	OpCallLocalArray = 0x45
 )
 
 type Opcode struct {
@@ -83,6 +114,54 @@ func (o *Opcode) String() string {
 		return "OpLoadConst"
 	case OpStoreFloat:
 		return "OpStoreFloat"
+	case OpMove:
+		return "OpMove"
+	case OpJump:
+		return "OpJump"
+	case OpLoadLocal:
+		return "OpLoadLocal"
+	case OpStoreLocal:
+		return "OpStoreLocal"
+	case OpWide:
+		return "OpWide"
+	case OpStoreNil:
+		return "OpStoreNil"
+	case OpMinus:
+		return "OpMinus"
+	case OpNot:
+		return "OpNot"
+	case OpArray:
+		return "OpArray"
+	case OpAppend:
+		return "OpAppend"
+	case OpIndex:
+		return "OpIndex"
+	case OpBuiltin:
+		return "OpBuiltin"
+	case OpIs:
+		return "OpIs"
+	case OpAsBool:
+		return "OpAsBool"
+	case OpAsInt:
+		return "OpAsInt"
+	case OpAsFloat:
+		return "OpAsFloat"
+	case OpIterInit:
+		return "OpIterInit"
+	case OpIterNext:
+		return "OpIterNext"
+	case OpIterValue:
+		return "OpIterValue"
+	case OpLoop:
+		return "OpLoop"
+	case OpCallLocal:
+		return "OpCallLocal"
+	case OpReturn:
+		return "OpReturn"
+	case OpCallArray:
+		return "OpCallArray"
+	case OpCallLocalArray:
+		return "OpCallLocalArray"
 	}
 	return "unknown opcode .."
 }
@@ -92,9 +171,20 @@ func (o *Opcode) Value() byte {
 }
 
 func (p *Program) PrintBytecode() {
+	wide := false
 	for i := 0; i < len(p.Instructions); {
 		opcode := NewOpcode(p.Instructions[i])
 		argsCount := opcodeArgsCount(opcode)
+		if wide {
+			// The wide operand takes three more bytes.
+			argsCount += 3
+		}
+		switch int(opcode.Value()) {
+		case OpCall, OpCallLocal, OpArray, OpAppend:
+			// The last fixed operand counts the registers following it.
+			argsCount += int(p.Instructions[i+argsCount])
+		}
+		wide = int(opcode.Value()) == OpWide
 		args := p.Instructions[i+1 : i+1+argsCount]
 
 		fmt.Printf("%s", opcode.String())
@@ -114,10 +204,16 @@ func opcodeArgsCount(o *Opcode) int {
 		return 0
 	case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpExp, OpStringConcat,
 		OpEqual, OpNotEqual, OpLessThan, OpGreaterThan, OpLessOrEqual,
-		OpGreaterOrEqual:
+		OpGreaterOrEqual, OpIndex, OpBuiltin, OpIs, OpIterInit, OpIterValue:
 		return 3
-	case OpStoreInt, OpStoreString, OpStoreBool, OpJumpIfTrue, OpJumpIfFalse:
+	case OpStoreInt, OpStoreString, OpStoreBool, OpJumpIfTrue, OpJumpIfFalse,
+		OpStoreFloat, OpLoadConst, OpMove, OpLoadLocal, OpStoreLocal,
+		OpMinus, OpNot, OpArray, OpAppend, OpIterNext:
 		return 2
+	case OpJump, OpStoreNil, OpAsBool, OpAsInt, OpAsFloat, OpLoop, OpReturn:
+		return 1
+	case OpCall, OpCallLocal, OpCallArray, OpCallLocalArray:
+		return 3
 	default:
 		return 0
 	}
@@ -0,0 +1,198 @@
+package vm5
+
+import (
+	"fmt"
+	"math"
+)
+
+var operators = map[int]string{
+	OpAdd:            "+",
+	OpSub:            "-",
+	OpMul:            "*",
+	OpDiv:            "/",
+	OpMod:            "%",
+	OpExp:            "^",
+	OpEqual:          "==",
+	OpNotEqual:       "!=",
+	OpLessThan:       "<",
+	OpGreaterThan:    ">",
+	OpLessOrEqual:    "<=",
+	OpGreaterOrEqual: ">=",
+}
+
+// executeArithmeticOperation computes int64 operations in int64 and widens
+// an int64 operand to float64 when the other one is a float64. OpAdd also
+// concatenates strings.
+func executeArithmeticOperation(op int, a, b interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return intOperation(op, x, y)
+		case float64:
+			return floatOperation(op, float64(x), y)
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return floatOperation(op, x, float64(y))
+		case float64:
+			return floatOperation(op, x, y)
+		}
+	case string:
+		if y, ok := b.(string); ok && op == OpAdd {
+			return x + y, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid operation: %T %s %T", a, operators[op], b)
+}
+
+func intOperation(op int, x, y int64) (interface{}, error) {
+	switch op {
+	case OpAdd:
+		return x + y, nil
+	case OpSub:
+		return x - y, nil
+	case OpMul:
+		return x * y, nil
+	case OpDiv, OpMod:
+		if y == 0 {
+			return nil, fmt.Errorf("integer divide by zero")
+		}
+		if op == OpDiv {
+			return x / y, nil
+		}
+		return x % y, nil
+	case OpExp:
+		return int64(math.Pow(float64(x), float64(y))), nil
+	}
+	return nil, fmt.Errorf("invalid operation: int64 %s int64", operators[op])
+}
+
+func floatOperation(op int, x, y float64) (interface{}, error) {
+	switch op {
+	case OpAdd:
+		return x + y, nil
+	case OpSub:
+		return x - y, nil
+	case OpMul:
+		return x * y, nil
+	case OpDiv:
+		return x / y, nil
+	case OpExp:
+		return math.Pow(x, y), nil
+	}
+	return nil, fmt.Errorf("invalid operation: float64 %s float64", operators[op])
+}
+
+// executeComparisonOperation compares numbers of either type with each
+// other, strings with strings and, for equality, bools with bools.
+func executeComparisonOperation(op int, a, b interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return compareInts(op, x, y), nil
+		case float64:
+			return compareFloats(op, float64(x), y), nil
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return compareFloats(op, x, float64(y)), nil
+		case float64:
+			return compareFloats(op, x, y), nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return compareStrings(op, x, y), nil
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch op {
+			case OpEqual:
+				return x == y, nil
+			case OpNotEqual:
+				return x != y, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("invalid operation: %T %s %T", a, operators[op], b)
+}
+
+func compareInts(op int, x, y int64) bool {
+	switch op {
+	case OpEqual:
+		return x == y
+	case OpNotEqual:
+		return x != y
+	case OpLessThan:
+		return x < y
+	case OpGreaterThan:
+		return x > y
+	case OpLessOrEqual:
+		return x <= y
+	default:
+		return x >= y
+	}
+}
+
+func compareFloats(op int, x, y float64) bool {
+	switch op {
+	case OpEqual:
+		return x == y
+	case OpNotEqual:
+		return x != y
+	case OpLessThan:
+		return x < y
+	case OpGreaterThan:
+		return x > y
+	case OpLessOrEqual:
+		return x <= y
+	default:
+		return x >= y
+	}
+}
+
+func compareStrings(op int, x, y string) bool {
+	switch op {
+	case OpEqual:
+		return x == y
+	case OpNotEqual:
+		return x != y
+	case OpLessThan:
+		return x < y
+	case OpGreaterThan:
+		return x > y
+	case OpLessOrEqual:
+		return x <= y
+	default:
+		return x >= y
+	}
+}
+
+func executeMinusOperation(a interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case int64:
+		return -x, nil
+	case float64:
+		return -x, nil
+	}
+	return nil, fmt.Errorf("invalid operation: -%T", a)
+}
+
+// executeIndexOperation returns nil for an index outside of the array.
+func executeIndexOperation(array, index interface{}) (interface{}, error) {
+	elements, ok := array.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid operation: %T[%T]", array, index)
+	}
+	i, ok := index.(int64)
+	if !ok {
+		return nil, fmt.Errorf("invalid operation: %T[%T]", array, index)
+	}
+	if i < 0 || i >= int64(len(elements)) {
+		return nil, nil
+	}
+	return elements[i], nil
+}
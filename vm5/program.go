@@ -4,3 +4,11 @@ type Program struct {
 	Instructions []byte
 	Constants    []interface{}
 }
+
+// Function is a compiled `fn` definition, stored in Program.Constants and
+// invoked with OpCallLocal.
+type Function struct {
+	Name          string
+	Instructions  []byte
+	NumParameters int
+}
@@ -1,18 +1,52 @@
 package vm5
 
 import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
+	"context"
+	"encoding/binary"
 	"fmt"
-	"math"
 	"reflect"
 )
 
+// ResultRegister holds the result of a program, vm5/compiler moves the value
+// of the expression there.
+const ResultRegister = 3
+
+// MaxCallDepth limits nested calls of user-defined functions, so a recursive
+// definition fails with an error instead of growing without bound.
+const MaxCallDepth = 1024
+
 type VM struct {
 	Registers    [16]interface{}
+	Limits       budget.Limits // bounds every Run, unlimited by default
+	locals       []interface{} // let bindings and spilled registers
+	frames       []frame
+	saved        int // the values held by the callers in frames
 	ip           int
+	wide         bool // the next operand follows OpWide
 	instructions []byte
 	constants    []interface{}
 }
 
+// frame saves the caller's state while a user-defined function runs. The
+// function uses all registers, so the caller's are restored on return.
+type frame struct {
+	instructions []byte
+	ip           int
+	locals       []interface{}
+	registers    [16]interface{}
+	result       byte
+	held         int
+}
+
+// iterator holds the loop variables of every iteration of a comprehension,
+// entries[pos-1] is the current one.
+type iterator struct {
+	entries [][]interface{}
+	pos     int
+}
+
 func New(program Program) *VM {
 	return &VM{
 		instructions: program.Instructions,
@@ -20,511 +54,526 @@ func New(program Program) *VM {
 	}
 }
 
+// Result returns the value left in ResultRegister by the last Run.
+func (vm *VM) Result() interface{} {
+	return vm.Registers[ResultRegister]
+}
+
 func (vm *VM) Run(env interface{}) error {
+	return vm.RunContext(context.Background(), env)
+}
+
+// RunContext is Run stopping with a *budget.InterruptedError once ctx is done,
+// checked every budget.CheckInterval instructions and around calls. Functions
+// of env taking a context.Context as first parameter receive ctx.
+func (vm *VM) RunContext(ctx context.Context, env interface{}) error {
+	if len(vm.frames) > 0 {
+		// A previous run failed inside a function.
+		vm.instructions = vm.frames[0].instructions
+		vm.frames = vm.frames[:0]
+	}
+	vm.Registers = [16]interface{}{}
+	vm.locals = vm.locals[:0]
+	vm.saved = 0
 	vm.ip = 0
+	vm.wide = false
+	limited := vm.Limits != budget.Limits{}
+	done := ctx.Done()
+	executed := 0
 	for vm.ip < len(vm.instructions) {
+		if limited || done != nil {
+			executed++
+			if err := vm.Limits.Step(executed, vm.depth()); err != nil {
+				return err
+			}
+			if done != nil && executed%budget.CheckInterval == 0 {
+				if err := budget.Interrupted(ctx, vm.ip); err != nil {
+					return err
+				}
+			}
+		}
 		op := NewOpcode(vm.instructions[vm.ip])
 		switch int(op.Value()) {
-		case OpStoreInt:
-			vm.ip++
-			reg := int(vm.instructions[vm.ip])
-			if reg >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", reg)
+		case OpExit:
+			return nil
+		case OpStoreInt, OpStoreFloat, OpStoreString:
+			reg, err := vm.register()
+			if err != nil {
+				return err
 			}
+			vm.Registers[reg] = vm.constants[vm.index()]
 			vm.ip++
-			val := vm.constants[vm.instructions[vm.ip]]
-			vm.ip++
-			vm.Registers[reg] = val
-		case OpStoreFloat:
-			vm.ip++
-			reg := int(vm.instructions[vm.ip])
-			if reg >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", reg)
-			}
-			vm.ip++
-			val := vm.constants[vm.instructions[vm.ip]]
-			vm.ip++
-			vm.Registers[reg] = val
-		case OpAdd:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			a := vm.instructions[vm.ip]
-			vm.ip++
-			b := vm.instructions[vm.ip]
-			vm.ip++
-			if int(a) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", a)
-			}
-			if int(b) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", b)
-			}
-			if int(res) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", res)
-			}
-			switch vm.Registers[a].(type) {
-			case int:
-				switch vm.Registers[b].(type) {
-				case int:
-					aVal := vm.Registers[a].(int)
-					bVal := vm.Registers[b].(int)
-					vm.Registers[res] = aVal + bVal
-				case float64:
-					aVal := float64(vm.Registers[a].(int))
-					bVal := vm.Registers[b].(float64)
-					vm.Registers[res] = aVal + bVal
-				}
-			case float64:
-				switch vm.Registers[b].(type) {
-				case int:
-					aVal := vm.Registers[a].(float64)
-					bVal := float64(vm.Registers[b].(int))
-					vm.Registers[res] = aVal + bVal
-				case float64:
-					aVal := vm.Registers[a].(float64)
-					bVal := vm.Registers[b].(float64)
-					vm.Registers[res] = aVal + bVal
-				}
+		case OpStoreBool:
+			reg, err := vm.register()
+			if err != nil {
+				return err
 			}
-		case OpSub:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			a := vm.instructions[vm.ip]
 			vm.ip++
-			b := vm.instructions[vm.ip]
+			vm.Registers[reg] = vm.instructions[vm.ip] != 0
 			vm.ip++
-
-			if int(a) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", a)
-			}
-			if int(b) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", b)
+		case OpStoreNil:
+			reg, err := vm.register()
+			if err != nil {
+				return err
 			}
-			if int(res) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", res)
-			}
-			aVal := vm.Registers[a].(int)
-			bVal := vm.Registers[b].(int)
-			vm.Registers[res] = aVal - bVal
-		case OpMul:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			a := vm.instructions[vm.ip]
+			vm.Registers[reg] = nil
 			vm.ip++
-			b := vm.instructions[vm.ip]
-			vm.ip++
-
-			if int(a) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", a)
+		case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpExp:
+			res, a, b, err := vm.registers()
+			if err != nil {
+				return err
 			}
-			if int(b) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", b)
+			value, err := executeArithmeticOperation(int(op.Value()), vm.Registers[a], vm.Registers[b])
+			if err != nil {
+				return err
 			}
-			if int(res) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", res)
-			}
-			aVal := vm.Registers[a].(int)
-			bVal := vm.Registers[b].(int)
-			vm.Registers[res] = aVal * bVal
-		case OpDiv:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			a := vm.instructions[vm.ip]
-			vm.ip++
-			b := vm.instructions[vm.ip]
-			vm.ip++
-
-			if int(a) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", a)
-			}
-			if int(b) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", b)
-			}
-			if int(res) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", res)
-			}
-			switch vm.Registers[a].(type) {
-			case int:
-				switch vm.Registers[b].(type) {
-				case int:
-					aVal := vm.Registers[a].(int)
-					bVal := vm.Registers[b].(int)
-					vm.Registers[res] = aVal / bVal
-				case float64:
-					aVal := float64(vm.Registers[a].(int))
-					bVal := vm.Registers[b].(float64)
-					vm.Registers[res] = aVal / bVal
-				}
-			case float64:
-				switch vm.Registers[b].(type) {
-				case int:
-					aVal := vm.Registers[a].(float64)
-					bVal := float64(vm.Registers[b].(int))
-					vm.Registers[res] = aVal / bVal
-				case float64:
-					aVal := vm.Registers[a].(float64)
-					bVal := vm.Registers[b].(float64)
-					vm.Registers[res] = aVal / bVal
+			if s, ok := value.(string); ok {
+				if err := vm.Limits.Concat(len(s)); err != nil {
+					return err
 				}
 			}
-		case OpMod:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			a := vm.instructions[vm.ip]
-			vm.ip++
-			b := vm.instructions[vm.ip]
-			vm.ip++
-
-			if int(a) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", a)
+			vm.Registers[res] = value
+		case OpStringConcat:
+			res, a, b, err := vm.registers()
+			if err != nil {
+				return err
+			}
+			aVal, aOk := vm.Registers[a].(string)
+			bVal, bOk := vm.Registers[b].(string)
+			if !aOk || !bOk {
+				return fmt.Errorf("invalid operation: %T + %T", vm.Registers[a], vm.Registers[b])
+			}
+			if err := vm.Limits.Concat(len(aVal) + len(bVal)); err != nil {
+				return err
+			}
+			vm.Registers[res] = aVal + bVal
+		case OpEqual, OpNotEqual, OpLessThan, OpGreaterThan, OpLessOrEqual, OpGreaterOrEqual:
+			res, a, b, err := vm.registers()
+			if err != nil {
+				return err
+			}
+			value, err := executeComparisonOperation(int(op.Value()), vm.Registers[a], vm.Registers[b])
+			if err != nil {
+				return err
+			}
+			vm.Registers[res] = value
+		case OpMinus, OpNot:
+			res, err := vm.register()
+			if err != nil {
+				return err
+			}
+			reg, err := vm.register()
+			if err != nil {
+				return err
+			}
+			vm.ip++
+			if int(op.Value()) == OpNot {
+				v, ok := vm.Registers[reg].(bool)
+				if !ok {
+					return fmt.Errorf("invalid operation: not %T", vm.Registers[reg])
+				}
+				vm.Registers[res] = !v
+				break
 			}
-			if int(b) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", b)
+			value, err := executeMinusOperation(vm.Registers[reg])
+			if err != nil {
+				return err
 			}
-			if int(res) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", res)
+			vm.Registers[res] = value
+		case OpArray, OpAppend:
+			res, err := vm.register()
+			if err != nil {
+				return err
 			}
-			aVal := vm.Registers[a].(int)
-			bVal := vm.Registers[b].(int)
-			vm.Registers[res] = aVal % bVal
-		case OpExp:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			a := vm.instructions[vm.ip]
 			vm.ip++
-			b := vm.instructions[vm.ip]
-			vm.ip++
-
-			if int(a) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", a)
+			size := int(vm.instructions[vm.ip])
+			var array []interface{}
+			if int(op.Value()) == OpAppend {
+				array = vm.Registers[res].([]interface{})
+			} else {
+				array = make([]interface{}, 0, size)
 			}
-			if int(b) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", b)
+			for i := 0; i < size; i++ {
+				reg, err := vm.register()
+				if err != nil {
+					return err
+				}
+				array = append(array, vm.Registers[reg])
+			}
+			if err := vm.Limits.Array(len(array)); err != nil {
+				return err
+			}
+			vm.ip++
+			vm.Registers[res] = array
+		case OpIndex:
+			res, a, b, err := vm.registers()
+			if err != nil {
+				return err
+			}
+			value, err := executeIndexOperation(vm.Registers[a], vm.Registers[b])
+			if err != nil {
+				return err
+			}
+			vm.Registers[res] = value
+		case OpBuiltin:
+			res, err := vm.register()
+			if err != nil {
+				return err
+			}
+			vm.ip++
+			index := int(vm.instructions[vm.ip])
+			reg, err := vm.register()
+			if err != nil {
+				return err
+			}
+			vm.ip++
+			if index >= len(builtin.Builtins) {
+				return fmt.Errorf("builtin %d out of range", index)
+			}
+			value, err := builtin.Builtins[index].Call(vm.Registers[reg])
+			if err != nil {
+				return err
+			}
+			vm.Registers[res] = value
+		case OpIs:
+			res, err := vm.register()
+			if err != nil {
+				return err
+			}
+			reg, err := vm.register()
+			if err != nil {
+				return err
+			}
+			name := vm.constants[vm.index()].(string)
+			vm.ip++
+			vm.Registers[res] = builtin.Is(vm.Registers[reg], name)
+		case OpAsBool, OpAsInt, OpAsFloat:
+			reg, err := vm.register()
+			if err != nil {
+				return err
+			}
+			vm.ip++
+			var value interface{}
+			switch int(op.Value()) {
+			case OpAsBool:
+				value, err = builtin.AsBool(vm.Registers[reg])
+			case OpAsInt:
+				value, err = builtin.AsInt64(vm.Registers[reg])
+			default:
+				value, err = builtin.AsFloat64(vm.Registers[reg])
+			}
+			if err != nil {
+				return err
+			}
+			vm.Registers[reg] = value
+		case OpCall, OpCallArray:
+			offset := vm.ip
+			res, err := vm.register()
+			if err != nil {
+				return err
+			}
+			fnAddr := vm.constants[vm.index()]
+			args, err := vm.arguments(int(op.Value()) == OpCallArray)
+			if err != nil {
+				return err
+			}
+			if err := vm.call(ctx, env, offset, res, fnAddr, args); err != nil {
+				return err
+			}
+		case OpCallLocal, OpCallLocalArray:
+			res, err := vm.register()
+			if err != nil {
+				return err
+			}
+			function := vm.constants[vm.index()].(*Function)
+			if len(vm.frames) >= MaxCallDepth {
+				return fmt.Errorf("maximum call depth %d exceeded in %s()", MaxCallDepth, function.Name)
+			}
+			locals, err := vm.arguments(int(op.Value()) == OpCallLocalArray)
+			if err != nil {
+				return err
+			}
+			held := vm.held()
+			vm.frames = append(vm.frames, frame{
+				instructions: vm.instructions,
+				ip:           vm.ip,
+				locals:       vm.locals,
+				registers:    vm.Registers,
+				result:       res,
+				held:         held,
+			})
+			vm.saved += held
+			vm.instructions = function.Instructions
+			vm.locals = locals
+			vm.Registers = [16]interface{}{}
+			vm.ip = 0
+		case OpReturn:
+			reg, err := vm.register()
+			if err != nil {
+				return err
+			}
+			value := vm.Registers[reg]
+			caller := vm.frames[len(vm.frames)-1]
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			vm.saved -= caller.held
+			vm.instructions = caller.instructions
+			vm.locals = caller.locals
+			vm.Registers = caller.registers
+			vm.Registers[caller.result] = value
+			vm.ip = caller.ip
+		case OpIterInit:
+			res, err := vm.register()
+			if err != nil {
+				return err
+			}
+			reg, err := vm.register()
+			if err != nil {
+				return err
+			}
+			vm.ip++
+			variables := int(vm.instructions[vm.ip])
+			vm.ip++
+			entries, err := builtin.Entries(vm.Registers[reg], variables)
+			if err != nil {
+				return err
+			}
+			vm.Registers[res] = &iterator{entries: entries}
+		case OpIterNext:
+			reg, err := vm.register()
+			if err != nil {
+				return err
+			}
+			it := vm.Registers[reg].(*iterator)
+			done := it.pos == len(it.entries)
+			if !done {
+				it.pos++
+			}
+			if err := vm.jump(done); err != nil {
+				return err
+			}
+		case OpIterValue:
+			res, err := vm.register()
+			if err != nil {
+				return err
+			}
+			reg, err := vm.register()
+			if err != nil {
+				return err
+			}
+			vm.ip++
+			i := int(vm.instructions[vm.ip])
+			vm.ip++
+			it := vm.Registers[reg].(*iterator)
+			vm.Registers[res] = it.entries[it.pos-1][i]
+		case OpLoop:
+			offset := vm.index()
+			if offset > vm.ip {
+				return fmt.Errorf("jump target out of range")
+			}
+			vm.ip -= offset
+		case OpLoadConst:
+			res, err := vm.register()
+			if err != nil {
+				return err
 			}
-			if int(res) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", res)
+			value, err := builtin.Load(env, vm.constants[vm.index()])
+			if err != nil {
+				return err
 			}
-			aVal := vm.Registers[a].(int)
-			bVal := vm.Registers[b].(int)
-			vm.Registers[res] = int(math.Pow(float64(aVal), float64(bVal)))
-		case OpStoreString:
 			vm.ip++
-			reg := vm.instructions[vm.ip]
-			if int(reg) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", reg)
+			vm.Registers[res] = value
+		case OpJumpIfFalse, OpJumpIfTrue:
+			reg, err := vm.register()
+			if err != nil {
+				return err
 			}
-			vm.ip++
-			vm.Registers[reg] = vm.constants[vm.instructions[vm.ip]]
-			vm.ip++
-		case OpStringConcat:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			a := vm.instructions[vm.ip]
-			if int(a) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", a)
+			v, ok := vm.Registers[reg].(bool)
+			if !ok {
+				return fmt.Errorf("expected bool condition, got %T", vm.Registers[reg])
 			}
-			vm.ip++
-			b := vm.instructions[vm.ip]
-			if int(b) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", b)
+			if err := vm.jump(v == (int(op.Value()) == OpJumpIfTrue)); err != nil {
+				return err
 			}
-			vm.ip++
-			if int(res) >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", res)
+		case OpJump:
+			if err := vm.jump(true); err != nil {
+				return err
 			}
-			aVal := vm.Registers[a]
-			bVal := vm.Registers[b]
-			vm.Registers[res] = aVal.(string) + bVal.(string)
-		case OpStoreBool:
-			vm.ip++
-			reg := int(vm.instructions[vm.ip])
-			if reg >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", reg)
+		case OpMove:
+			res, err := vm.register()
+			if err != nil {
+				return err
 			}
-			vm.ip++
-			val := int(vm.instructions[vm.ip])
-			vm.ip++
-			vm.Registers[reg] = val != 0
-		case OpEqual:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			r1 := int(vm.instructions[vm.ip])
-			vm.ip++
-			r2 := int(vm.instructions[vm.ip])
-			vm.ip++
-
-			if r1 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r1)
-			}
-			if r2 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r2)
+			reg, err := vm.register()
+			if err != nil {
+				return err
 			}
-
-			switch vm.Registers[r1].(type) {
-			case int:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal == bVal
-			case string:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal.(string) == bVal.(string)
-			case bool:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal == bVal
-			}
-		case OpNotEqual:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			r1 := int(vm.instructions[vm.ip])
 			vm.ip++
-			r2 := int(vm.instructions[vm.ip])
-			vm.ip++
-
-			if r1 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r1)
-			}
-			if r2 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r2)
+			vm.Registers[res] = vm.Registers[reg]
+		case OpLoadLocal:
+			res, err := vm.register()
+			if err != nil {
+				return err
 			}
-
-			switch vm.Registers[r1].(type) {
-			case int:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal != bVal
-			case string:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal.(string) != bVal.(string)
-			case bool:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal != bVal
-			}
-		case OpLessThan:
-			vm.ip++
-			res := vm.instructions[vm.ip]
+			slot := vm.index()
 			vm.ip++
-			r1 := int(vm.instructions[vm.ip])
-			vm.ip++
-			r2 := int(vm.instructions[vm.ip])
-			vm.ip++
-
-			if r1 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r1)
+			if slot >= len(vm.locals) {
+				return fmt.Errorf("local %d out of range", slot)
 			}
-			if r2 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r2)
+			vm.Registers[res] = vm.locals[slot]
+		case OpStoreLocal:
+			slot := vm.index()
+			reg, err := vm.register()
+			if err != nil {
+				return err
 			}
-
-			switch vm.Registers[r1].(type) {
-			case int:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal.(int) < bVal.(int)
-			case string:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal.(string) < bVal.(string)
-			}
-		case OpGreaterThan:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			r1 := int(vm.instructions[vm.ip])
 			vm.ip++
-			r2 := int(vm.instructions[vm.ip])
+			for len(vm.locals) <= slot {
+				vm.locals = append(vm.locals, nil)
+			}
+			vm.locals[slot] = vm.Registers[reg]
+		case OpWide:
 			vm.ip++
+			vm.wide = true
+		default:
+			return fmt.Errorf("unsupported opcode: %s", op)
+		}
+	}
+	return nil
+}
 
-			if r1 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r1)
-			}
-			if r2 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r2)
-			}
+// depth is the number of values the machine holds for budget.Limits: the
+// registers in use and the local slots of the running function and of its
+// callers, plus one per call.
+func (vm *VM) depth() int {
+	return vm.held() + vm.saved + len(vm.frames)
+}
 
-			switch vm.Registers[r1].(type) {
-			case int:
-				aVal := vm.Registers[r1]
-				switch vm.Registers[r2].(type) {
-				case int:
-					bVal := vm.Registers[r2]
-					vm.Registers[res] = aVal.(int) > bVal.(int)
-				case float64:
-					bVal := vm.Registers[r2]
-					vm.Registers[res] = float64(aVal.(int)) > bVal.(float64)
-				}
-			case string:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal.(string) > bVal.(string)
-			}
-		case OpLessOrEqual:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			r1 := int(vm.instructions[vm.ip])
-			vm.ip++
-			r2 := int(vm.instructions[vm.ip])
-			vm.ip++
+// held counts the registers written since the function started and its
+// local slots.
+func (vm *VM) held() int {
+	held := len(vm.locals)
+	for _, value := range vm.Registers {
+		if value != nil {
+			held++
+		}
+	}
+	return held
+}
 
-			if r1 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r1)
-			}
-			if r2 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r2)
-			}
+// arguments reads the arguments of a call and moves past the instruction.
+// They are in the registers following their number or, with inArray, in the
+// array of the register following the callee.
+func (vm *VM) arguments(inArray bool) ([]interface{}, error) {
+	if inArray {
+		reg, err := vm.register()
+		if err != nil {
+			return nil, err
+		}
+		vm.ip++
+		args := vm.Registers[reg].([]interface{})
+		return append([]interface{}(nil), args...), nil
+	}
+	vm.ip++
+	args := make([]interface{}, vm.instructions[vm.ip])
+	for i := range args {
+		reg, err := vm.register()
+		if err != nil {
+			return nil, err
+		}
+		args[i] = vm.Registers[reg]
+	}
+	vm.ip++
+	return args, nil
+}
 
-			switch vm.Registers[r1].(type) {
-			case int:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal.(int) <= bVal.(int)
-			case string:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal.(string) <= bVal.(string)
-			}
-		case OpGreaterOrEqual:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			r1 := int(vm.instructions[vm.ip])
-			vm.ip++
-			r2 := int(vm.instructions[vm.ip])
-			vm.ip++
+// call calls the function fnAddr of env with args and stores its result in
+// res.
+func (vm *VM) call(ctx context.Context, env interface{}, offset int, res byte, fnAddr interface{}, args []interface{}) error {
+	fn, err := builtin.Load(env, fnAddr)
+	if err != nil {
+		return err
+	}
+	if reflect.TypeOf(fn) == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+		return fmt.Errorf("%v is not a function", fnAddr)
+	}
+	in := make([]reflect.Value, len(args))
+	for i, param := range args {
+		if param == nil {
+			in[i] = reflect.ValueOf(&args[i]).Elem()
+		} else {
+			in[i] = reflect.ValueOf(param)
+		}
+	}
+	if err := budget.Interrupted(ctx, offset); err != nil {
+		return err
+	}
+	f := reflect.ValueOf(fn)
+	out := f.Call(builtin.WithContext(ctx, f, in))
+	if err := budget.Interrupted(ctx, offset); err != nil {
+		return err
+	}
+	if len(out) == 2 && out[1].Type() == reflect.TypeOf((*error)(nil)).Elem() && !out[1].IsNil() {
+		return out[1].Interface().(error)
+	}
+	vm.Registers[res] = out[0].Interface()
+	return nil
+}
 
-			if r1 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r1)
-			}
-			if r2 >= len(vm.Registers) {
-				return fmt.Errorf("register %d out of range", r2)
-			}
+// register moves to the next operand and reads it as a register.
+func (vm *VM) register() (byte, error) {
+	vm.ip++
+	reg := vm.instructions[vm.ip]
+	if int(reg) >= len(vm.Registers) {
+		return 0, fmt.Errorf("register %d out of range", reg)
+	}
+	return reg, nil
+}
 
-			switch vm.Registers[r1].(type) {
-			case int:
-				switch vm.Registers[r2].(type) {
-				case int:
-					aVal := vm.Registers[r1]
-					bVal := vm.Registers[r2]
-					vm.Registers[res] = aVal.(int) >= bVal.(int)
-				case float64:
-					aVal := vm.Registers[r1]
-					bVal := vm.Registers[r2]
-					vm.Registers[res] = float64(aVal.(int)) >= bVal.(float64)
-				}
-			case float64:
-				switch vm.Registers[r2].(type) {
-				case int:
-					aVal := vm.Registers[r1]
-					bVal := vm.Registers[r2]
-					vm.Registers[res] = aVal.(float64) >= float64(bVal.(int))
-				case float64:
-					aVal := vm.Registers[r1]
-					bVal := vm.Registers[r2]
-					vm.Registers[res] = aVal.(float64) >= bVal.(float64)
-				}
-			case string:
-				aVal := vm.Registers[r1]
-				bVal := vm.Registers[r2]
-				vm.Registers[res] = aVal.(string) >= bVal.(string)
-			}
-		case OpCall:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			fnAddr := vm.constants[vm.instructions[vm.ip]]
-			vm.ip++
-			v := reflect.ValueOf(env)
-			kind := v.Kind()
-			if kind == reflect.Invalid {
-				fmt.Sprintf("error")
-			}
-			var fn interface{}
-			switch kind {
-			case reflect.Map:
-				value := v.MapIndex(reflect.ValueOf(fnAddr))
-				if value.IsValid() {
-					fn = value.Interface()
-				} else {
-					elem := reflect.TypeOf(env).Elem()
-					fn = reflect.Zero(elem).Interface()
-				}
-			}
-			size := int(vm.instructions[vm.ip])
-			in := make([]reflect.Value, size)
-			vm.ip++
-			for i := 0; i < size; i++ {
-				r := int(vm.instructions[vm.ip])
-				vm.ip++
-				in[i] = reflect.ValueOf(vm.Registers[r])
-			}
-			out := reflect.ValueOf(fn).Call(in)
-			vm.Registers[res] = out[0].Interface()
-		case OpLoadConst:
-			vm.ip++
-			res := vm.instructions[vm.ip]
-			vm.ip++
-			varAddr := vm.constants[vm.instructions[vm.ip]]
-			vm.ip++
-			v := reflect.ValueOf(env)
-			kind := v.Kind()
-			if kind == reflect.Invalid {
-				fmt.Sprintf("error")
-			}
+// registers reads the result and operand registers of a binary instruction
+// and moves past it.
+func (vm *VM) registers() (res, a, b byte, err error) {
+	if res, err = vm.register(); err != nil {
+		return
+	}
+	if a, err = vm.register(); err != nil {
+		return
+	}
+	if b, err = vm.register(); err != nil {
+		return
+	}
+	vm.ip++
+	return
+}
 
-			if kind == reflect.Ptr {
-				v = reflect.Indirect(v)
-				kind = v.Kind()
-			}
+// index moves to the next operand and reads it as a constant index, local
+// slot or jump offset.
+func (vm *VM) index() int {
+	vm.ip++
+	return vm.operand()
+}
 
-			switch kind {
-			case reflect.Map:
-				value := v.MapIndex(reflect.ValueOf(varAddr))
-				if value.IsValid() {
-					vm.Registers[res] = value.Interface()
-				} else {
-					elem := reflect.TypeOf(env).Elem()
-					vm.Registers[res] = reflect.Zero(elem).Interface()
-				}
-			}
-		case OpJumpIfFalse:
-			vm.ip++
-			reg := int(vm.instructions[vm.ip])
-			if vm.Registers[reg].(bool) == false {
-				vm.ip++
-				targetIP := int(vm.instructions[vm.ip])
-				if targetIP >= len(vm.instructions) {
-					return fmt.Errorf("jump target out of range")
-				}
-				vm.ip += targetIP
-			} else {
-				vm.ip += 2
-			}
-		case OpJumpIfTrue:
-			vm.ip++
-			reg := int(vm.instructions[vm.ip])
-			if vm.Registers[reg].(bool) == true {
-				vm.ip++
-				targetIP := int(vm.instructions[vm.ip])
-				if targetIP >= len(vm.instructions) {
-					return fmt.Errorf("jump target out of range")
-				}
-				vm.ip += targetIP
-			} else {
-				vm.ip += 2
-			}
-		}
+// jump reads the offset of a jump and, when taken, adds it to the position of
+// the last byte of the instruction.
+func (vm *VM) jump(taken bool) error {
+	offset := vm.index()
+	if !taken {
+		vm.ip++
+		return nil
+	}
+	if vm.ip+offset > len(vm.instructions) {
+		return fmt.Errorf("jump target out of range")
 	}
+	vm.ip += offset
 	return nil
 }
+
+// operand reads a constant index, local slot or jump offset at vm.ip. After
+// OpWide it takes four bytes and vm.ip is left on the last one.
+func (vm *VM) operand() int {
+	if vm.wide {
+		vm.wide = false
+		vm.ip += 3
+		return int(binary.BigEndian.Uint32(vm.instructions[vm.ip-3:]))
+	}
+	return int(vm.instructions[vm.ip])
+}
@@ -1,6 +1,9 @@
 package vm5
 
 import (
+	"bachelor-thesis/budget"
+	"bytes"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -18,8 +21,8 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpAdd), 03, 01, 02,
 			},
-			Constants: []interface{}{10, 20},
-		}, 30,
+			Constants: []interface{}{int64(10), int64(20)},
+		}, int64(30),
 	},
 	{ // 10 + 20 + 5
 		Program{
@@ -29,8 +32,8 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 01, 2,
 				byte(OpAdd), 03, 01, 03,
 			},
-			Constants: []interface{}{10, 20, 5},
-		}, 35,
+			Constants: []interface{}{int64(10), int64(20), int64(5)},
+		}, int64(35),
 	},
 	{ // 20 - 10
 		Program{
@@ -38,8 +41,8 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpSub), 03, 02, 01,
 			},
-			Constants: []interface{}{10, 20},
-		}, 10,
+			Constants: []interface{}{int64(10), int64(20)},
+		}, int64(10),
 	},
 	{ // 20 * 10
 		Program{
@@ -47,8 +50,8 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpMul), 03, 02, 01,
 			},
-			Constants: []interface{}{20, 10},
-		}, 200,
+			Constants: []interface{}{int64(20), int64(10)},
+		}, int64(200),
 	},
 	{ // 20 / 10
 		Program{
@@ -56,8 +59,8 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpDiv), 03, 01, 02,
 			},
-			Constants: []interface{}{20, 10},
-		}, 2,
+			Constants: []interface{}{int64(20), int64(10)},
+		}, int64(2),
 	},
 	{ // 20 % 19
 		Program{
@@ -65,8 +68,8 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpMod), 03, 01, 02,
 			},
-			Constants: []interface{}{20, 19},
-		}, 1,
+			Constants: []interface{}{int64(20), int64(19)},
+		}, int64(1),
 	},
 	{ // 2 ^ 2
 		Program{
@@ -74,8 +77,8 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpExp), 03, 02, 01,
 			},
-			Constants: []interface{}{2, 2},
-		}, 4,
+			Constants: []interface{}{int64(2), int64(2)},
+		}, int64(4),
 	},
 	{ // 1 - 2 + 3 - 4
 		Program{
@@ -87,8 +90,8 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 01, 3,
 				byte(OpSub), 03, 03, 01,
 			},
-			Constants: []interface{}{1, 2, 3, 4},
-		}, -2,
+			Constants: []interface{}{int64(1), int64(2), int64(3), int64(4)},
+		}, int64(-2),
 	},
 	{ // "hello"
 		Program{
@@ -123,7 +126,7 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpLessThan), 03, 01, 02,
 			},
-			Constants: []interface{}{1, 2},
+			Constants: []interface{}{int64(1), int64(2)},
 		}, true,
 	},
 	{ // 1 > 2
@@ -132,7 +135,7 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpGreaterThan), 03, 01, 02,
 			},
-			Constants: []interface{}{1, 2},
+			Constants: []interface{}{int64(1), int64(2)},
 		}, false,
 	},
 	{ // 1 == 2
@@ -141,7 +144,7 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpEqual), 03, 01, 02,
 			},
-			Constants: []interface{}{1, 2},
+			Constants: []interface{}{int64(1), int64(2)},
 		}, false,
 	},
 	{ // 1 != 2
@@ -150,7 +153,7 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpNotEqual), 03, 01, 02,
 			},
-			Constants: []interface{}{1, 2},
+			Constants: []interface{}{int64(1), int64(2)},
 		}, true,
 	},
 	{ // true != false
@@ -159,7 +162,7 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpNotEqual), 03, 01, 02,
 			},
-			Constants: []interface{}{1, 2},
+			Constants: []interface{}{int64(1), int64(2)},
 		}, true,
 	},
 	{ // "a" <= "ab"
@@ -196,7 +199,7 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 02, 1,
 				byte(OpCall), 03, 2, 2, 01, 02,
 			},
-			Constants: []interface{}{1, 2, "foo"}}, 3,
+			Constants: []interface{}{int64(1), int64(2), "foo"}}, int64(3),
 	},
 	{ // bar(1, 2, 3)
 		Program{
@@ -206,7 +209,7 @@ var vmTests = []vmTest{
 				byte(OpStoreInt), 03, 2,
 				byte(OpCall), 03, 3, 3, 01, 02, 03,
 			},
-			Constants: []interface{}{1, 2, 3, "bar"}}, 6,
+			Constants: []interface{}{int64(1), int64(2), int64(3), "bar"}}, int64(6),
 	},
 	{ // true or false
 		Program{
@@ -369,7 +372,7 @@ var vmTests = []vmTest{
 			Instructions: []byte{
 				byte(OpLoadConst), 03, 0,
 			},
-			Constants: []interface{}{"var"}}, 1,
+			Constants: []interface{}{"var"}}, int64(1),
 	},
 	{ // var: 1 + par: 2
 		Program{
@@ -378,7 +381,108 @@ var vmTests = []vmTest{
 				byte(OpLoadConst), 02, 1,
 				byte(OpAdd), 03, 01, 02,
 			},
-			Constants: []interface{}{"var", "par"}}, 3,
+			Constants: []interface{}{"var", "par"}}, int64(3),
+	},
+	{ // 2.5 * 2 - 1
+		Program{
+			Instructions: []byte{
+				byte(OpStoreFloat), 01, 0,
+				byte(OpStoreInt), 02, 1,
+				byte(OpMul), 03, 01, 02,
+				byte(OpStoreInt), 02, 2,
+				byte(OpSub), 03, 03, 02,
+			},
+			Constants: []interface{}{2.5, int64(2), int64(1)}}, 4.0,
+	},
+	{ // 1.5 <= 2
+		Program{
+			Instructions: []byte{
+				byte(OpStoreFloat), 01, 0,
+				byte(OpStoreInt), 02, 1,
+				byte(OpLessOrEqual), 03, 01, 02,
+			},
+			Constants: []interface{}{1.5, int64(2)}}, true,
+	},
+	{ // -(7 % 4)
+		Program{
+			Instructions: []byte{
+				byte(OpStoreInt), 01, 0,
+				byte(OpStoreInt), 02, 1,
+				byte(OpMod), 01, 01, 02,
+				byte(OpMinus), 03, 01,
+			},
+			Constants: []interface{}{int64(7), int64(4)}}, int64(-3),
+	},
+	{ // not true
+		Program{
+			Instructions: []byte{
+				byte(OpStoreBool), 01, 1,
+				byte(OpNot), 03, 01,
+			}}, false,
+	},
+	{ // nil
+		Program{
+			Instructions: []byte{
+				byte(OpStoreInt), 03, 0,
+				byte(OpStoreNil), 03,
+			},
+			Constants: []interface{}{int64(1)}}, nil,
+	},
+	{ // [1, "a", 2][1]
+		Program{
+			Instructions: []byte{
+				byte(OpStoreInt), 01, 0,
+				byte(OpStoreString), 02, 1,
+				byte(OpArray), 04, 2, 01, 02,
+				byte(OpStoreInt), 01, 2,
+				byte(OpAppend), 04, 1, 01,
+				byte(OpStoreInt), 01, 0,
+				byte(OpIndex), 03, 04, 01,
+			},
+			Constants: []interface{}{int64(1), "a", int64(2)}}, "a",
+	},
+	{ // [1][5]
+		Program{
+			Instructions: []byte{
+				byte(OpStoreInt), 01, 0,
+				byte(OpArray), 02, 1, 01,
+				byte(OpStoreInt), 01, 1,
+				byte(OpIndex), 03, 02, 01,
+			},
+			Constants: []interface{}{int64(1), int64(5)}}, nil,
+	},
+	{ // int("42")
+		Program{
+			Instructions: []byte{
+				byte(OpStoreString), 01, 0,
+				byte(OpBuiltin), 03, 0, 01,
+			},
+			Constants: []interface{}{"42"}}, int64(42),
+	},
+	{ // 1.5 is float
+		Program{
+			Instructions: []byte{
+				byte(OpStoreFloat), 01, 0,
+				byte(OpIs), 03, 01, 1,
+			},
+			Constants: []interface{}{1.5, "float"}}, true,
+	},
+	{ // 2 as float64
+		Program{
+			Instructions: []byte{
+				byte(OpStoreInt), 03, 0,
+				byte(OpAsFloat), 03,
+			},
+			Constants: []interface{}{int64(2)}}, 2.0,
+	},
+	{ // 1, exit before 2
+		Program{
+			Instructions: []byte{
+				byte(OpStoreInt), 03, 0,
+				byte(OpExit),
+				byte(OpStoreInt), 03, 1,
+			},
+			Constants: []interface{}{int64(1), int64(2)}}, int64(1),
 	},
 }
 
@@ -386,11 +490,11 @@ func TestVM(t *testing.T) {
 	for _, test := range vmTests {
 		vm := New(test.input)
 		err := vm.Run(map[string]interface{}{
-			"foo": func(a, b int) int { return a + b },
-			"bar": func(a, b, c int) int { return a + b + c },
-			"var": 1, "par": 2})
+			"foo": func(a, b int64) int64 { return a + b },
+			"bar": func(a, b, c int64) int64 { return a + b + c },
+			"var": int64(1), "par": int64(2)})
 		require.NoError(t, err, test.input)
-		testExpectedObject(t, test.expected, vm.Registers[3])
+		testExpectedObject(t, test.expected, vm.Result())
 	}
 }
 
@@ -404,3 +508,100 @@ func testExpectedObject(
 		assert.Equal(t, expected, actual)
 	}
 }
+
+func TestRunError(t *testing.T) {
+	tests := []struct {
+		input    Program
+		expected string
+	}{
+		{Program{
+			Instructions: []byte{byte(OpStoreInt), 01, 0, byte(OpStoreInt), 02, 1, byte(OpDiv), 03, 01, 02},
+			Constants:    []interface{}{int64(1), int64(0)}},
+			"integer divide by zero"},
+		{Program{
+			Instructions: []byte{byte(OpStoreInt), 01, 0, byte(OpStoreString), 02, 1, byte(OpSub), 03, 01, 02},
+			Constants:    []interface{}{int64(1), "a"}},
+			"invalid operation: int64 - string"},
+		{Program{
+			Instructions: []byte{byte(OpStoreFloat), 01, 0, byte(OpStoreFloat), 02, 0, byte(OpMod), 03, 01, 02},
+			Constants:    []interface{}{1.5}},
+			"invalid operation: float64 % float64"},
+		{Program{
+			Instructions: []byte{byte(OpStoreString), 01, 0, byte(OpMinus), 03, 01},
+			Constants:    []interface{}{"a"}},
+			"invalid operation: -string"},
+		{Program{
+			Instructions: []byte{byte(OpStoreString), 03, 0, byte(OpAsBool), 03},
+			Constants:    []interface{}{"a"}},
+			`expected bool result, got "a" (string)`},
+		{Program{Instructions: []byte{byte(OpMove), 03, 16}}, "register 16 out of range"},
+	}
+	for _, test := range tests {
+		err := New(test.input).Run(nil)
+		assert.EqualError(t, err, test.expected)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		input  Program
+		limits budget.Limits
+		err    error
+	}{
+		{Program{ // 10 + 20
+			Instructions: []byte{byte(OpStoreInt), 01, 0, byte(OpStoreInt), 02, 1, byte(OpAdd), 03, 01, 02},
+			Constants:    []interface{}{int64(10), int64(20)}},
+			budget.Limits{Instructions: 2}, &budget.InstructionLimitError{Limit: 2}},
+		{Program{ // let a = 1; let b = a; a
+			Instructions: []byte{byte(OpStoreInt), 01, 0, byte(OpStoreLocal), 0, 01, byte(OpStoreLocal), 1, 01, byte(OpMove), 03, 01},
+			Constants:    []interface{}{int64(1)}},
+			budget.Limits{StackDepth: 1}, &budget.StackDepthError{Limit: 1}},
+		{Program{ // [1, 1, 1]
+			Instructions: []byte{byte(OpStoreInt), 01, 0, byte(OpArray), 03, 3, 01, 01, 01},
+			Constants:    []interface{}{int64(1)}},
+			budget.Limits{ArrayLength: 2}, &budget.ArrayLengthError{Limit: 2, Length: 3}},
+		{Program{ // "ab" + "ab"
+			Instructions: []byte{byte(OpStoreString), 01, 0, byte(OpStringConcat), 03, 01, 01},
+			Constants:    []interface{}{"ab"}},
+			budget.Limits{StringLength: 3}, &budget.StringLengthError{Limit: 3, Length: 4}},
+		{Program{
+			Instructions: []byte{byte(OpStoreString), 01, 0, byte(OpAdd), 03, 01, 01},
+			Constants:    []interface{}{"ab"}},
+			budget.Limits{StringLength: 3}, &budget.StringLengthError{Limit: 3, Length: 4}},
+		{Program{
+			Instructions: []byte{byte(OpStoreInt), 01, 0, byte(OpStoreInt), 02, 1, byte(OpAdd), 03, 01, 02},
+			Constants:    []interface{}{int64(10), int64(20)}},
+			budget.Limits{Instructions: 3, StackDepth: 2, ArrayLength: 1, StringLength: 1}, nil},
+	}
+	for _, test := range tests {
+		vm := New(test.input)
+		vm.Limits = test.limits
+		assert.Equal(t, test.err, vm.Run(nil), test.input)
+	}
+}
+
+type contextKey struct{}
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey{}, int64(10)))
+	defer cancel()
+	env := map[string]interface{}{
+		"get":  func(ctx context.Context, x int64) int64 { return ctx.Value(contextKey{}).(int64) + x },
+		"stop": func(x int64) int64 { cancel(); return x },
+	}
+	vm := New(Program{ // get(1)
+		Instructions: []byte{byte(OpStoreInt), 01, 0, byte(OpCall), 03, 1, 1, 01},
+		Constants:    []interface{}{int64(1), "get"}})
+	require.NoError(t, vm.RunContext(ctx, env))
+	assert.Equal(t, int64(11), vm.Result())
+
+	err := New(Program{ // stop(1)
+		Instructions: []byte{byte(OpStoreInt), 01, 0, byte(OpCall), 03, 1, 1, 01},
+		Constants:    []interface{}{int64(1), "stop"}}).RunContext(ctx, env)
+	assert.Equal(t, &budget.InterruptedError{Offset: 3, Err: context.Canceled}, err)
+
+	// without calls the context is checked every budget.CheckInterval instructions
+	err = New(Program{
+		Instructions: bytes.Repeat([]byte{byte(OpMove), 03, 01}, budget.CheckInterval)}).RunContext(ctx, nil)
+	assert.Equal(t, &budget.InterruptedError{Offset: 3 * (budget.CheckInterval - 1), Err: context.Canceled}, err)
+}
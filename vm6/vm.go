@@ -1,19 +1,41 @@
 package vm6
 
 import (
+	"bachelor-thesis/budget"
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/vm/code"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
 )
 
 type VM struct {
+	Limits       budget.Limits // bounds every Run, unlimited by default
 	constants    []interface{}
 	instructions code.Instructions
 	stack        []interface{}
 	stackString  []string
 	stackInt     []int64
+	locals       []interface{}
 	sp           int
+	wide         bool // the next operand follows OpWide
+}
+
+// onStackString and onStackInt mark the elements of stack whose value is held
+// in stackString or stackInt, which tells "" and 0 apart from nil.
+type onStackString struct{}
+
+type onStackInt struct{}
+
+func isString(value interface{}) bool {
+	_, ok := value.(onStackString)
+	return ok
+}
+
+func isInt(value interface{}) bool {
+	_, ok := value.(onStackInt)
+	return ok
 }
 
 func New(instructions code.Instructions, constants []interface{}) *VM {
@@ -28,18 +50,18 @@ func New(instructions code.Instructions, constants []interface{}) *VM {
 }
 
 func (vm *VM) StackTop() interface{} {
-	if vm.stackString[len(vm.stackString)-1] != "" {
-		return vm.stackString[len(vm.stackString)-1]
-	} else if vm.stackInt[len(vm.stackInt)-1] != 0 {
-		return vm.stackInt[len(vm.stackInt)-1]
-	} else if vm.stackInt[len(vm.stackInt)-1] == 0 && vm.stack[len(vm.stack)-1] == nil {
-		return vm.stackInt[len(vm.stackInt)-1]
-	} else {
-		return vm.stack[len(vm.stack)-1]
-	}
+	n := len(vm.stack)
+	return box(vm.stack[n-1], vm.stackString[n-1], vm.stackInt[n-1])
 }
 
 func (vm *VM) Run(env interface{}) error {
+	return vm.RunContext(context.Background(), env)
+}
+
+// RunContext is Run stopping with a *budget.InterruptedError once ctx is done,
+// checked every budget.CheckInterval instructions and around calls. Functions
+// of env taking a context.Context as first parameter receive ctx.
+func (vm *VM) RunContext(ctx context.Context, env interface{}) error {
 	if vm.stack == nil {
 		vm.stack = make([]interface{}, 0, 2)
 	} else {
@@ -55,18 +77,47 @@ func (vm *VM) Run(env interface{}) error {
 	} else {
 		vm.stackInt = vm.stackInt[0:0]
 	}
+	vm.locals = vm.locals[0:0]
 	vm.sp = 0
+	vm.wide = false
+	limited := vm.Limits != budget.Limits{}
+	done := ctx.Done()
+	executed := 0
 	for vm.sp < len(vm.instructions) {
+		if limited || done != nil {
+			executed++
+			if err := vm.Limits.Step(executed, len(vm.stack)); err != nil {
+				return err
+			}
+			if done != nil && executed%budget.CheckInterval == 0 {
+				if err := budget.Interrupted(ctx, vm.sp); err != nil {
+					return err
+				}
+			}
+		}
 		switch code.Opcode(vm.instructions[vm.sp]) {
 		case code.OpConstant:
-			constIndex := binary.BigEndian.Uint16(vm.instructions[vm.sp+1:])
-			vm.sp += 2
+			constIndex := vm.operand()
 			if int(constIndex) >= len(vm.constants) {
 				return fmt.Errorf("constant index out of range: %d", constIndex)
 			}
 			vm.push(vm.constants[constIndex])
 		case code.OpPop:
 			vm.pop()
+		case code.OpDup:
+			vm.stack = append(vm.stack, vm.stack[len(vm.stack)-1])
+			vm.stackString = append(vm.stackString, vm.stackString[len(vm.stackString)-1])
+			vm.stackInt = append(vm.stackInt, vm.stackInt[len(vm.stackInt)-1])
+		case code.OpSwap:
+			n := len(vm.stack)
+			vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-2]
+			vm.stackString[n-2], vm.stackString[n-1] = vm.stackString[n-1], vm.stackString[n-2]
+			vm.stackInt[n-2], vm.stackInt[n-1] = vm.stackInt[n-1], vm.stackInt[n-2]
+		case code.OpRot:
+			n := len(vm.stack)
+			vm.stack[n-3], vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-3], vm.stack[n-2]
+			vm.stackString[n-3], vm.stackString[n-2], vm.stackString[n-1] = vm.stackString[n-1], vm.stackString[n-3], vm.stackString[n-2]
+			vm.stackInt[n-3], vm.stackInt[n-2], vm.stackInt[n-1] = vm.stackInt[n-1], vm.stackInt[n-3], vm.stackInt[n-2]
 		case code.OpTrue:
 			vm.push(true)
 		case code.OpFalse:
@@ -76,83 +127,62 @@ func (vm *VM) Run(env interface{}) error {
 		case code.OpAdd:
 			a, as, ai := vm.pop()
 			b, bs, bi := vm.pop()
-			if a == nil && b == nil && as == "" && bs == "" {
-				vm.push(bi + ai)
-			} else if a == nil && b == nil {
-				vm.push(bs + as)
-			} else if a != nil && b != nil {
-				vm.push(vm.executeAddOperation(b, a))
-			} else if b != nil {
-				vm.push(vm.executeAddOperation(b, ai))
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi + ai)
+			} else if isString(a) && isString(b) {
+				if err := vm.Limits.Concat(len(bs) + len(as)); err != nil {
+					return err
+				}
+				vm.pushString(bs + as)
 			} else {
-				vm.push(vm.executeAddOperation(bi, a))
+				vm.push(vm.executeAddOperation(box(b, bs, bi), box(a, as, ai)))
 			}
 		case code.OpSub:
-			a, _, ai := vm.pop()
-			b, _, bi := vm.pop()
-			if a == nil && b == nil {
-				vm.push(bi - ai)
-			} else if a != nil && b != nil {
-				vm.push(vm.executeSubtractOperation(b, a))
-			} else if b != nil {
-				vm.push(vm.executeSubtractOperation(b, ai))
+			a, as, ai := vm.pop()
+			b, bs, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi - ai)
 			} else {
-				vm.push(vm.executeSubtractOperation(bi, a))
+				vm.push(vm.executeSubtractOperation(box(b, bs, bi), box(a, as, ai)))
 			}
 		case code.OpMul:
-			a, _, ai := vm.pop()
-			b, _, bi := vm.pop()
-			if a == nil && b == nil {
-				vm.push(bi * ai)
-			} else if a != nil && b != nil {
-				vm.push(vm.executeMultiplyOperation(b, a))
-			} else if b != nil {
-				vm.push(vm.executeMultiplyOperation(b, ai))
+			a, as, ai := vm.pop()
+			b, bs, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi * ai)
 			} else {
-				vm.push(vm.executeMultiplyOperation(bi, a))
+				vm.push(vm.executeMultiplyOperation(box(b, bs, bi), box(a, as, ai)))
 			}
 		case code.OpDiv:
-			a, _, ai := vm.pop()
-			b, _, bi := vm.pop()
-			if a == nil && b == nil {
-				vm.push(bi / ai)
-			} else if a != nil && b != nil {
-				vm.push(vm.executeDivideOperation(b, a))
-			} else if b != nil {
-				vm.push(vm.executeDivideOperation(b, ai))
+			a, as, ai := vm.pop()
+			b, bs, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi / ai)
 			} else {
-				vm.push(vm.executeDivideOperation(bi, a))
+				vm.push(vm.executeDivideOperation(box(b, bs, bi), box(a, as, ai)))
 			}
 		case code.OpMod:
-			a, _, ai := vm.pop()
-			b, _, bi := vm.pop()
-			if a == nil && b == nil {
-				vm.push(bi % ai)
-			} else if a != nil && b != nil {
-				vm.push(vm.executeRemainderOperation(b, a))
-			} else if b != nil {
-				vm.push(vm.executeRemainderOperation(b, ai))
+			a, as, ai := vm.pop()
+			b, bs, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.pushInt(bi % ai)
 			} else {
-				vm.push(vm.executeRemainderOperation(bi, a))
+				vm.push(vm.executeRemainderOperation(box(b, bs, bi), box(a, as, ai)))
 			}
 		case code.OpExp:
-			a, _, ai := vm.pop()
-			b, _, bi := vm.pop()
-			if a == nil && b == nil {
-				vm.push(int64(math.Pow(float64(bi), float64(ai))))
-			} else if a != nil && b != nil {
-				vm.push(vm.executeExponentiationOperation(b, a))
-			} else if b != nil {
-				vm.push(vm.executeExponentiationOperation(b, ai))
+			a, as, ai := vm.pop()
+			b, bs, bi := vm.pop()
+			if isInt(a) && isInt(b) {
+				vm.pushInt(int64(math.Pow(float64(bi), float64(ai))))
 			} else {
-				vm.push(vm.executeExponentiationOperation(bi, a))
+				vm.push(vm.executeExponentiationOperation(box(b, bs, bi), box(a, as, ai)))
 			}
 		case code.OpMinus:
 			vm.push(vm.executeMinusOperator())
 		case code.OpEqual, code.OpNotEqual, code.OpLessThan, code.OpGreaterThan, code.OpLessOrEqual, code.OpGreaterOrEqual:
 			a, as, ai := vm.pop()
 			b, bs, bi := vm.pop()
-			if a == nil && b == nil && as == "" && bs == "" {
+			if isInt(a) && isInt(b) {
 				switch code.Opcode(vm.instructions[vm.sp]) {
 				case code.OpLessThan:
 					vm.push(bi < ai)
@@ -167,7 +197,7 @@ func (vm *VM) Run(env interface{}) error {
 				case code.OpEqual:
 					vm.push(bi == ai)
 				}
-			} else if a == nil && b == nil && as != "" && bs != "" {
+			} else if isString(a) && isString(b) {
 				switch code.Opcode(vm.instructions[vm.sp]) {
 				case code.OpLessThan:
 					vm.push(bs < as)
@@ -182,47 +212,209 @@ func (vm *VM) Run(env interface{}) error {
 				case code.OpEqual:
 					vm.push(bs == as)
 				}
-			} else if a != nil && b != nil {
-				vm.push(vm.executeComparisonOperation(a, b, code.Opcode(vm.instructions[vm.sp])))
-			} else if b != nil {
-				vm.push(vm.executeComparisonOperation(ai, b, code.Opcode(vm.instructions[vm.sp])))
 			} else {
-				vm.push(vm.executeComparisonOperation(a, bi, code.Opcode(vm.instructions[vm.sp])))
+				vm.push(vm.executeComparisonOperation(box(a, as, ai), box(b, bs, bi), code.Opcode(vm.instructions[vm.sp])))
 			}
 		case code.OpArray:
-			numElements := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			numElements := vm.operand()
+			if err := vm.Limits.Array(numElements); err != nil {
+				return err
+			}
 			array := make([]interface{}, numElements)
 			for i := numElements - 1; i >= 0; i-- {
-				a, as, ai := vm.pop()
-				if a == nil && as == "" {
-					array[i] = ai
-				} else if a == nil {
-					array[i] = as
-				} else {
-					array[i] = a
-				}
+				array[i] = vm.popValue()
 			}
 			vm.push(array)
 		case code.OpIndex:
-			_, _, index := vm.pop()
-			array, _, _ := vm.pop()
+			index := vm.popValue()
+			array := vm.popValue()
 			vm.executeIndexOperation(array, index)
 		case code.OpNot:
-			v, _, _ := vm.pop()
-			vm.push(!v.(bool))
+			vm.push(!vm.popValue().(bool))
 		case code.OpJumpIfTrue:
-			pos := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			pos := vm.operand()
 			if vm.StackTop().(bool) {
 				vm.sp += pos
 			}
 		case code.OpJumpIfFalse:
-			pos := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
-			vm.sp += 2
+			pos := vm.operand()
 			if !vm.StackTop().(bool) {
 				vm.sp += pos
 			}
+		case code.OpJump:
+			pos := vm.operand()
+			vm.sp += pos
+		case code.OpGetLocal:
+			slot := vm.operand()
+			vm.push(vm.locals[slot])
+		case code.OpSetLocal:
+			slot := vm.operand()
+			for len(vm.locals) <= slot {
+				vm.locals = append(vm.locals, nil)
+			}
+			vm.locals[slot] = vm.popValue()
+			vm.push(vm.locals[slot])
+		case code.OpBuiltin:
+			index := vm.operand()
+			value, err := builtin.Builtins[index].Call(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpIs:
+			constIndex := vm.operand()
+			vm.push(builtin.Is(vm.popValue(), vm.constants[constIndex].(string)))
+		case code.OpPushInt:
+			constIndex := vm.operand()
+			vm.pushInt(vm.constants[constIndex].(int64))
+		case code.OpPushFloat:
+			constIndex := vm.operand()
+			vm.pushBoxed(vm.constants[constIndex])
+		case code.OpPushStr:
+			constIndex := vm.operand()
+			vm.pushString(vm.constants[constIndex].(string))
+		case code.OpAddInt:
+			a, b := vm.popInts()
+			vm.pushInt(a + b)
+		case code.OpSubInt:
+			a, b := vm.popInts()
+			vm.pushInt(a - b)
+		case code.OpMulInt:
+			a, b := vm.popInts()
+			vm.pushInt(a * b)
+		case code.OpDivInt:
+			a, b := vm.popInts()
+			vm.pushInt(a / b)
+		case code.OpModInt:
+			a, b := vm.popInts()
+			vm.pushInt(a % b)
+		case code.OpExpInt:
+			a, b := vm.popInts()
+			vm.pushInt(int64(math.Pow(float64(a), float64(b))))
+		case code.OpMinusInt:
+			vm.pushInt(-vm.popInt())
+		case code.OpAddFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(a + b)
+		case code.OpSubFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(a - b)
+		case code.OpMulFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(a * b)
+		case code.OpDivFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(a / b)
+		case code.OpExpFloat:
+			a, b := vm.popFloats()
+			vm.pushFloat(math.Pow(a, b))
+		case code.OpMinusFloat:
+			vm.pushFloat(-vm.popFloat())
+		case code.OpConcatStr:
+			a, b := vm.popStrings()
+			if err := vm.Limits.Concat(len(a) + len(b)); err != nil {
+				return err
+			}
+			vm.pushString(a + b)
+		case code.OpEqInt:
+			a, b := vm.popInts()
+			vm.push(a == b)
+		case code.OpNeInt:
+			a, b := vm.popInts()
+			vm.push(a != b)
+		case code.OpLtInt:
+			a, b := vm.popInts()
+			vm.push(a < b)
+		case code.OpGtInt:
+			a, b := vm.popInts()
+			vm.push(a > b)
+		case code.OpLeInt:
+			a, b := vm.popInts()
+			vm.push(a <= b)
+		case code.OpGeInt:
+			a, b := vm.popInts()
+			vm.push(a >= b)
+		case code.OpEqFloat:
+			a, b := vm.popFloats()
+			vm.push(a == b)
+		case code.OpNeFloat:
+			a, b := vm.popFloats()
+			vm.push(a != b)
+		case code.OpLtFloat:
+			a, b := vm.popFloats()
+			vm.push(a < b)
+		case code.OpGtFloat:
+			a, b := vm.popFloats()
+			vm.push(a > b)
+		case code.OpLeFloat:
+			a, b := vm.popFloats()
+			vm.push(a <= b)
+		case code.OpGeFloat:
+			a, b := vm.popFloats()
+			vm.push(a >= b)
+		case code.OpEqStr:
+			a, b := vm.popStrings()
+			vm.push(a == b)
+		case code.OpNeStr:
+			a, b := vm.popStrings()
+			vm.push(a != b)
+		case code.OpLtStr:
+			a, b := vm.popStrings()
+			vm.push(a < b)
+		case code.OpGtStr:
+			a, b := vm.popStrings()
+			vm.push(a > b)
+		case code.OpLeStr:
+			a, b := vm.popStrings()
+			vm.push(a <= b)
+		case code.OpGeStr:
+			a, b := vm.popStrings()
+			vm.push(a >= b)
+		case code.OpLoadConst:
+			value, err := builtin.Load(env, vm.constants[vm.operand()])
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpCall:
+			offset := vm.sp
+			numArgs := vm.operand()
+			fn := vm.popValue()
+			args := make([]interface{}, numArgs)
+			for i := numArgs - 1; i >= 0; i-- {
+				args[i] = vm.popValue()
+			}
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
+			value, err := call(ctx, fn, args)
+			if err != nil {
+				return err
+			}
+			if err := budget.Interrupted(ctx, offset); err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpAsBool:
+			value, err := builtin.AsBool(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpAsInt:
+			value, err := builtin.AsInt64(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpAsFloat:
+			value, err := builtin.AsFloat64(vm.popValue())
+			if err != nil {
+				return err
+			}
+			vm.push(value)
+		case code.OpWide:
+			vm.wide = true
 		default:
 			return fmt.Errorf("unsupported opcode: %d", code.Opcode(vm.instructions[vm.sp]))
 		}
@@ -231,16 +423,26 @@ func (vm *VM) Run(env interface{}) error {
 	return nil
 }
 
+// operand reads the operand of the current instruction and moves past it.
+// After OpWide the operand is four bytes instead of two.
+func (vm *VM) operand() int {
+	if vm.wide {
+		vm.wide = false
+		value := int(binary.BigEndian.Uint32(vm.instructions[vm.sp+1:]))
+		vm.sp += 4
+		return value
+	}
+	value := int(binary.BigEndian.Uint16(vm.instructions[vm.sp+1:]))
+	vm.sp += 2
+	return value
+}
+
 func (vm *VM) push(value interface{}) {
 	switch v := value.(type) {
 	case string:
-		vm.stackString = append(vm.stackString, v)
-		vm.stack = append(vm.stack, nil)
-		vm.stackInt = append(vm.stackInt, 0)
+		vm.pushString(v)
 	case int64:
-		vm.stackInt = append(vm.stackInt, v)
-		vm.stack = append(vm.stack, nil)
-		vm.stackString = append(vm.stackString, "")
+		vm.pushInt(v)
 	default:
 		vm.stack = append(vm.stack, value)
 		vm.stackInt = append(vm.stackInt, 0)
@@ -257,3 +459,83 @@ func (vm *VM) pop() (interface{}, string, int64) {
 	vm.stackInt = vm.stackInt[:len(vm.stackInt)-1]
 	return value, valueString, valueInt
 }
+
+// popValue pops the top element and boxes it back from whichever stack holds it.
+func (vm *VM) popValue() interface{} {
+	return box(vm.pop())
+}
+
+func box(value interface{}, valueString string, valueInt int64) interface{} {
+	switch value.(type) {
+	case onStackString:
+		return valueString
+	case onStackInt:
+		return valueInt
+	}
+	return value
+}
+
+// The typed instructions know which stack holds their operands.
+
+func (vm *VM) pushInt(value int64) {
+	vm.stackInt = append(vm.stackInt, value)
+	vm.stack = append(vm.stack, onStackInt{})
+	vm.stackString = append(vm.stackString, "")
+}
+
+func (vm *VM) pushFloat(value float64) {
+	vm.pushBoxed(value)
+}
+
+// pushBoxed pushes a value already stored in an interface, such as a
+// constant, without boxing it again.
+func (vm *VM) pushBoxed(value interface{}) {
+	vm.stack = append(vm.stack, value)
+	vm.stackInt = append(vm.stackInt, 0)
+	vm.stackString = append(vm.stackString, "")
+}
+
+func (vm *VM) pushString(value string) {
+	vm.stackString = append(vm.stackString, value)
+	vm.stack = append(vm.stack, onStackString{})
+	vm.stackInt = append(vm.stackInt, 0)
+}
+
+func (vm *VM) drop() {
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	vm.stackString = vm.stackString[:len(vm.stackString)-1]
+	vm.stackInt = vm.stackInt[:len(vm.stackInt)-1]
+}
+
+func (vm *VM) popInt() int64 {
+	value := vm.stackInt[len(vm.stackInt)-1]
+	vm.drop()
+	return value
+}
+
+func (vm *VM) popFloat() float64 {
+	value := vm.stack[len(vm.stack)-1].(float64)
+	vm.drop()
+	return value
+}
+
+func (vm *VM) popString() string {
+	value := vm.stackString[len(vm.stackString)-1]
+	vm.drop()
+	return value
+}
+
+func (vm *VM) popInts() (int64, int64) {
+	b := vm.popInt()
+	return vm.popInt(), b
+}
+
+func (vm *VM) popFloats() (float64, float64) {
+	b := vm.popFloat()
+	return vm.popFloat(), b
+}
+
+func (vm *VM) popStrings() (string, string) {
+	b := vm.popString()
+	return vm.popString(), b
+}
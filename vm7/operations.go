@@ -1,9 +1,12 @@
 package vm7
 
 import (
+	"bachelor-thesis/builtin"
 	"bachelor-thesis/vm/code"
+	"context"
 	"fmt"
 	"math"
+	"reflect"
 )
 
 func (vm *VM) executeAddOperation(a, b interface{}) interface{} {
@@ -77,6 +80,17 @@ func (vm *VM) executeDivideOperation(a, b interface{}) interface{} {
 	panic(fmt.Sprintf("invalid operation: %T / %T", a, b))
 }
 
+func (vm *VM) executeRemainderOperation(a, b interface{}) interface{} {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x % y
+		}
+	}
+	panic(fmt.Sprintf("invalid operation: %T mod %T", a, b))
+}
+
 func (vm *VM) executeExponentiationOperation(a, b interface{}) interface{} {
 	switch x := a.(type) {
 	case int64:
@@ -96,11 +110,10 @@ func (vm *VM) executeExponentiationOperation(a, b interface{}) interface{} {
 }
 
 func (vm *VM) executeMinusOperator() interface{} {
-	operand, _, operandi := vm.pop()
-	if operand == nil {
-		return -operandi
-	}
+	operand := vm.popValue()
 	switch x := operand.(type) {
+	case int64:
+		return -x
 	case float64:
 		return -x
 	}
@@ -221,9 +234,30 @@ func (vm *VM) executeIndexOperation(array interface{}, index interface{}) {
 		vm.push(nil)
 		return
 	}
-	switch t := arrayObject[i].(type) {
-	case int64, float64, bool, string:
-		vm.push(t)
-		return
+	vm.push(arrayObject[i])
+}
+
+// call calls an environment function, passing ctx when it takes a context. A
+// function may return an error as its second result.
+func call(ctx context.Context, fn interface{}, args []interface{}) (interface{}, error) {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%v is not a function", fn)
+	}
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		if arg == nil {
+			in[i] = reflect.ValueOf(&args[i]).Elem()
+		} else {
+			in[i] = reflect.ValueOf(arg)
+		}
+	}
+	out := f.Call(builtin.WithContext(ctx, f, in))
+	if len(out) == 0 {
+		return nil, nil
+	}
+	if len(out) == 2 && out[1].Type() == reflect.TypeOf((*error)(nil)).Elem() && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
 	}
+	return out[0].Interface(), nil
 }